@@ -0,0 +1,170 @@
+/*
+Copyright © 2023 NAME HERE <EMAIL ADDRESS>
+
+*/
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/glebarez/sqlite"
+	"github.com/spf13/cobra"
+	"github.com/yang-zzhong/xl/database"
+	"github.com/yang-zzhong/xl/migrate"
+	"gorm.io/driver/mysql"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+var (
+	migrateDialect string
+	migrateDSN     string
+	migrateDir     string
+	migrateTable   string
+)
+
+// migrateCmd represents the migrate command
+var migrateCmd = &cobra.Command{
+	Use:   "migrate",
+	Short: "Apply, revert and create the sql migrations of a directory",
+	Long: `Apply, revert and create the versioned sql migrations of a directory. the migrations are
+named <version>_<name>.up.sql and <version>_<name>.down.sql, and the ones applied are recorded
+in the history table. For example:
+
+xl migrate create add_email --dir migrations
+xl migrate up --dsn "root@tcp(127.0.0.1:3306)/test?parseTime=True"
+xl migrate up --dialect postgres --dsn "postgres://root@127.0.0.1:5432/test"
+xl migrate down 2
+xl migrate status`,
+}
+
+var migrateUpCmd = &cobra.Command{
+	Use:   "up [n]",
+	Short: "Apply n pending migrations, all of them if n is not given",
+	Args:  cobra.MaximumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		n, err := steps(args, 0)
+		if err != nil {
+			return err
+		}
+		m, err := migrator()
+		if err != nil {
+			return err
+		}
+		applied, err := m.Up(context.Background(), n)
+		for _, migration := range applied {
+			fmt.Fprintf(cmd.OutOrStdout(), "up %s_%s\n", migration.Version, migration.Name)
+		}
+		return err
+	},
+}
+
+var migrateDownCmd = &cobra.Command{
+	Use:   "down [n]",
+	Short: "Revert the n migrations applied last, 1 if n is not given",
+	Args:  cobra.MaximumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		n, err := steps(args, 1)
+		if err != nil {
+			return err
+		}
+		m, err := migrator()
+		if err != nil {
+			return err
+		}
+		reverted, err := m.Down(context.Background(), n)
+		for _, migration := range reverted {
+			fmt.Fprintf(cmd.OutOrStdout(), "down %s_%s\n", migration.Version, migration.Name)
+		}
+		return err
+	},
+}
+
+var migrateStatusCmd = &cobra.Command{
+	Use:   "status",
+	Short: "Show the migrations applied and the ones pending",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		m, err := migrator()
+		if err != nil {
+			return err
+		}
+		statuses, err := m.Status(context.Background())
+		if err != nil {
+			return err
+		}
+		for _, status := range statuses {
+			state := "pending"
+			if status.AppliedAt != nil {
+				state = "applied at " + status.AppliedAt.Format(time.RFC3339)
+			}
+			if status.Missing {
+				state += " (missing)"
+			}
+			fmt.Fprintf(cmd.OutOrStdout(), "%s_%s\t%s\n", status.Version, status.Name, state)
+		}
+		return nil
+	},
+}
+
+var migrateCreateCmd = &cobra.Command{
+	Use:   "create <name>",
+	Short: "Create the empty up and down sql files of a migration",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		up, down, err := migrate.Create(migrateDir, args[0], time.Now())
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(cmd.OutOrStdout(), "created %s\ncreated %s\n", up, down)
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(migrateCmd)
+	migrateCmd.AddCommand(migrateUpCmd, migrateDownCmd, migrateStatusCmd, migrateCreateCmd)
+	migrateCmd.PersistentFlags().StringVar(&migrateDialect, "dialect", database.MySQL, "the dialect of the database, mysql, postgres or sqlite")
+	migrateCmd.PersistentFlags().StringVar(&migrateDSN, "dsn", "root@tcp(127.0.0.1:3306)/test?charset=utf8mb4&parseTime=True&loc=Local", "the dsn of the database")
+	migrateCmd.PersistentFlags().StringVar(&migrateDir, "dir", "migrations", "the directory of the migrations")
+	migrateCmd.PersistentFlags().StringVar(&migrateTable, "table", migrate.DefaultTable, "the history table of the migrations")
+}
+
+func steps(args []string, n int) (int, error) {
+	if len(args) == 0 {
+		return n, nil
+	}
+	n, err := strconv.Atoi(args[0])
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid steps %q", args[0])
+	}
+	return n, nil
+}
+
+func migrator() (*migrate.Migrator, error) {
+	var dialector gorm.Dialector
+	switch migrateDialect {
+	case database.MySQL:
+		dialector = mysql.Open(migrateDSN)
+	case database.Postgres:
+		dialector = postgres.Open(migrateDSN)
+	case database.SQLite:
+		dialector = sqlite.Open(migrateDSN)
+	default:
+		return nil, fmt.Errorf("unknown dialect %q", migrateDialect)
+	}
+	db, err := gorm.Open(dialector, &gorm.Config{Logger: logger.Default.LogMode(logger.Warn)})
+	if err != nil {
+		return nil, fmt.Errorf("can't open %s: %w", migrateDialect, err)
+	}
+	m := migrate.New(db, migrate.Table(migrateTable))
+	if err := m.Load(os.DirFS(migrateDir)); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
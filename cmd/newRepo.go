@@ -8,33 +8,36 @@ import (
 	"fmt"
 
 	"github.com/spf13/cobra"
+	"github.com/yang-zzhong/xl/database"
 )
 
+var newRepoTemplate database.RepositoryTemplate
+
 // newRepoCmd represents the newRepo command
 var newRepoCmd = &cobra.Command{
 	Use:   "newRepo",
-	Short: "A brief description of your command",
-	Long: `A longer description that spans multiple lines and likely contains examples
-and usage of using your command. For example:
-
-Cobra is a CLI library for Go that empowers applications.
-This application is a tool to generate the needed files
-to quickly create a Cobra application.`,
-	Run: func(cmd *cobra.Command, args []string) {
-		fmt.Println("newRepo called")
+	Short: "Generate the model, the repository and its tests of a package",
+	Long: `Generate the model, the repository and the tests of the repository into a new package. the
+generated tests expect the sql of the dialect, which is one of mysql, postgres and sqlite. For example:
+
+xl newRepo --package internal/user --model User
+xl newRepo --root /path/to/project --package order --model Order --dialect postgres`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if err := newRepoTemplate.Create(); err != nil {
+			return err
+		}
+		fmt.Fprintf(cmd.OutOrStdout(), "created repository of %s in %s\n", newRepoTemplate.Model, newRepoTemplate.Package)
+		return nil
 	},
 }
 
 func init() {
 	rootCmd.AddCommand(newRepoCmd)
-
-	// Here you will define your flags and configuration settings.
-
-	// Cobra supports Persistent Flags which will work for this command
-	// and all subcommands, e.g.:
-	// newRepoCmd.PersistentFlags().String("foo", "", "A help for foo")
-
-	// Cobra supports local flags which will only run when this command
-	// is called directly, e.g.:
-	// newRepoCmd.Flags().BoolP("toggle", "t", false, "Help message for toggle")
+	newRepoCmd.Flags().StringVar(&newRepoTemplate.RootDirectory, "root", "", "the directory the package is created in")
+	newRepoCmd.Flags().StringVar(&newRepoTemplate.Package, "package", "", "the package of the repository")
+	newRepoCmd.Flags().StringVar(&newRepoTemplate.Model, "model", "", "the model of the repository")
+	newRepoCmd.Flags().StringVar(&newRepoTemplate.Dialect, "dialect", database.MySQL, "the dialect of the sql expected by the tests, mysql, postgres or sqlite")
+	newRepoCmd.MarkFlagRequired("package")
+	newRepoCmd.MarkFlagRequired("model")
 }
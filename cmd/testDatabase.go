@@ -6,6 +6,7 @@ package cmd
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"os"
 	"time"
@@ -83,6 +84,23 @@ func run(cmd *cobra.Command, args []string) {
 		}
 		return nil
 	})
+	test("optimistic lock", db, func() error {
+		repo := database.NewGormRepository(db)
+		book := Book{ID: uuid.NewString(), Name: "book1"}
+		if err := repo.Create(ctx, &book); err != nil {
+			return errs.Wrap(err, "create book")
+		}
+		stale := book
+		book.Name = "book2"
+		if err := repo.Update(ctx, &book); err != nil {
+			return errs.Wrap(err, "update book")
+		}
+		stale.Name = "book3"
+		if err := repo.Update(ctx, &stale); !errors.Is(err, database.ErrConflict) {
+			return fmt.Errorf("update stale book: expect conflict, got %v", err)
+		}
+		return nil
+	})
 }
 
 type User struct {
@@ -100,6 +118,7 @@ type Book struct {
 	Name      string
 	AuthorID  string
 	Phone     string
+	Version   int64          `lock:"version"`
 	CreatedAt time.Time      `gorm:"<-:create,autoCreateTime"`
 	UpdateAt  time.Time      `gorm:"autoCreateTime"`
 	DeletedAt gorm.DeletedAt `gorm:"index"`
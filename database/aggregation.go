@@ -0,0 +1,137 @@
+package database
+
+import (
+	"strings"
+)
+
+// Aggregation an aggregate function of a column selected as Alias, see Sum, Avg, Min, Max, Count and CountDistinct
+type Aggregation struct {
+	Func     string
+	Field    string
+	Distinct bool
+	Alias    string
+}
+
+// Sum the sum of field, selected as sum_<field> if no alias is given
+func Sum(field string) Aggregation {
+	return Aggregation{Func: "SUM", Field: field}
+}
+
+// Avg the average of field, selected as avg_<field> if no alias is given
+func Avg(field string) Aggregation {
+	return Aggregation{Func: "AVG", Field: field}
+}
+
+// Min the minimum of field, selected as min_<field> if no alias is given
+func Min(field string) Aggregation {
+	return Aggregation{Func: "MIN", Field: field}
+}
+
+// Max the maximum of field, selected as max_<field> if no alias is given
+func Max(field string) Aggregation {
+	return Aggregation{Func: "MAX", Field: field}
+}
+
+// Count the count of the rows whose field is not null, or of all rows if field is *.
+// selected as count_<field>, or count for *, if no alias is given
+func Count(field string) Aggregation {
+	return Aggregation{Func: "COUNT", Field: field}
+}
+
+// CountDistinct the count of the distinct values of field, selected as count_distinct_<field> if no alias is given
+func CountDistinct(field string) Aggregation {
+	return Aggregation{Func: "COUNT", Field: field, Distinct: true}
+}
+
+// As select the aggregation as alias
+func (a Aggregation) As(alias string) Aggregation {
+	a.Alias = alias
+	return a
+}
+
+// as the alias of the aggregation, which is the column the result is scanned from
+func (a Aggregation) as() string {
+	if a.Alias != "" {
+		return a.Alias
+	}
+	name := strings.ToLower(a.Func)
+	if a.Distinct {
+		name += "_distinct"
+	}
+	if a.Field == "*" {
+		return name
+	}
+	return name + "_" + lastSegment(a.Field)
+}
+
+// expr the aggregate of the field like sum(amount), which quote compiles to the aggregate function
+func (a Aggregation) expr() string {
+	if a.Distinct {
+		return a.Func + "(DISTINCT " + a.Field + ")"
+	}
+	return a.Func + "(" + a.Field + ")"
+}
+
+// unaliased the matches of opts whose fields are the aliases of aggs are matched by the aggregates, for the
+// dialects like postgres whose HAVING knows no alias of the selected columns
+func unaliased(opts MatchOptions, aggs []Aggregation) MatchOptions {
+	matches := make([]MatchItem, len(opts.Matches))
+	for i, item := range opts.Matches {
+		switch value := item.Value.(type) {
+		case MatchOptions:
+			item.Value = unaliased(value, aggs)
+		default:
+			for _, agg := range aggs {
+				if item.Field != "" && item.Field == agg.as() {
+					item.Field = agg.expr()
+					break
+				}
+			}
+		}
+		matches[i] = item
+	}
+	opts.Matches = matches
+	return opts
+}
+
+// GroupBy group the records by the columns
+func (m *Model) GroupBy(columns ...string) *Model {
+	if m.Grp == nil {
+		m.Grp = &Group{}
+	}
+	m.Grp.By = strings.Join(columns, ",")
+	return m
+}
+
+// Having filter the groups, the aggregations are matched by their alias, which is compiled to the aggregate on postgres
+//   M(&stats, &Order{}).GroupBy("tenant_id").Aggregate(Sum("amount").As("total")).
+//       Having(func(opts *MatchOptions) { opts.GT("total", 100) })
+func (m *Model) Having(opts ...MatchOption) *Model {
+	if m.Grp == nil {
+		m.Grp = &Group{}
+	}
+	if m.Grp.Having == nil {
+		m.Grp.Having = &MatchOptions{}
+	}
+	m.Grp.Having.Apply(opts...)
+	return m
+}
+
+// Aggregate select the group by columns and the aggregations, the result is scanned into
+// the struct fields named after the columns and the aliases, or into the maps keyed by them
+//   var stats []struct {
+//       TenantID int64
+//       Total    float64
+//       Orders   int64
+//   }
+//   err := repo.Find(ctx, M(&stats, &Order{}).GroupBy("tenant_id").Aggregate(
+//       Sum("amount").As("total"),
+//       Count("*").As("orders"),
+//   ))
+//   // or
+//   var rows []map[string]interface{}
+//   err := repo.Find(ctx, M(&rows, &Order{}).GroupBy("tenant_id", "status").Aggregate(Avg("amount"), Max("amount")))
+func (m *Model) Aggregate(aggs ...Aggregation) *Model {
+	m.Aggs = append(m.Aggs, aggs...)
+	return m
+}
@@ -0,0 +1,74 @@
+package database
+
+import (
+	"context"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGormRepository_Aggregate(t *testing.T) {
+	db, mock, gdb := mockDB(t)
+	defer db.Close()
+	repo := NewGormRepository(gdb)
+	func() {
+		execSql := "^SELECT `tenant_id`,SUM\\(`amount`\\) AS `total`,COUNT\\(\\*\\) AS `count`,COUNT\\(DISTINCT `orders`\\.`id`\\) AS `count_distinct_id` " +
+			"FROM `orders` WHERE `amount` > \\? GROUP BY `tenant_id` HAVING `total` > \\? ORDER BY `total` DESC$"
+		mock.ExpectQuery(execSql).
+			WithArgs(0, 10).
+			WillReturnRows(sqlmock.NewRows([]string{"tenant_id", "total", "count", "count_distinct_id"}).
+				AddRow(1, 30.5, 3, 3).
+				AddRow(2, 20, 2, 1))
+	}()
+	var stats []struct {
+		TenantID        int64
+		Total           float64
+		Count           int64
+		CountDistinctID int64
+	}
+	m := M(&stats, &Order{}).
+		GroupBy("tenant_id").
+		Aggregate(Sum("amount").As("total"), Count("*"), CountDistinct("orders.id")).
+		Having(func(opts *MatchOptions) { opts.GT("total", 10) })
+	err := repo.Find(context.Background(), m, func(opts *MatchOptions) { opts.GT("amount", 0).SetSort("-total") })
+	assert.Nil(t, err)
+	assert.Len(t, stats, 2)
+	assert.Equal(t, int64(1), stats[0].TenantID)
+	assert.Equal(t, 30.5, stats[0].Total)
+	assert.Equal(t, int64(3), stats[0].Count)
+	assert.Equal(t, int64(1), stats[1].CountDistinctID)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestGormRepository_AggregateMaps(t *testing.T) {
+	db, mock, gdb := mockDB(t)
+	defer db.Close()
+	repo := NewGormRepository(gdb)
+	func() {
+		execSql := "^SELECT `tenant_id`,`author_id`,AVG\\(`amount`\\) AS `avg_amount`,MIN\\(`amount`\\) AS `min_amount`,MAX\\(`amount`\\) AS `max_amount` " +
+			"FROM `orders` GROUP BY `tenant_id`,`author_id`$"
+		mock.ExpectQuery(execSql).
+			WillReturnRows(sqlmock.NewRows([]string{"tenant_id", "author_id", "avg_amount", "min_amount", "max_amount"}).
+				AddRow(1, 2, 15, 10, 20))
+	}()
+	var rows []map[string]interface{}
+	m := M(&rows, &Order{}).GroupBy("tenant_id", "author_id").Aggregate(Avg("amount"), Min("amount"), Max("amount"))
+	err := repo.Find(context.Background(), m)
+	assert.Nil(t, err)
+	assert.Equal(t, []map[string]interface{}{
+		{"tenant_id": int64(1), "author_id": int64(2), "avg_amount": int64(15), "min_amount": int64(10), "max_amount": int64(20)},
+	}, rows)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestGormRepository_AggregateInvalid(t *testing.T) {
+	db, _, gdb := mockDB(t)
+	defer db.Close()
+	repo := NewGormRepository(gdb)
+	var rows []map[string]interface{}
+	err := repo.Find(context.Background(), M(&rows, &Order{}).Aggregate(Sum("amount").As("total; DROP TABLE orders")))
+	assert.ErrorIs(t, err, ErrInvalidIdentifier)
+	err = repo.Find(context.Background(), M(&rows, &Order{}).Aggregate(Aggregation{Func: "SLEEP", Field: "amount"}))
+	assert.ErrorIs(t, err, ErrInvalidIdentifier)
+}
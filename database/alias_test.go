@@ -0,0 +1,58 @@
+package database
+
+import (
+	"context"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+)
+
+type Employee struct {
+	ID        int64
+	Name      string
+	ManagerID int64
+}
+
+type EmployeeWithManager struct {
+	Name    string `field:"name"`
+	Manager string `field:"m.name"`
+	Mentor  string `field:"t.name"`
+}
+
+func TestGormRepository_SelfJoin(t *testing.T) {
+	db, mock, gdb := mockDB(t)
+	defer db.Close()
+	repo := NewGormRepository(gdb)
+	func() {
+		execSql := "^SELECT e\\.name AS name,m\\.name AS manager,t\\.name AS mentor FROM employees AS `e` " +
+			"LEFT JOIN employees AS `m` ON `m`\\.`id` = `e`\\.`manager_id` " +
+			"Inner JOIN employees AS `t` ON `t`\\.`id` = `m`\\.`manager_id` " +
+			"WHERE `e`\\.`name` LIKE \\?$"
+		mock.ExpectQuery(execSql).
+			WithArgs("a%").
+			WillReturnRows(sqlmock.NewRows([]string{"name", "manager", "mentor"}).AddRow("a", "b", "c"))
+	}()
+	var rows []EmployeeWithManager
+	m := M(&rows, &Employee{}).As("e").
+		With(As(&Employee{}, "m"), func(opts *MatchOptions) { opts.EQ("m.id", Field("e.manager_id")) }).
+		IWith(As(&Employee{}, "t"), func(opts *MatchOptions) { opts.EQ("t.id", Field("m.manager_id")) })
+	err := repo.Find(context.Background(), m, func(opts *MatchOptions) { opts.StartsWith("e.name", "a") })
+	assert.Nil(t, err)
+	assert.Equal(t, []EmployeeWithManager{{Name: "a", Manager: "b", Mentor: "c"}}, rows)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestGormRepository_AliasInvalid(t *testing.T) {
+	db, mock, gdb := mockDB(t)
+	defer db.Close()
+	repo := NewGormRepository(gdb)
+	var rows []EmployeeWithManager
+	err := repo.Find(context.Background(), M(&rows, &Employee{}).With(As(&Employee{}, "m; DROP"), func(opts *MatchOptions) {
+		opts.EQ("m.id", Field("employees.manager_id"))
+	}))
+	assert.ErrorIs(t, err, ErrInvalidIdentifier)
+	err = repo.Count(context.Background(), M(nil, &Employee{}).As("e.x"), new(int64))
+	assert.ErrorIs(t, err, ErrInvalidIdentifier)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
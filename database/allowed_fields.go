@@ -0,0 +1,176 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+)
+
+var (
+	ErrFieldNotAllowed = errors.New("field not allowed")
+)
+
+// AllowedField a field of the model allowed in the user-facing filters
+type AllowedField struct {
+	// Name the name exposed to the user
+	Name string
+	// Column the column matched
+	Column string
+	// Type the type of the struct field
+	Type reflect.Type
+	// Sortable whether sorting by it is allowed
+	Sortable bool
+}
+
+// AllowedFields the whitelist of the fields of a model. a column qualified by a table is allowed only if the
+// table is the model's own, or its alias given by As
+type AllowedFields struct {
+	byName   map[string]AllowedField
+	byColumn map[string]AllowedField
+	table    string
+	alias    string
+}
+
+var allowedFields sync.Map
+
+// Allowed the fields of model allowed in the user-facing filters, derived from the filter tags of model.
+// the tag is `filter:"[name][,sort]"`, the column is used as the name when name is omitted
+//   type Book struct {
+//       ID        string    `filter:"id,sort"`
+//       AuthorID  string    `filter:"author"` // exposed as author, matches the column author_id
+//       CreatedAt time.Time `filter:",sort"`  // exposed as created_at
+//       Secret    string                      // not allowed
+//   }
+func Allowed(model interface{}) *AllowedFields {
+	t := indirectType(reflect.TypeOf(model))
+	if allowed, ok := allowedFields.Load(t); ok {
+		return allowed.(*AllowedFields)
+	}
+	allowed := &AllowedFields{byName: map[string]AllowedField{}, byColumn: map[string]AllowedField{}, table: modelTable(t)}
+	allowed.parse(t)
+	actual, _ := allowedFields.LoadOrStore(t, allowed)
+	return actual.(*AllowedFields)
+}
+
+func (allowed *AllowedFields) parse(t reflect.Type) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.Anonymous && indirectType(f.Type).Kind() == reflect.Struct {
+			allowed.parse(indirectType(f.Type))
+			continue
+		}
+		tag, ok := f.Tag.Lookup("filter")
+		if !ok || tag == "-" || !f.IsExported() {
+			continue
+		}
+		parts := strings.Split(tag, ",")
+		field := AllowedField{Name: parts[0], Column: columnName(f), Type: f.Type}
+		if field.Name == "" {
+			field.Name = field.Column
+		}
+		for _, opt := range parts[1:] {
+			if strings.TrimSpace(opt) == "sort" {
+				field.Sortable = true
+			}
+		}
+		allowed.byName[field.Name] = field
+		allowed.byColumn[field.Column] = field
+	}
+}
+
+// As the allowed fields of the model aliased as alias, the columns qualified by the alias are allowed
+// rather than the ones qualified by the table
+//   err := Allowed(&Employee{}).As("e").Validate(opts)
+func (allowed *AllowedFields) As(alias string) *AllowedFields {
+	aliased := *allowed
+	aliased.alias = alias
+	return &aliased
+}
+
+// Lookup the allowed field exposed as name
+func (allowed *AllowedFields) Lookup(name string) (AllowedField, bool) {
+	field, ok := allowed.byName[name]
+	return field, ok
+}
+
+// Fields all of the allowed fields ordered by name
+func (allowed *AllowedFields) Fields() []AllowedField {
+	fields := make([]AllowedField, 0, len(allowed.byName))
+	for _, field := range allowed.byName {
+		fields = append(fields, field)
+	}
+	sort.Slice(fields, func(i, j int) bool { return fields[i].Name < fields[j].Name })
+	return fields
+}
+
+// Validate every column matched and sorted by in opts is allowed. raw sqls are never allowed
+func (allowed *AllowedFields) Validate(opts MatchOptions) error {
+	for _, item := range opts.Matches {
+		if err := allowed.validateItem(item); err != nil {
+			return err
+		}
+	}
+	for _, spec := range opts.Sort {
+		column, _, err := ParseSort(spec)
+		if err != nil {
+			return err
+		}
+		if field, ok := allowed.column(column); !ok || !field.Sortable {
+			return fmt.Errorf("%w: sort by %q", ErrFieldNotAllowed, column)
+		}
+	}
+	return nil
+}
+
+func (allowed *AllowedFields) validateItem(item MatchItem) error {
+	switch item.Operator {
+	case OR, AND, NOT:
+		return allowed.Validate(MatchOptions{Matches: item.Value.(MatchOptions).Matches})
+	case EXISTS, NOTEXISTS:
+		return fmt.Errorf("%w: subquery", ErrFieldNotAllowed)
+	case FULLTEXT:
+		for _, f := range item.Value.(FullText).Fields {
+			if err := allowed.validateColumn(f); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if ref, ok := item.Value.(Field); ok {
+		if err := allowed.validateColumn(string(ref)); err != nil {
+			return err
+		}
+	}
+	return allowed.validateColumn(item.Field)
+}
+
+func (allowed *AllowedFields) validateColumn(name string) error {
+	column, err := Identifier(name)
+	if err != nil {
+		return err
+	}
+	if _, ok := allowed.column(column); !ok {
+		return fmt.Errorf("%w: %q", ErrFieldNotAllowed, name)
+	}
+	return nil
+}
+
+// column the allowed field of column, column may be qualified by the table of the model or its alias. the
+// columns of other tables are never allowed, even if they share the name of an allowed one
+func (allowed *AllowedFields) column(column string) (AllowedField, bool) {
+	if i := strings.LastIndex(column, "."); i >= 0 {
+		qualifier := allowed.table
+		if allowed.alias != "" {
+			qualifier = allowed.alias
+		}
+		if column[:i] != qualifier {
+			return AllowedField{}, false
+		}
+		column = column[i+1:]
+	}
+	field, ok := allowed.byColumn[column]
+	return field, ok
+}
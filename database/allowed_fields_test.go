@@ -0,0 +1,98 @@
+package database
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type Filtered struct {
+	ID        string    `filter:"id,sort"`
+	AuthorID  string    `filter:"author"`
+	Title     string    `gorm:"column:book_title" filter:"title"`
+	CreatedAt time.Time `filter:",sort"`
+	Secret    string
+}
+
+func TestParseSort(t *testing.T) {
+	cases := []struct {
+		spec   string
+		column string
+		desc   bool
+		err    error
+	}{
+		{spec: "name", column: "name"},
+		{spec: "name ASC", column: "name"},
+		{spec: "books.name desc", column: "books.name", desc: true},
+		{spec: "-created_at", column: "created_at", desc: true},
+		{spec: Field("name").DESC(), column: "name", desc: true},
+		{spec: "`books`.`name` DESC", column: "books.name", desc: true},
+		{spec: "name; DROP TABLE books", err: ErrInvalidSort},
+		{spec: "-name DESC", err: ErrInvalidSort},
+		{spec: "(SELECT 1)", err: ErrInvalidSort},
+		{spec: "-(id)", err: ErrInvalidIdentifier},
+		{spec: "name RANDOM", err: ErrInvalidSort},
+	}
+	for _, c := range cases {
+		column, desc, err := ParseSort(c.spec)
+		if c.err != nil {
+			assert.True(t, errors.Is(err, c.err), c.spec)
+			continue
+		}
+		assert.Nil(t, err, c.spec)
+		assert.Equal(t, c.column, column, c.spec)
+		assert.Equal(t, c.desc, desc, c.spec)
+	}
+}
+
+func TestAllowed(t *testing.T) {
+	allowed := Allowed(&[]Filtered{})
+	assert.Same(t, allowed, Allowed(Filtered{}))
+	names := []string{}
+	for _, f := range allowed.Fields() {
+		names = append(names, f.Name)
+	}
+	assert.Equal(t, []string{"author", "created_at", "id", "title"}, names)
+	title, ok := allowed.Lookup("title")
+	assert.True(t, ok)
+	assert.Equal(t, AllowedField{Name: "title", Column: "book_title", Type: reflect.TypeOf("")}, title)
+	_, ok = allowed.Lookup("secret")
+	assert.False(t, ok)
+}
+
+func TestAllowedFields_Validate(t *testing.T) {
+	allowed := Allowed(Filtered{})
+	cases := []struct {
+		name string
+		opts MatchOptions
+		err  error
+	}{
+		{name: "allowed", opts: (&MatchOptions{}).Apply(
+			func(opts *MatchOptions) { opts.EQ("author_id", "1").IN("filtereds.id", []string{"1"}).SetSort("-created_at") },
+			Or(func(opts *MatchOptions) { opts.Contains("book_title", "go") }),
+		)},
+		{name: "not allowed", opts: (&MatchOptions{}).Apply(func(opts *MatchOptions) { opts.EQ("secret", "1") }), err: ErrFieldNotAllowed},
+		{name: "in group", opts: (&MatchOptions{}).Apply(Not(func(opts *MatchOptions) { opts.EQ("secret", "1") })), err: ErrFieldNotAllowed},
+		{name: "field value", opts: (&MatchOptions{}).Apply(func(opts *MatchOptions) { opts.EQ("id", Field("secret")) }), err: ErrFieldNotAllowed},
+		{name: "injection", opts: (&MatchOptions{}).Apply(func(opts *MatchOptions) { opts.EQ("id = id OR 1", "1") }), err: ErrInvalidIdentifier},
+		{name: "not sortable", opts: (&MatchOptions{}).Apply(func(opts *MatchOptions) { opts.SetSort("author_id") }), err: ErrFieldNotAllowed},
+		{name: "other table", opts: (&MatchOptions{}).Apply(func(opts *MatchOptions) { opts.EQ("secrets.id", "1") }), err: ErrFieldNotAllowed},
+		{name: "other table sort", opts: (&MatchOptions{}).Apply(func(opts *MatchOptions) { opts.SetSort("users.id") }), err: ErrFieldNotAllowed},
+		{name: "subquery", opts: (&MatchOptions{}).Apply(func(opts *MatchOptions) { opts.Exists(Raw("SELECT 1")) }), err: ErrFieldNotAllowed},
+	}
+	for _, c := range cases {
+		err := allowed.Validate(c.opts)
+		if c.err == nil {
+			assert.Nil(t, err, c.name)
+			continue
+		}
+		assert.True(t, errors.Is(err, c.err), c.name)
+	}
+	aliased := allowed.As("f")
+	assert.Nil(t, aliased.Validate((&MatchOptions{}).Apply(func(opts *MatchOptions) { opts.EQ("f.id", "1").SetSort("f.id") })))
+	assert.ErrorIs(t, aliased.Validate((&MatchOptions{}).Apply(func(opts *MatchOptions) { opts.EQ("filtereds.id", "1") })), ErrFieldNotAllowed)
+	assert.ErrorIs(t, allowed.Validate((&MatchOptions{}).Apply(func(opts *MatchOptions) { opts.EQ("f.id", "1") })), ErrFieldNotAllowed)
+}
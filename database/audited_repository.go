@@ -0,0 +1,422 @@
+package database
+
+import (
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+// DefaultAuditTable the table of the audit entries if AuditTable is not given
+const DefaultAuditTable = "audit_entries"
+
+// the operations audited
+const (
+	AuditCreate           = "create"
+	AuditUpdate           = "update"
+	AuditUpdateFields     = "update fields"
+	AuditBulkUpdateFields = "bulk update fields"
+	AuditDelete           = "delete"
+	AuditForceDelete      = "force delete"
+	AuditRestore          = "restore"
+)
+
+// ErrNotAudited the write can't be audited by the audited repository
+var ErrNotAudited = errors.New("not audited")
+
+// Change the value of a column before and after the change
+type Change struct {
+	Before interface{} `json:"before"`
+	After  interface{} `json:"after"`
+}
+
+// AuditEntry a change of a record made by an actor
+type AuditEntry struct {
+	ID int64 `gorm:"primarykey"`
+	// Model the model of the record, like the type name of the model
+	Model    string `gorm:"size:128;index:idx_audit_record"`
+	RecordID string `gorm:"size:64;index:idx_audit_record"`
+	Op       string `gorm:"size:32"`
+	Actor    string `gorm:"size:128"`
+	// Before the columns of the record before the change, nil if the record didn't exist
+	Before map[string]interface{} `gorm:"serializer:json"`
+	// After the columns of the record after the change, nil if the record is deleted
+	After map[string]interface{} `gorm:"serializer:json"`
+	// Changes the columns changed
+	Changes   map[string]Change `gorm:"serializer:json"`
+	CreatedAt time.Time
+
+	table string
+}
+
+func (e *AuditEntry) valueTable() string {
+	return e.table
+}
+
+type actorKey struct{}
+
+// WithActor derive a ctx whose writes are audited as made by actor
+//   ctx = database.WithActor(r.Context(), user.ID)
+func WithActor(ctx context.Context, actor string) context.Context {
+	return context.WithValue(ctx, actorKey{}, actor)
+}
+
+// ActorOf the actor carried by ctx, empty if there's none
+func ActorOf(ctx context.Context) string {
+	actor, _ := ctx.Value(actorKey{}).(string)
+	return actor
+}
+
+// AuditOptions options of the audited repository
+type AuditOptions struct {
+	// Table the table the audit entries are written to
+	Table string
+	// Actor the actor of the writes made with the ctx
+	Actor func(ctx context.Context) string
+}
+
+type AuditOption func(*AuditOptions)
+
+// AuditTable write the audit entries to table
+func AuditTable(table string) AuditOption {
+	return func(opts *AuditOptions) { opts.Table = table }
+}
+
+// AuditActor take the actor of the writes from ctx by actor rather than ActorOf
+func AuditActor(actor func(ctx context.Context) string) AuditOption {
+	return func(opts *AuditOptions) { opts.Actor = actor }
+}
+
+// AuditedRepository a Repository recording the before and after of the records written by Create,
+// CreateInBatches, Update, UpdateFields, BulkUpdateFields, Delete, ForceDelete and Restore. the records
+// written are locked and fetched before the write and fetched after it, the audit entries are written in
+// the same transaction as the write. Upsert is refused with ErrNotAudited
+type AuditedRepository struct {
+	Repository
+	opts AuditOptions
+}
+
+// NewAuditedRepository audit the writes to repo, the audit entries are written via repo as well
+// usage:
+//   repo := NewAuditedRepository(NewGormRepository(db), AuditTable("user_audits"))
+//   err := repo.UpdateFields(database.WithActor(ctx, "admin"), &User{}, Fields{"role": "member"}, ID("1"))
+//   entries, err := repo.History(ctx, &User{}, "1")
+func NewAuditedRepository(repo Repository, opts ...AuditOption) *AuditedRepository {
+	r := &AuditedRepository{Repository: repo}
+	r.opts.Table = DefaultAuditTable
+	r.opts.Actor = ActorOf
+	for _, apply := range opts {
+		apply(&r.opts)
+	}
+	return r
+}
+
+// History the audit entries of the record of model v whose primary key is id, the earliest first
+func (r *AuditedRepository) History(ctx context.Context, v interface{}, id interface{}, opts ...MatchOption) ([]AuditEntry, error) {
+	entries := []AuditEntry{}
+	opts = append([]MatchOption{func(opts *MatchOptions) {
+		opts.EQ("model", modelName(v)).EQ("record_id", fmt.Sprint(id)).SetSort("id")
+	}}, opts...)
+	if err := r.Repository.Find(ctx, M(&entries, &AuditEntry{table: r.opts.Table}), opts...); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+func (r *AuditedRepository) Create(ctx context.Context, v interface{}) error {
+	return r.auditCreate(ctx, v, func(ctx context.Context, repo Repository) error {
+		return repo.Create(ctx, v)
+	})
+}
+
+func (r *AuditedRepository) CreateInBatches(ctx context.Context, v interface{}, batchSize int) error {
+	return r.auditCreate(ctx, v, func(ctx context.Context, repo Repository) error {
+		return repo.CreateInBatches(ctx, v, batchSize)
+	})
+}
+
+// Upsert is refused, whether the records are created or updated is unknown before the write
+func (r *AuditedRepository) Upsert(ctx context.Context, v interface{}, conflict []string, update ...string) error {
+	return fmt.Errorf("%w: upsert %T", ErrNotAudited, v)
+}
+
+func (r *AuditedRepository) Update(ctx context.Context, v interface{}) error {
+	return r.audit(ctx, AuditUpdate, v, nil, func(ctx context.Context, repo Repository) error {
+		return repo.Update(ctx, v)
+	})
+}
+
+func (r *AuditedRepository) UpdateFields(ctx context.Context, v interface{}, fields Fields, opts ...MatchOption) error {
+	return r.audit(ctx, AuditUpdateFields, v, opts, func(ctx context.Context, repo Repository) error {
+		return repo.UpdateFields(ctx, v, fields, opts...)
+	})
+}
+
+func (r *AuditedRepository) BulkUpdateFields(ctx context.Context, v interface{}, rows map[interface{}]Fields) error {
+	if len(rows) == 0 {
+		return r.Repository.BulkUpdateFields(ctx, v, rows)
+	}
+	pk, ok := primaryKeyColumn(reflect.TypeOf(v))
+	if !ok {
+		return fmt.Errorf("audit: %T has no primary key", v)
+	}
+	keys := make([]interface{}, 0, len(rows))
+	for key := range rows {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool { return fmt.Sprint(keys[i]) < fmt.Sprint(keys[j]) })
+	matches := []MatchOption{func(opts *MatchOptions) { opts.IN(pk, keys) }}
+	return r.audit(ctx, AuditBulkUpdateFields, v, matches, func(ctx context.Context, repo Repository) error {
+		return repo.BulkUpdateFields(ctx, v, rows)
+	})
+}
+
+func (r *AuditedRepository) Delete(ctx context.Context, v interface{}, opts ...MatchOption) error {
+	return r.audit(ctx, AuditDelete, v, opts, func(ctx context.Context, repo Repository) error {
+		return repo.Delete(ctx, v, opts...)
+	})
+}
+
+func (r *AuditedRepository) ForceDelete(ctx context.Context, v interface{}, opts ...MatchOption) error {
+	matches := append([]MatchOption{WithTrashed()}, opts...)
+	return r.audit(ctx, AuditForceDelete, v, matches, func(ctx context.Context, repo Repository) error {
+		return repo.ForceDelete(ctx, v, opts...)
+	})
+}
+
+func (r *AuditedRepository) Restore(ctx context.Context, v interface{}, opts ...MatchOption) error {
+	matches := append(append([]MatchOption{}, opts...), OnlyTrashed())
+	return r.audit(ctx, AuditRestore, v, matches, func(ctx context.Context, repo Repository) error {
+		return repo.Restore(ctx, v, opts...)
+	})
+}
+
+// Transaction the repo passed to do audits its writes as well
+func (r *AuditedRepository) Transaction(ctx context.Context, do func(ctx context.Context, repo Repository) error, opts ...TxOption) error {
+	return r.Repository.Transaction(ctx, func(ctx context.Context, repo Repository) error {
+		return do(ctx, &AuditedRepository{Repository: repo, opts: r.opts})
+	}, opts...)
+}
+
+// auditRecord the columns of a record audited, keyed by its primary key
+type auditRecord struct {
+	id      interface{}
+	key     string
+	columns map[string]interface{}
+}
+
+// audit fetch the records of model v matched by opts, run write, and record the changes of them.
+// the record of v itself is matched if its primary key is set
+func (r *AuditedRepository) audit(ctx context.Context, op string, v interface{}, opts []MatchOption, write func(ctx context.Context, repo Repository) error) error {
+	pk, ok := primaryKeyColumn(reflect.TypeOf(v))
+	if !ok {
+		return fmt.Errorf("audit: %T has no primary key", v)
+	}
+	opt := &MatchOptions{}
+	opt.Apply(opts...)
+	if id, ok := fieldByColumn(reflect.ValueOf(v), pk); ok && !id.IsZero() {
+		opts = append(append([]MatchOption{}, opts...), func(opts *MatchOptions) { opts.EQ(pk, id.Interface()) })
+	} else if len(opt.Matches) == 0 {
+		// nothing to audit, the write either creates the record or is refused for missing conditions
+		return r.Repository.Transaction(ctx, write)
+	}
+	return r.Repository.Transaction(ctx, func(ctx context.Context, repo Repository) error {
+		// lock the records so that the befores are the ones the write changes
+		befores, err := records(ctx, repo, v, pk, append(append([]MatchOption{}, opts...), ForUpdate())...)
+		if err != nil {
+			return err
+		}
+		if err := write(ctx, repo); err != nil {
+			return err
+		}
+		afters := map[string]auditRecord{}
+		switch op {
+		case AuditDelete, AuditForceDelete:
+		case AuditUpdate:
+			after := auditRecord{columns: columnsOf(reflect.ValueOf(v))}
+			after.key = fmt.Sprint(after.columns[pk])
+			afters[after.key] = after
+		default:
+			ids := make([]interface{}, len(befores))
+			for i, before := range befores {
+				ids[i] = before.id
+			}
+			if len(ids) == 0 {
+				break
+			}
+			found, err := records(ctx, repo, v, pk, func(opts *MatchOptions) { opts.IN(pk, ids).WithTrashed() })
+			if err != nil {
+				return err
+			}
+			for _, after := range found {
+				afters[after.key] = after
+			}
+		}
+		for _, before := range befores {
+			after, ok := afters[before.key]
+			if err := r.record(ctx, repo, op, v, before.key, before.columns, after.columns, ok); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// auditCreate run write creating the record v, or the slice of records v, and record the columns created
+func (r *AuditedRepository) auditCreate(ctx context.Context, v interface{}, write func(ctx context.Context, repo Repository) error) error {
+	pk, ok := primaryKeyColumn(reflect.TypeOf(v))
+	if !ok {
+		return fmt.Errorf("audit: %T has no primary key", v)
+	}
+	return r.Repository.Transaction(ctx, func(ctx context.Context, repo Repository) error {
+		if err := write(ctx, repo); err != nil {
+			return err
+		}
+		created := reflect.ValueOf(v)
+		for created.Kind() == reflect.Ptr {
+			created = created.Elem()
+		}
+		if created.Kind() != reflect.Slice && created.Kind() != reflect.Array {
+			after := columnsOf(created)
+			return r.record(ctx, repo, AuditCreate, v, fmt.Sprint(after[pk]), nil, after, true)
+		}
+		for i := 0; i < created.Len(); i++ {
+			after := columnsOf(created.Index(i))
+			if err := r.record(ctx, repo, AuditCreate, v, fmt.Sprint(after[pk]), nil, after, true); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// record write the audit entry of the record keyed by key, skipped if the record still exists unchanged
+func (r *AuditedRepository) record(ctx context.Context, repo Repository, op string, v interface{}, key string, before, after map[string]interface{}, exists bool) error {
+	entry := &AuditEntry{
+		Model:    modelName(v),
+		RecordID: key,
+		Op:       op,
+		Actor:    r.opts.Actor(ctx),
+		Before:   before,
+		After:    after,
+		Changes:  changes(before, after),
+		table:    r.opts.Table,
+	}
+	if exists && len(entry.Changes) == 0 {
+		return nil
+	}
+	return repo.Create(ctx, entry)
+}
+
+// records fetch the records of model v matched by opts
+func records(ctx context.Context, repo Repository, v interface{}, pk string, opts ...MatchOption) ([]auditRecord, error) {
+	slice := reflect.New(reflect.SliceOf(indirectType(reflect.TypeOf(v))))
+	if err := repo.Find(ctx, slice.Interface(), opts...); err != nil {
+		return nil, err
+	}
+	found := make([]auditRecord, slice.Elem().Len())
+	for i := range found {
+		columns := columnsOf(slice.Elem().Index(i))
+		found[i] = auditRecord{id: columns[pk], key: fmt.Sprint(columns[pk]), columns: columns}
+	}
+	return found, nil
+}
+
+// columnsOf the values of the columns of the struct v, the relations are left out
+func columnsOf(v reflect.Value) map[string]interface{} {
+	for v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			return nil
+		}
+		v = v.Elem()
+	}
+	columns := map[string]interface{}{}
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		fv := v.Field(i)
+		if f.Anonymous && indirectType(f.Type).Kind() == reflect.Struct && !isValue(f.Type) {
+			for column, value := range columnsOf(fv) {
+				columns[column] = value
+			}
+			continue
+		}
+		if !f.IsExported() || strings.TrimSpace(f.Tag.Get("gorm")) == "-" || !isValue(f.Type) {
+			continue
+		}
+		if valuer, ok := fv.Interface().(driver.Valuer); ok {
+			if fv.Kind() == reflect.Ptr && fv.IsNil() {
+				columns[columnName(f)] = nil
+				continue
+			}
+			value, err := valuer.Value()
+			if err == nil {
+				columns[columnName(f)] = value
+				continue
+			}
+		}
+		columns[columnName(f)] = fv.Interface()
+	}
+	return columns
+}
+
+var (
+	timeType   = reflect.TypeOf(time.Time{})
+	valuerType = reflect.TypeOf((*driver.Valuer)(nil)).Elem()
+)
+
+// isValue whether the field of type t is a column rather than a relation
+func isValue(t reflect.Type) bool {
+	if t.Implements(valuerType) || reflect.PtrTo(t).Implements(valuerType) {
+		return true
+	}
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	switch t.Kind() {
+	case reflect.Struct:
+		return t == timeType
+	case reflect.Slice, reflect.Array:
+		return t.Elem().Kind() == reflect.Uint8
+	case reflect.Map, reflect.Chan, reflect.Func, reflect.Interface:
+		return false
+	}
+	return true
+}
+
+// changes the columns whose values differ between before and after, the values are compared by their json
+func changes(before, after map[string]interface{}) map[string]Change {
+	diff := map[string]Change{}
+	for column, value := range before {
+		if after == nil {
+			diff[column] = Change{Before: value}
+			continue
+		}
+		if !sameJSON(value, after[column]) {
+			diff[column] = Change{Before: value, After: after[column]}
+		}
+	}
+	for column, value := range after {
+		if _, ok := before[column]; !ok {
+			diff[column] = Change{After: value}
+		}
+	}
+	return diff
+}
+
+func sameJSON(a, b interface{}) bool {
+	ja, err := json.Marshal(a)
+	if err != nil {
+		return false
+	}
+	jb, err := json.Marshal(b)
+	if err != nil {
+		return false
+	}
+	return string(ja) == string(jb)
+}
@@ -0,0 +1,152 @@
+package database
+
+import (
+	"context"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAuditedRepository_UpdateFields(t *testing.T) {
+	db, mock, gdb := mockDB(t)
+	defer db.Close()
+	repo := NewAuditedRepository(NewGormRepository(gdb), AuditTable("user_audits"))
+	mock.ExpectBegin()
+	mock.ExpectQuery("^SELECT \\* FROM `users` WHERE `name` = \\? FOR UPDATE$").
+		WithArgs("a").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name"}).AddRow("1", "a").AddRow("2", "a"))
+	mock.ExpectExec("^UPDATE `users` SET `name`=\\? WHERE `name` = \\?$").
+		WithArgs("b", "a").
+		WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectQuery("^SELECT \\* FROM `users` WHERE `id` IN \\(\\?,\\?\\)$").
+		WithArgs("1", "2").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name"}).AddRow("1", "b").AddRow("2", "b"))
+	for _, id := range []string{"1", "2"} {
+		mock.ExpectExec("^INSERT INTO `user_audits` \\(`model`,`record_id`,`op`,`actor`,`before`,`after`,`changes`,`created_at`\\) VALUES").
+			WithArgs("database.User", id, AuditUpdateFields, "admin",
+				`{"id":"`+id+`","name":"a"}`, `{"id":"`+id+`","name":"b"}`, `{"name":{"before":"a","after":"b"}}`, AnyTime{}).
+			WillReturnResult(sqlmock.NewResult(1, 1))
+	}
+	mock.ExpectCommit()
+	ctx := WithActor(context.Background(), "admin")
+	err := repo.UpdateFields(ctx, &User{}, Fields{"name": "b"}, func(opts *MatchOptions) { opts.EQ("name", "a") })
+	assert.Nil(t, err)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestAuditedRepository_Delete(t *testing.T) {
+	db, mock, gdb := mockDB(t)
+	defer db.Close()
+	repo := NewAuditedRepository(NewGormRepository(gdb), AuditActor(func(ctx context.Context) string { return "system" }))
+	mock.ExpectBegin()
+	mock.ExpectQuery("^SELECT \\* FROM `users` WHERE `id` = \\? FOR UPDATE$").
+		WithArgs("1").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name"}).AddRow("1", "a"))
+	mock.ExpectExec("^DELETE FROM `users` WHERE `users`\\.`id` = \\?$").
+		WithArgs("1").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("^INSERT INTO `audit_entries` ").
+		WithArgs("database.User", "1", AuditDelete, "system",
+			`{"id":"1","name":"a"}`, nil, `{"id":{"before":"1","after":null},"name":{"before":"a","after":null}}`, AnyTime{}).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+	err := repo.Delete(context.Background(), &User{ID: "1"})
+	assert.Nil(t, err)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestAuditedRepository_Update(t *testing.T) {
+	db, mock, gdb := mockDB(t)
+	defer db.Close()
+	repo := NewAuditedRepository(NewGormRepository(gdb))
+	mock.ExpectBegin()
+	mock.ExpectQuery("^SELECT \\* FROM `users` WHERE `id` = \\? FOR UPDATE$").
+		WithArgs("1").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name"}).AddRow("1", "a"))
+	mock.ExpectExec("^UPDATE `users` SET `name`=\\? WHERE `id` = \\?$").
+		WithArgs("a", "1").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	// nothing changed, nothing audited
+	err := repo.Update(context.Background(), &User{ID: "1", Name: "a"})
+	assert.Nil(t, err)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestAuditedRepository_History(t *testing.T) {
+	db, mock, gdb := mockDB(t)
+	defer db.Close()
+	repo := NewAuditedRepository(NewGormRepository(gdb), AuditTable("user_audits"))
+	mock.ExpectQuery("^SELECT \\* FROM `user_audits` WHERE `model` = \\? AND `record_id` = \\? ORDER BY `id` LIMIT 10$").
+		WithArgs("database.User", "1").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "model", "record_id", "op", "actor", "changes"}).
+			AddRow(1, "database.User", "1", AuditUpdate, "admin", `{"name":{"before":"a","after":"b"}}`))
+	entries, err := repo.History(context.Background(), &User{}, "1", func(opts *MatchOptions) { opts.SetLimit(10) })
+	assert.Nil(t, err)
+	assert.Len(t, entries, 1)
+	assert.Equal(t, "admin", entries[0].Actor)
+	assert.Equal(t, Change{Before: "a", After: "b"}, entries[0].Changes["name"])
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestAuditedRepository_BulkUpdateFields(t *testing.T) {
+	db, mock, gdb := mockDB(t)
+	defer db.Close()
+	repo := NewAuditedRepository(NewGormRepository(gdb))
+	mock.ExpectBegin()
+	mock.ExpectQuery("^SELECT \\* FROM `users` WHERE `id` IN \\(\\?,\\?\\) FOR UPDATE$").
+		WithArgs("1", "2").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name"}).AddRow("1", "a").AddRow("2", "b"))
+	mock.ExpectExec("^UPDATE `users` SET `name`=CASE `id` WHEN \\? THEN \\? WHEN \\? THEN \\? ELSE `name` END WHERE `id` IN \\(\\?,\\?\\)$").
+		WithArgs("1", "a", "2", "c", "1", "2").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery("^SELECT \\* FROM `users` WHERE `id` IN \\(\\?,\\?\\)$").
+		WithArgs("1", "2").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name"}).AddRow("1", "a").AddRow("2", "c"))
+	// the record unchanged is not audited
+	mock.ExpectExec("^INSERT INTO `audit_entries` ").
+		WithArgs("database.User", "2", AuditBulkUpdateFields, "",
+			`{"id":"2","name":"b"}`, `{"id":"2","name":"c"}`, `{"name":{"before":"b","after":"c"}}`, AnyTime{}).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+	err := repo.BulkUpdateFields(context.Background(), &User{}, map[interface{}]Fields{
+		"1": {"name": "a"},
+		"2": {"name": "c"},
+	})
+	assert.Nil(t, err)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestAuditedRepository_Create(t *testing.T) {
+	db, mock, gdb := mockDB(t)
+	defer db.Close()
+	repo := NewAuditedRepository(NewGormRepository(gdb))
+	mock.ExpectBegin()
+	// CreateInBatches runs in a savepoint of the transaction auditing it
+	mock.ExpectExec("^SAVEPOINT ").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("^INSERT INTO `users` \\(`id`,`name`\\) VALUES \\(\\?,\\?\\),\\(\\?,\\?\\)$").
+		WithArgs("1", "a", "2", "b").
+		WillReturnResult(sqlmock.NewResult(0, 2))
+	for _, user := range []User{{ID: "1", Name: "a"}, {ID: "2", Name: "b"}} {
+		mock.ExpectExec("^INSERT INTO `audit_entries` ").
+			WithArgs("database.User", user.ID, AuditCreate, "admin",
+				nil, `{"id":"`+user.ID+`","name":"`+user.Name+`"}`,
+				`{"id":{"before":null,"after":"`+user.ID+`"},"name":{"before":null,"after":"`+user.Name+`"}}`, AnyTime{}).
+			WillReturnResult(sqlmock.NewResult(1, 1))
+	}
+	mock.ExpectCommit()
+	ctx := WithActor(context.Background(), "admin")
+	err := repo.CreateInBatches(ctx, []User{{ID: "1", Name: "a"}, {ID: "2", Name: "b"}}, 10)
+	assert.Nil(t, err)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestAuditedRepository_Upsert(t *testing.T) {
+	db, mock, gdb := mockDB(t)
+	defer db.Close()
+	repo := NewAuditedRepository(NewGormRepository(gdb))
+	err := repo.Upsert(context.Background(), &User{ID: "1", Name: "a"}, []string{"id"}, "name")
+	assert.ErrorIs(t, err, ErrNotAudited)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
@@ -0,0 +1,331 @@
+package database
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/yang-zzhong/xl/cache"
+	"github.com/yang-zzhong/xl/utils"
+)
+
+// DefaultCacheTTL the ttl of the records cached if CacheTTL is not given
+const DefaultCacheTTL = 5 * time.Minute
+
+// CacheOptions options of the cached repository
+type CacheOptions struct {
+	// Prefix the prefix of the cache keys
+	Prefix string
+	// TTL the ttl of the records cached
+	TTL time.Duration
+	// NegativeTTL the ttl of the not found cached, not found is not cached if it's zero
+	NegativeTTL time.Duration
+	// Cacheable whether the query of v is served from the cache
+	Cacheable func(v interface{}, opts *MatchOptions) bool
+}
+
+type CacheOption func(*CacheOptions)
+
+// CachePrefix set the prefix of the cache keys
+func CachePrefix(prefix string) CacheOption {
+	return func(opts *CacheOptions) { opts.Prefix = prefix }
+}
+
+// CacheTTL set the ttl of the records cached
+func CacheTTL(ttl time.Duration) CacheOption {
+	return func(opts *CacheOptions) { opts.TTL = ttl }
+}
+
+// NegativeTTL cache the not found for ttl
+func NegativeTTL(ttl time.Duration) CacheOption {
+	return func(opts *CacheOptions) { opts.NegativeTTL = ttl }
+}
+
+// CacheIf serve the queries from the cache only if cacheable returns true
+//   repo := NewCachedRepository(repo, c, CacheIf(func(v interface{}, opts *MatchOptions) bool {
+//       _, ok := v.(*User)
+//       return ok
+//   }))
+func CacheIf(cacheable func(v interface{}, opts *MatchOptions) bool) CacheOption {
+	return func(opts *CacheOptions) { opts.Cacheable = cacheable }
+}
+
+// cacheable by default every query but the ones joining, preloading, uniting or subquerying
+// other models, which are not invalidated when the other models are written, and the ones locking
+func cacheable(v interface{}, opts *MatchOptions) bool {
+	if opts.ForUpdate || hasSubquery(opts.Matches) {
+		return false
+	}
+	m, ok := v.(*Model)
+	return !ok || len(m.Joins) == 0 && len(m.Preloads) == 0 && len(m.Unions) == 0 && !hasSubquery(m.Opts.Matches)
+}
+
+func hasSubquery(items []MatchItem) bool {
+	for _, item := range items {
+		switch value := item.Value.(type) {
+		case *Model:
+			return true
+		case MatchOptions:
+			if hasSubquery(value.Matches) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// cacheEntry the record cached, or the not found of the query
+type cacheEntry struct {
+	NotFound bool   `json:"not_found,omitempty"`
+	Data     []byte `json:"data,omitempty"`
+}
+
+func (e cacheEntry) decode(v interface{}) error {
+	if e.NotFound {
+		return ErrRecordNotFound
+	}
+	return json.Unmarshal(e.Data, v)
+}
+
+type cachedRepository struct {
+	Repository
+	cache cache.Cache
+	opts  CacheOptions
+	group *utils.SingleFlight
+	// written the models written in the transaction, nil if the repository is not in a transaction
+	written map[string]struct{}
+	lock    sync.Mutex
+}
+
+// NewCachedRepository a read-through cache of repo. First and Find are served from c, keyed by the
+// model and the match condition. the caches of a model are invalidated once the model is written,
+// and the queries in a transaction never touch the cache, whether they're made by the repo passed to
+// the do of Transaction or with the ctx carrying the transaction. the models written with a ctx carrying
+// a transaction are invalidated once the transaction ends. the loads of the same query are made once
+// if they are concurrent
+// usage:
+//   repo := NewCachedRepository(NewGormRepository(db), cache.Redis(cli), CacheTTL(time.Minute), NegativeTTL(10*time.Second))
+//   err := repo.First(ctx, &user, ID("1"))
+func NewCachedRepository(repo Repository, c cache.Cache, opts ...CacheOption) Repository {
+	r := &cachedRepository{Repository: repo, cache: c, group: &utils.SingleFlight{}}
+	r.opts.TTL = DefaultCacheTTL
+	for _, apply := range opts {
+		apply(&r.opts)
+	}
+	if r.opts.Cacheable == nil {
+		r.opts.Cacheable = cacheable
+	}
+	return r
+}
+
+// modelName the name of the model of v that the caches are invalidated by
+func modelName(v interface{}) string {
+	if m, ok := v.(*Model); ok {
+		v = m.From
+	}
+	return indirectType(reflect.TypeOf(v)).String()
+}
+
+func (r *cachedRepository) generationKey(model string) string {
+	return r.opts.Prefix + model + ":gen"
+}
+
+// key the cache key of the query, the matches are sorted so that the same condition built
+// in different order shares the cache. the generation of the model is a part of the key, so
+// that bumping it invalidates all the caches of the model
+func (r *cachedRepository) key(ctx context.Context, op string, v interface{}, opt *MatchOptions) (string, error) {
+	matches := make([]string, len(opt.Matches))
+	for i, item := range opt.Matches {
+		bs, err := json.Marshal(item)
+		if err != nil {
+			return "", err
+		}
+		matches[i] = string(bs)
+	}
+	sort.Strings(matches)
+	query := map[string]interface{}{
+		"op":      op,
+		"matches": matches,
+		"sort":    opt.Sort,
+		"limit":   opt.Limit,
+		"offset":  opt.Offset,
+		"select":  opt.Select,
+		"trashed": opt.Trashed,
+		"result":  fmt.Sprintf("%T", v),
+	}
+	if m, ok := v.(*Model); ok {
+		query["result"] = fmt.Sprintf("%T", m.Result)
+		query["group"] = m.Grp
+		query["aggs"] = m.Aggs
+		query["preloads"] = m.Preloads
+		query["where"] = m.Opts
+		query["alias"] = m.Alias
+	}
+	bs, err := json.Marshal(query)
+	if err != nil {
+		return "", err
+	}
+	model := modelName(v)
+	var gen int64
+	if err := r.cache.Get(ctx, r.generationKey(model), &gen); err != nil {
+		gen = 0
+	}
+	sum := sha1.Sum(bs)
+	return r.opts.Prefix + model + ":" + strconv.FormatInt(gen, 10) + ":" + hex.EncodeToString(sum[:]), nil
+}
+
+// read serve the query from the cache, or load it and cache the result
+func (r *cachedRepository) read(ctx context.Context, op string, v interface{}, opts []MatchOption, load func() error) error {
+	opt := &MatchOptions{}
+	opt.Apply(opts...)
+	if r.written != nil || inTransaction(ctx) || !r.opts.Cacheable(v, opt) {
+		return load()
+	}
+	key, err := r.key(ctx, op, v, opt)
+	if err != nil {
+		return load()
+	}
+	result := v
+	if m, ok := v.(*Model); ok {
+		result = m.Result
+	}
+	var entry cacheEntry
+	if err := r.cache.Get(ctx, key, &entry); err == nil {
+		return entry.decode(result)
+	}
+	loaded := false
+	shared, err := r.group.Do(key, func() (interface{}, error) {
+		loaded = true
+		if err := load(); err != nil {
+			if isNotFound(err) && r.opts.NegativeTTL > 0 {
+				r.cache.Put(ctx, key, cacheEntry{NotFound: true}, r.opts.NegativeTTL)
+			}
+			return nil, err
+		}
+		data, err := json.Marshal(result)
+		if err != nil {
+			return nil, err
+		}
+		entry := cacheEntry{Data: data}
+		r.cache.Put(ctx, key, entry, r.opts.TTL)
+		return entry, nil
+	})
+	if err != nil || loaded {
+		return err
+	}
+	return shared.(cacheEntry).decode(result)
+}
+
+// invalidate the caches of the models by bumping their generation. in a transaction the models
+// are recorded to be invalidated again when the transaction ends. with a ctx carrying a transaction
+// the invalidation is deferred until the transaction ends, otherwise the readers outside of it might
+// cache the records before it's committed under the generation bumped
+func (r *cachedRepository) invalidate(ctx context.Context, models ...string) error {
+	if r.written == nil && inTransaction(ctx) {
+		afterTransaction(ctx, func() { r.invalidate(context.Background(), models...) })
+		return nil
+	}
+	if r.written != nil {
+		r.lock.Lock()
+		for _, model := range models {
+			r.written[model] = struct{}{}
+		}
+		r.lock.Unlock()
+	}
+	gen := time.Now().UnixNano()
+	for _, model := range models {
+		if err := r.cache.Put(ctx, r.generationKey(model), gen, cache.Permenent); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// wrote invalidate the caches of the model v after writing it
+func (r *cachedRepository) wrote(ctx context.Context, v interface{}, err error) error {
+	if invalidateErr := r.invalidate(ctx, modelName(v)); err == nil {
+		return invalidateErr
+	}
+	return err
+}
+
+func (r *cachedRepository) First(ctx context.Context, v interface{}, opts ...MatchOption) error {
+	return r.read(ctx, "first", v, opts, func() error {
+		return r.Repository.First(ctx, v, opts...)
+	})
+}
+
+func (r *cachedRepository) Find(ctx context.Context, v interface{}, opts ...MatchOption) error {
+	return r.read(ctx, "find", v, opts, func() error {
+		return r.Repository.Find(ctx, v, opts...)
+	})
+}
+
+func (r *cachedRepository) Paginate(ctx context.Context, v interface{}, page *Page, opts ...MatchOption) error {
+	return paginate(ctx, r, v, page, opts...)
+}
+
+func (r *cachedRepository) Each(ctx context.Context, v interface{}, size int, do func(ctx context.Context) error, opts ...MatchOption) error {
+	return each(ctx, r, v, size, do, opts...)
+}
+
+func (r *cachedRepository) Update(ctx context.Context, v interface{}) error {
+	return r.wrote(ctx, v, r.Repository.Update(ctx, v))
+}
+
+func (r *cachedRepository) Delete(ctx context.Context, v interface{}, opts ...MatchOption) error {
+	return r.wrote(ctx, v, r.Repository.Delete(ctx, v, opts...))
+}
+
+func (r *cachedRepository) Restore(ctx context.Context, v interface{}, opts ...MatchOption) error {
+	return r.wrote(ctx, v, r.Repository.Restore(ctx, v, opts...))
+}
+
+func (r *cachedRepository) ForceDelete(ctx context.Context, v interface{}, opts ...MatchOption) error {
+	return r.wrote(ctx, v, r.Repository.ForceDelete(ctx, v, opts...))
+}
+
+func (r *cachedRepository) Create(ctx context.Context, v interface{}) error {
+	return r.wrote(ctx, v, r.Repository.Create(ctx, v))
+}
+
+func (r *cachedRepository) UpdateFields(ctx context.Context, v interface{}, fields Fields, opts ...MatchOption) error {
+	return r.wrote(ctx, v, r.Repository.UpdateFields(ctx, v, fields, opts...))
+}
+
+func (r *cachedRepository) CreateInBatches(ctx context.Context, v interface{}, batchSize int) error {
+	return r.wrote(ctx, v, r.Repository.CreateInBatches(ctx, v, batchSize))
+}
+
+func (r *cachedRepository) Upsert(ctx context.Context, v interface{}, conflict []string, update ...string) error {
+	return r.wrote(ctx, v, r.Repository.Upsert(ctx, v, conflict, update...))
+}
+
+func (r *cachedRepository) BulkUpdateFields(ctx context.Context, v interface{}, rows map[interface{}]Fields) error {
+	return r.wrote(ctx, v, r.Repository.BulkUpdateFields(ctx, v, rows))
+}
+
+// Transaction the repo passed to do bypasses the cache, and the models written in the
+// transaction are invalidated again after it ends
+func (r *cachedRepository) Transaction(ctx context.Context, do func(ctx context.Context, repo Repository) error, opts ...TxOption) error {
+	scoped := &cachedRepository{cache: r.cache, opts: r.opts, group: r.group, written: map[string]struct{}{}}
+	err := r.Repository.Transaction(ctx, func(ctx context.Context, repo Repository) error {
+		scoped.Repository = repo
+		return do(ctx, scoped)
+	}, opts...)
+	models := make([]string, 0, len(scoped.written))
+	for model := range scoped.written {
+		models = append(models, model)
+	}
+	if invalidateErr := r.invalidate(ctx, models...); err == nil {
+		return invalidateErr
+	}
+	return err
+}
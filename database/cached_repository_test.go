@@ -0,0 +1,235 @@
+package database
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+	"github.com/yang-zzhong/xl/cache"
+)
+
+// memCache an in memory cache.Cache marshaling the values like the redis one
+type memCache struct {
+	lock   sync.Mutex
+	values map[string][]byte
+}
+
+func (c *memCache) Put(ctx context.Context, key string, val interface{}, ttl ...time.Duration) error {
+	bs, err := json.Marshal(val)
+	if err != nil {
+		return err
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.values == nil {
+		c.values = map[string][]byte{}
+	}
+	c.values[key] = bs
+	return nil
+}
+
+func (c *memCache) Get(ctx context.Context, key string, val interface{}) error {
+	c.lock.Lock()
+	bs, ok := c.values[key]
+	c.lock.Unlock()
+	if !ok {
+		return cache.ErrCacheNotFound
+	}
+	return json.Unmarshal(bs, val)
+}
+
+func (c *memCache) TTL(ctx context.Context, key string, ttl *time.Duration) error {
+	return nil
+}
+
+func (c *memCache) Del(ctx context.Context, keys ...string) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for _, key := range keys {
+		delete(c.values, key)
+	}
+	return nil
+}
+
+func TestCachedRepository_First(t *testing.T) {
+	db, mock, gdb := mockDB(t)
+	defer db.Close()
+	repo := NewCachedRepository(NewGormRepository(gdb), &memCache{})
+	execSql := "^SELECT \\* FROM `users` WHERE `id` = \\? AND `name` = \\? ORDER BY `users`\\.`id` LIMIT 1$"
+	func() {
+		mock.ExpectQuery(execSql).
+			WithArgs("1", "a").
+			WillReturnRows(sqlmock.NewRows([]string{"id", "name"}).AddRow("1", "a"))
+		mock.ExpectBegin()
+		mock.ExpectExec("^UPDATE `users` SET `name`=\\? WHERE `id` = \\?$").
+			WithArgs("b", "1").
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectCommit()
+	}()
+	ctx := context.Background()
+	for i := 0; i < 2; i++ {
+		var user User
+		// the same condition in different order hits the same cache
+		err := repo.First(ctx, &user, func(opts *MatchOptions) {
+			if i == 0 {
+				opts.EQ("id", "1").EQ("name", "a")
+				return
+			}
+			opts.EQ("name", "a").EQ("id", "1")
+		})
+		assert.Nil(t, err)
+		assert.Equal(t, User{ID: "1", Name: "a"}, user)
+	}
+	err := repo.UpdateFields(ctx, &User{}, Fields{"name": "b"}, func(opts *MatchOptions) { opts.EQ("id", "1") })
+	assert.Nil(t, err)
+	assert.Nil(t, mock.ExpectationsWereMet())
+
+	// invalidated by the update
+	mock.ExpectQuery(execSql).
+		WithArgs("1", "a").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name"}))
+	var user User
+	err = repo.First(ctx, &user, func(opts *MatchOptions) { opts.EQ("id", "1").EQ("name", "a") })
+	assert.True(t, isNotFound(err))
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestCachedRepository_NegativeCache(t *testing.T) {
+	db, mock, gdb := mockDB(t)
+	defer db.Close()
+	repo := NewCachedRepository(NewGormRepository(gdb), &memCache{}, NegativeTTL(time.Minute))
+	func() {
+		mock.ExpectQuery("^SELECT \\* FROM `users` WHERE `id` = \\? ORDER BY `users`\\.`id` LIMIT 1$").
+			WithArgs("1").
+			WillReturnRows(sqlmock.NewRows([]string{"id", "name"}))
+	}()
+	for i := 0; i < 2; i++ {
+		var user User
+		err := repo.First(context.Background(), &user, func(opts *MatchOptions) { opts.EQ("id", "1") })
+		assert.True(t, isNotFound(err))
+	}
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestCachedRepository_SingleFlight(t *testing.T) {
+	db, mock, gdb := mockDB(t)
+	defer db.Close()
+	repo := NewCachedRepository(NewGormRepository(gdb), &memCache{})
+	func() {
+		mock.ExpectQuery("^SELECT \\* FROM `users` LIMIT 2$").
+			WillDelayFor(50 * time.Millisecond).
+			WillReturnRows(sqlmock.NewRows([]string{"id", "name"}).AddRow("1", "a").AddRow("2", "b"))
+	}()
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var users []User
+			err := repo.Find(context.Background(), &users, func(opts *MatchOptions) { opts.SetLimit(2) })
+			assert.Nil(t, err)
+			assert.Equal(t, []User{{ID: "1", Name: "a"}, {ID: "2", Name: "b"}}, users)
+		}()
+	}
+	wg.Wait()
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestCachedRepository_Transaction(t *testing.T) {
+	db, mock, gdb := mockDB(t)
+	defer db.Close()
+	repo := NewCachedRepository(NewGormRepository(gdb), &memCache{})
+	execSql := "^SELECT \\* FROM `users`$"
+	func() {
+		mock.ExpectQuery(execSql).WillReturnRows(sqlmock.NewRows([]string{"id", "name"}).AddRow("1", "a"))
+		mock.ExpectBegin()
+		mock.ExpectQuery(execSql).WillReturnRows(sqlmock.NewRows([]string{"id", "name"}).AddRow("1", "a"))
+		mock.ExpectExec("^INSERT INTO `users`").WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectRollback()
+		mock.ExpectQuery(execSql).WillReturnRows(sqlmock.NewRows([]string{"id", "name"}).AddRow("1", "a"))
+	}()
+	ctx := context.Background()
+	var users []User
+	assert.Nil(t, repo.Find(ctx, &users))
+	errRollback := errors.New("rollback")
+	err := repo.Transaction(ctx, func(ctx context.Context, repo Repository) error {
+		// bypass the cache in the transaction
+		if err := repo.Find(ctx, &users); err != nil {
+			return err
+		}
+		if err := repo.Create(ctx, &User{ID: "2", Name: "b"}); err != nil {
+			return err
+		}
+		return errRollback
+	})
+	assert.ErrorIs(t, err, errRollback)
+	assert.Nil(t, repo.Find(ctx, &users))
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestCachedRepository_TransactionContext(t *testing.T) {
+	db, mock, gdb := mockDB(t)
+	defer db.Close()
+	c := &memCache{}
+	gorm := NewGormRepository(gdb)
+	repo := NewCachedRepository(gorm, c)
+	execSql := "^SELECT \\* FROM `users`$"
+	func() {
+		mock.ExpectQuery(execSql).WillReturnRows(sqlmock.NewRows([]string{"id", "name"}).AddRow("1", "a"))
+		mock.ExpectBegin()
+		mock.ExpectQuery(execSql).WillReturnRows(sqlmock.NewRows([]string{"id", "name"}).AddRow("1", "a").AddRow("2", "b"))
+		mock.ExpectExec("^INSERT INTO `users`").WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectRollback()
+		mock.ExpectQuery(execSql).WillReturnRows(sqlmock.NewRows([]string{"id", "name"}).AddRow("1", "a"))
+	}()
+	ctx := context.Background()
+	var users []User
+	assert.Nil(t, repo.Find(ctx, &users))
+	errRollback := errors.New("rollback")
+	err := gorm.Transaction(ctx, func(ctx context.Context, _ Repository) error {
+		// the outer repo with the ctx carrying the transaction bypasses the cache too
+		if err := repo.Find(ctx, &users); err != nil {
+			return err
+		}
+		assert.Len(t, users, 2)
+		if err := repo.Create(ctx, &User{ID: "2", Name: "b"}); err != nil {
+			return err
+		}
+		// not invalidated before the transaction ends
+		var gen int64
+		assert.ErrorIs(t, c.Get(ctx, "database.User:gen", &gen), cache.ErrCacheNotFound)
+		return errRollback
+	})
+	assert.ErrorIs(t, err, errRollback)
+	var gen int64
+	assert.Nil(t, c.Get(ctx, "database.User:gen", &gen))
+	users = nil
+	assert.Nil(t, repo.Find(ctx, &users))
+	assert.Len(t, users, 1)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestCachedRepository_Aggregations(t *testing.T) {
+	db, mock, gdb := mockDB(t)
+	defer db.Close()
+	repo := NewCachedRepository(NewGormRepository(gdb), &memCache{})
+	func() {
+		mock.ExpectQuery("^SELECT `tenant_id`,SUM\\(`amount`\\) AS `value` FROM `orders` GROUP BY `tenant_id`$").
+			WillReturnRows(sqlmock.NewRows([]string{"tenant_id", "value"}).AddRow(1, 30))
+		mock.ExpectQuery("^SELECT `tenant_id`,AVG\\(`amount`\\) AS `value` FROM `orders` GROUP BY `tenant_id`$").
+			WillReturnRows(sqlmock.NewRows([]string{"tenant_id", "value"}).AddRow(1, 10))
+	}()
+	ctx := context.Background()
+	var sums, avgs []map[string]interface{}
+	assert.Nil(t, repo.Find(ctx, M(&sums, &Order{}).GroupBy("tenant_id").Aggregate(Sum("amount").As("value"))))
+	// the same result type, group and matches, but another aggregation
+	assert.Nil(t, repo.Find(ctx, M(&avgs, &Order{}).GroupBy("tenant_id").Aggregate(Avg("amount").As("value"))))
+	assert.Equal(t, int64(30), sums[0]["value"])
+	assert.Equal(t, int64(10), avgs[0]["value"])
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
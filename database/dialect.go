@@ -0,0 +1,174 @@
+package database
+
+import (
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	sqlite "github.com/glebarez/go-sqlite"
+)
+
+// the dialects the gorm repository compiles the conditions for, which are the names of the gorm dialectors
+const (
+	MySQL    = "mysql"
+	Postgres = "postgres"
+	SQLite   = "sqlite"
+)
+
+var ErrUnsupported = errors.New("unsupported by the dialect")
+
+var (
+	// jsonPathRegexp the steps of a json path like $.tags[0].name
+	jsonPathRegexp = regexp.MustCompile(`\.("[^"]*"|[^.\[]+)|\[(\d+)\]`)
+	pgQuoter       = strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+)
+
+var (
+	sqliteRegexpOnce sync.Once
+	sqliteRegexpErr  error
+	sqliteRegexpDone int32
+	// sqliteRegexps the patterns compiled by the regexp function of sqlite
+	sqliteRegexps sync.Map
+)
+
+// dialect the dialect of the repository's db, MySQL is assumed for the dialectors not known
+func (repo *gormRepository) dialect() string {
+	switch name := repo.db.Dialector.Name(); name {
+	case Postgres, SQLite:
+		return name
+	}
+	return MySQL
+}
+
+// compileFullText compile the full-text search of the quoted fields. postgres searches the tsvector
+// of the fields, the boolean mode is the web search syntax of websearch_to_tsquery there
+func (repo *gormRepository) compileFullText(fields []string, search FullText) (string, []interface{}, error) {
+	switch repo.dialect() {
+	case Postgres:
+		fn := "plainto_tsquery"
+		switch search.Mode {
+		case "", NaturalLanguageMode:
+		case BooleanMode:
+			fn = "websearch_to_tsquery"
+		default:
+			return "", nil, fmt.Errorf("%w: full-text search %s of %s", ErrUnsupported, search.Mode, Postgres)
+		}
+		return fmt.Sprintf("to_tsvector(concat_ws(' ', %s)) @@ %s(?)", strings.Join(fields, ","), fn), []interface{}{search.Query}, nil
+	case SQLite:
+		return "", nil, fmt.Errorf("%w: full-text search of %s, which needs a FTS5 table", ErrUnsupported, SQLite)
+	}
+	if search.Mode == "" {
+		return fmt.Sprintf("MATCH (%s) AGAINST (?)", strings.Join(fields, ",")), []interface{}{search.Query}, nil
+	}
+	return fmt.Sprintf("MATCH (%s) AGAINST (? %s)", strings.Join(fields, ","), search.Mode), []interface{}{search.Query}, nil
+}
+
+// compileJSONContains compile the match of the quoted json field containing value, at path if it's given.
+// sqlite matches the scalar values only, which are the elements of an array or the value itself
+func (repo *gormRepository) compileJSONContains(field, path string, value interface{}) (string, []interface{}, error) {
+	switch repo.dialect() {
+	case Postgres:
+		if path != "" {
+			return fmt.Sprintf("(%s::jsonb #> ?::text[]) @> ?::jsonb", field), []interface{}{pgPath(path), jsonValue{value}}, nil
+		}
+		return fmt.Sprintf("%s::jsonb @> ?::jsonb", field), []interface{}{jsonValue{value}}, nil
+	case SQLite:
+		if path != "" {
+			return fmt.Sprintf("EXISTS (SELECT 1 FROM json_each(%s, ?) WHERE json_each.value = json_extract(?, '$'))", field), []interface{}{path, jsonValue{value}}, nil
+		}
+		return fmt.Sprintf("EXISTS (SELECT 1 FROM json_each(%s) WHERE json_each.value = json_extract(?, '$'))", field), []interface{}{jsonValue{value}}, nil
+	}
+	if path != "" {
+		return fmt.Sprintf("JSON_CONTAINS(%s, ?, ?)", field), []interface{}{jsonValue{value}, path}, nil
+	}
+	return fmt.Sprintf("JSON_CONTAINS(%s, ?)", field), []interface{}{jsonValue{value}}, nil
+}
+
+// compileJSONExtract compile the unquoted value of the quoted json field at path
+func (repo *gormRepository) compileJSONExtract(field, path string) (string, []interface{}) {
+	switch repo.dialect() {
+	case Postgres:
+		return fmt.Sprintf("(%s::jsonb #>> ?::text[])", field), []interface{}{pgPath(path)}
+	case SQLite:
+		return fmt.Sprintf("json_extract(%s, ?)", field), []interface{}{path}
+	}
+	return fmt.Sprintf("JSON_UNQUOTE(JSON_EXTRACT(%s, ?))", field), []interface{}{path}
+}
+
+// regexpOperator the operator matching a regular expression, which sqlite has once RegisterSQLiteRegexp is called
+func (repo *gormRepository) regexpOperator() (string, error) {
+	switch repo.dialect() {
+	case Postgres:
+		return "~", nil
+	case SQLite:
+		if !sqliteRegexpRegistered() {
+			return "", fmt.Errorf("%w: regexp of %s, see RegisterSQLiteRegexp", ErrUnsupported, SQLite)
+		}
+	}
+	return "REGEXP", nil
+}
+
+// RegisterSQLiteRegexp register the regexp function which the REGEXP operator of sqlite calls, matching by the
+// regular expressions of go. it must be called before the connections are opened
+//   if err := database.RegisterSQLiteRegexp(); err != nil {
+//       return err
+//   }
+//   db, err := gorm.Open(sqlite.Open("file::memory:"))
+func RegisterSQLiteRegexp() error {
+	sqliteRegexpOnce.Do(func() {
+		sqliteRegexpErr = sqlite.RegisterDeterministicScalarFunction("regexp", 2, func(ctx *sqlite.FunctionContext, args []driver.Value) (driver.Value, error) {
+			pattern, ok := args[0].(string)
+			if !ok || args[1] == nil {
+				return nil, nil
+			}
+			re, ok := sqliteRegexps.Load(pattern)
+			if !ok {
+				compiled, err := regexp.Compile(pattern)
+				if err != nil {
+					return nil, err
+				}
+				re, _ = sqliteRegexps.LoadOrStore(pattern, compiled)
+			}
+			switch value := args[1].(type) {
+			case string:
+				return re.(*regexp.Regexp).MatchString(value), nil
+			case []byte:
+				return re.(*regexp.Regexp).Match(value), nil
+			}
+			return re.(*regexp.Regexp).MatchString(fmt.Sprint(args[1])), nil
+		})
+		if sqliteRegexpErr == nil {
+			atomic.StoreInt32(&sqliteRegexpDone, 1)
+		}
+	})
+	return sqliteRegexpErr
+}
+
+func sqliteRegexpRegistered() bool {
+	return atomic.LoadInt32(&sqliteRegexpDone) == 1
+}
+
+// likeEscape the ESCAPE of LIKE, sqlite has no escape character by default while EscapeLike escapes by backslashes
+func (repo *gormRepository) likeEscape() string {
+	if repo.dialect() == SQLite {
+		return ` ESCAPE '\'`
+	}
+	return ""
+}
+
+// pgPath convert the json path like $.tags[0].name to the text array of postgres like {"tags","0","name"}
+func pgPath(path string) string {
+	steps := []string{}
+	for _, m := range jsonPathRegexp.FindAllStringSubmatch(path, -1) {
+		step := m[1] + m[2]
+		if strings.HasPrefix(step, `"`) {
+			step = strings.Trim(step, `"`)
+		}
+		steps = append(steps, `"`+pgQuoter.Replace(step)+`"`)
+	}
+	return "{" + strings.Join(steps, ",") + "}"
+}
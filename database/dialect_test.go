@@ -0,0 +1,162 @@
+package database
+
+import (
+	"context"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/glebarez/sqlite"
+	"github.com/stretchr/testify/assert"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+)
+
+type Gadget struct {
+	ID    int64
+	Name  string `gorm:"uniqueIndex"`
+	Attrs string
+}
+
+func TestGormRepository_Postgres(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.Nil(t, err)
+	defer db.Close()
+	gdb, err := gorm.Open(postgres.New(postgres.Config{Conn: db}))
+	assert.Nil(t, err)
+	repo := NewGormRepository(gdb)
+	func() {
+		mock.ExpectQuery(`^SELECT \* FROM "users" WHERE LOWER\("name"\) LIKE LOWER\(\$1\) AND \("attrs"::jsonb #> \$2::text\[\]\) @> \$3::jsonb AND \("attrs"::jsonb #>> \$4::text\[\]\) = \$5 ORDER BY "name" DESC$`).
+			WithArgs("a%", `{"tags"}`, `"red"`, `{"size","0"}`, "xl").
+			WillReturnRows(sqlmock.NewRows([]string{"id", "name"}).AddRow("1", "ab"))
+		mock.ExpectQuery(`^SELECT \* FROM "users" WHERE "name" ~ \$1$`).
+			WithArgs("^a[0-9]+$").
+			WillReturnRows(sqlmock.NewRows([]string{"id", "name"}))
+		mock.ExpectQuery(`^SELECT \* FROM "users" WHERE to_tsvector\(concat_ws\(' ', "name","bio"\)\) @@ websearch_to_tsquery\(\$1\)$`).
+			WithArgs("go -java").
+			WillReturnRows(sqlmock.NewRows([]string{"id", "name"}))
+	}()
+	var users []User
+	err = repo.Find(context.Background(), &users, func(opts *MatchOptions) {
+		opts.ILike("name", "a%").JSONContains("attrs", "red", "$.tags").JSONPath("attrs", "$.size[0]", EQ, "xl").SetSort(Field("name").DESC())
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, []User{{ID: "1", Name: "ab"}}, users)
+	err = repo.Find(context.Background(), &users, func(opts *MatchOptions) { opts.Regexp("name", "^a[0-9]+$") })
+	assert.Nil(t, err)
+	err = repo.Find(context.Background(), &users, func(opts *MatchOptions) {
+		opts.Search("go -java", BooleanMode, "name", "bio")
+	})
+	assert.Nil(t, err)
+	err = repo.Find(context.Background(), &users, func(opts *MatchOptions) {
+		opts.Search("go", QueryExpansionMode, "name")
+	})
+	assert.ErrorIs(t, err, ErrUnsupported)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestGormRepository_SQLite(t *testing.T) {
+	gdb, err := gorm.Open(sqlite.Open("file::memory:"))
+	assert.Nil(t, err)
+	sqlDB, err := gdb.DB()
+	assert.Nil(t, err)
+	defer sqlDB.Close()
+	// every connection opens its own memory db
+	sqlDB.SetMaxOpenConns(1)
+	assert.Nil(t, gdb.AutoMigrate(&Gadget{}))
+	repo := NewGormRepository(gdb)
+	ctx := context.Background()
+	assert.Nil(t, repo.CreateInBatches(ctx, []Gadget{
+		{Name: "50% off", Attrs: `{"color":"red","tags":["sale","new"]}`},
+		{Name: "500 off", Attrs: `{"color":"blue","tags":["new"]}`},
+	}, 10))
+
+	err = repo.Create(ctx, &Gadget{Name: "500 off"})
+	assert.ErrorIs(t, err, ErrDuplicate)
+	var dbErr *Error
+	assert.ErrorAs(t, err, &dbErr)
+	assert.Equal(t, "gadgets.name", dbErr.Key)
+
+	var gadgets []Gadget
+	assert.Nil(t, repo.Find(ctx, &gadgets, func(opts *MatchOptions) { opts.StartsWith("name", "50%") }))
+	assert.Len(t, gadgets, 1)
+	assert.Equal(t, "50% off", gadgets[0].Name)
+
+	gadgets = nil
+	assert.Nil(t, repo.Find(ctx, &gadgets, func(opts *MatchOptions) { opts.JSONContains("attrs", "sale", "$.tags") }))
+	assert.Len(t, gadgets, 1)
+	assert.Equal(t, "50% off", gadgets[0].Name)
+
+	gadgets = nil
+	assert.Nil(t, repo.Find(ctx, &gadgets, func(opts *MatchOptions) {
+		opts.JSONPath("attrs", "$.color", EQ, "blue").ILike("name", "500%").SetSort(Field("id").DESC())
+	}))
+	assert.Len(t, gadgets, 1)
+	assert.Equal(t, "500 off", gadgets[0].Name)
+
+	assert.Nil(t, repo.UpdateFields(ctx, &Gadget{}, Fields{"name": "sold out"}, func(opts *MatchOptions) { opts.EQ("name", "500 off") }))
+	var count int64
+	assert.Nil(t, repo.Count(ctx, &Gadget{}, &count, func(opts *MatchOptions) { opts.EQ("name", "sold out") }))
+	assert.Equal(t, int64(1), count)
+
+	err = repo.Find(ctx, &gadgets, func(opts *MatchOptions) { opts.Search("off", "", "name") })
+	assert.ErrorIs(t, err, ErrUnsupported)
+}
+
+func TestGormRepository_Regexp(t *testing.T) {
+	db, mock, gdb := mockDB(t)
+	defer db.Close()
+	mock.ExpectQuery("^SELECT \\* FROM `users` WHERE `name` REGEXP \\?$").
+		WithArgs("^a[0-9]+$").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name"}).AddRow("1", "a1"))
+	var users []User
+	err := NewGormRepository(gdb).Find(context.Background(), &users, func(opts *MatchOptions) { opts.Regexp("name", "^a[0-9]+$") })
+	assert.Nil(t, err)
+	assert.Len(t, users, 1)
+	assert.Nil(t, mock.ExpectationsWereMet())
+
+	// sqlite has no regexp function until it's registered
+	unregistered, err := gorm.Open(sqlite.Open("file::memory:"))
+	assert.Nil(t, err)
+	err = NewGormRepository(unregistered).Find(context.Background(), &users, func(opts *MatchOptions) { opts.Regexp("name", "a") })
+	assert.ErrorIs(t, err, ErrUnsupported)
+	unregisteredDB, err := unregistered.DB()
+	assert.Nil(t, err)
+	unregisteredDB.Close()
+
+	assert.Nil(t, RegisterSQLiteRegexp())
+	gdb, err = gorm.Open(sqlite.Open("file::memory:"))
+	assert.Nil(t, err)
+	sqlDB, err := gdb.DB()
+	assert.Nil(t, err)
+	defer sqlDB.Close()
+	sqlDB.SetMaxOpenConns(1)
+	assert.Nil(t, gdb.AutoMigrate(&Gadget{}))
+	repo := NewGormRepository(gdb)
+	ctx := context.Background()
+	assert.Nil(t, repo.CreateInBatches(ctx, []Gadget{{Name: "a1"}, {Name: "a12"}, {Name: "b1"}}, 10))
+	var gadgets []Gadget
+	assert.Nil(t, repo.Find(ctx, &gadgets, func(opts *MatchOptions) { opts.Regexp("name", "^a[0-9]+$").SetSort("id") }))
+	assert.Len(t, gadgets, 2)
+	assert.Equal(t, "a12", gadgets[1].Name)
+}
+
+func TestGormRepository_PostgresHaving(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.Nil(t, err)
+	defer db.Close()
+	gdb, err := gorm.Open(postgres.New(postgres.Config{Conn: db}))
+	assert.Nil(t, err)
+	// postgres has no alias of the selected columns in HAVING
+	mock.ExpectQuery(`^SELECT "tenant_id",SUM\("amount"\) AS "total",COUNT\(DISTINCT "id"\) AS "count_distinct_id" FROM "orders" GROUP BY "tenant_id" HAVING SUM\("amount"\) > \$1 AND \(COUNT\(DISTINCT "id"\) > \$2 OR "tenant_id" = \$3\)$`).
+		WithArgs(100, 1, 7).
+		WillReturnRows(sqlmock.NewRows([]string{"tenant_id", "total", "count_distinct_id"}).AddRow(7, 120, 1))
+	var rows []map[string]interface{}
+	err = NewGormRepository(gdb).Find(context.Background(), M(&rows, &Order{}).GroupBy("tenant_id").
+		Aggregate(Sum("amount").As("total"), CountDistinct("id")).
+		Having(func(opts *MatchOptions) {
+			opts.GT("total", 100).OR(*(&MatchOptions{}).GT("count_distinct_id", 1).EQ("tenant_id", 7))
+		}))
+	assert.Nil(t, err)
+	assert.Len(t, rows, 1)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
@@ -0,0 +1,188 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+
+	sqlite "github.com/glebarez/go-sqlite"
+	"github.com/go-sql-driver/mysql"
+	"github.com/jackc/pgconn"
+	"gorm.io/gorm"
+)
+
+var (
+	ErrTimeout    = errors.New("query timeout")
+	ErrCanceled   = errors.New("query canceled")
+	ErrDuplicate  = errors.New("duplicate key")
+	ErrForeignKey = errors.New("foreign key violated")
+	ErrDeadlock   = errors.New("deadlock")
+	// ErrConflict the record was updated by others since it was read, see Repository.Update
+	ErrConflict = errors.New("version conflict")
+
+	duplicateKeyRegexp = regexp.MustCompile(`for key '([^']+)'`)
+	foreignKeyRegexp   = regexp.MustCompile("CONSTRAINT `([^`]+)`")
+	sqliteUniqueRegexp = regexp.MustCompile(`UNIQUE constraint failed: (.+?) \(\d+\)`)
+)
+
+// the mysql error numbers translated
+const (
+	mysqlDuplicate        = 1062
+	mysqlRowReferenced    = 1451
+	mysqlNoReferencedRow  = 1452
+	mysqlLockWaitTimeout  = 1205
+	mysqlDeadlock         = 1213
+	mysqlExecutionTimeout = 3024
+)
+
+// the postgres SQLSTATEs translated
+const (
+	pgUniqueViolation     = "23505"
+	pgForeignKeyViolation = "23503"
+	pgDeadlock            = "40P01"
+	pgLockNotAvailable    = "55P03"
+	pgQueryCanceled       = "57014"
+)
+
+// the sqlite result codes translated, the extended codes are told by the primary code in the low byte
+const (
+	sqliteBusy             = 5
+	sqliteConstraintFK     = 787
+	sqliteConstraintPK     = 1555
+	sqliteConstraintUnique = 2067
+)
+
+// ContextError the operation was aborted by its context, errors.Is(err, ErrTimeout) reports
+// the deadline exceeded and errors.Is(err, ErrCanceled) reports the context canceled
+type ContextError struct {
+	Op  string
+	Err error
+}
+
+func (e *ContextError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Op, e.Err.Error())
+}
+
+func (e *ContextError) Unwrap() error {
+	return e.Err
+}
+
+func (e *ContextError) Is(target error) bool {
+	switch target {
+	case ErrTimeout:
+		return errors.Is(e.Err, context.DeadlineExceeded)
+	case ErrCanceled:
+		return errors.Is(e.Err, context.Canceled)
+	}
+	return false
+}
+
+// Error a driver error translated to one of ErrRecordNotFound, ErrDuplicate, ErrForeignKey, ErrDeadlock
+// and ErrTimeout, which errors.Is(err, Kind) reports. the driver error is still reachable by errors.As
+//
+//	var dbErr *database.Error
+//	if errors.As(err, &dbErr) && errors.Is(err, database.ErrDuplicate) {
+//	    log.Printf("duplicate %s", dbErr.Key)
+//	}
+type Error struct {
+	Kind error
+	// Key the unique key of ErrDuplicate, or the constraint of ErrForeignKey
+	Key string
+	Err error
+}
+
+func (e *Error) Error() string {
+	if e.Key != "" {
+		return fmt.Sprintf("%s [%s]: %s", e.Kind.Error(), e.Key, e.Err.Error())
+	}
+	return fmt.Sprintf("%s: %s", e.Kind.Error(), e.Err.Error())
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+func (e *Error) Is(target error) bool {
+	return target == e.Kind
+}
+
+// translate err of gorm and the driver to Error, the errors not known are returned as they are
+func translate(err error) error {
+	if err == nil {
+		return nil
+	}
+	var dbErr *Error
+	if errors.As(err, &dbErr) {
+		return err
+	}
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return &Error{Kind: ErrRecordNotFound, Err: err}
+	}
+	var myErr *mysql.MySQLError
+	if errors.As(err, &myErr) {
+		return translateMySQL(err, myErr)
+	}
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		return translatePostgres(err, pgErr)
+	}
+	var liteErr *sqlite.Error
+	if errors.As(err, &liteErr) {
+		return translateSQLite(err, liteErr)
+	}
+	return err
+}
+
+func translateMySQL(err error, myErr *mysql.MySQLError) error {
+	switch myErr.Number {
+	case mysqlDuplicate:
+		return &Error{Kind: ErrDuplicate, Key: submatch(duplicateKeyRegexp, myErr.Message), Err: err}
+	case mysqlRowReferenced, mysqlNoReferencedRow:
+		return &Error{Kind: ErrForeignKey, Key: submatch(foreignKeyRegexp, myErr.Message), Err: err}
+	case mysqlDeadlock:
+		return &Error{Kind: ErrDeadlock, Err: err}
+	case mysqlLockWaitTimeout, mysqlExecutionTimeout:
+		return &Error{Kind: ErrTimeout, Err: err}
+	}
+	return err
+}
+
+func translatePostgres(err error, pgErr *pgconn.PgError) error {
+	switch pgErr.Code {
+	case pgUniqueViolation:
+		return &Error{Kind: ErrDuplicate, Key: pgErr.ConstraintName, Err: err}
+	case pgForeignKeyViolation:
+		return &Error{Kind: ErrForeignKey, Key: pgErr.ConstraintName, Err: err}
+	case pgDeadlock:
+		return &Error{Kind: ErrDeadlock, Err: err}
+	case pgLockNotAvailable, pgQueryCanceled:
+		return &Error{Kind: ErrTimeout, Err: err}
+	}
+	return err
+}
+
+// translateSQLite the sqlite messages name the columns of the unique key rather than the key, like users.email
+func translateSQLite(err error, liteErr *sqlite.Error) error {
+	switch code := liteErr.Code(); {
+	case code == sqliteConstraintUnique, code == sqliteConstraintPK:
+		return &Error{Kind: ErrDuplicate, Key: submatch(sqliteUniqueRegexp, liteErr.Error()), Err: err}
+	case code == sqliteConstraintFK:
+		return &Error{Kind: ErrForeignKey, Err: err}
+	case code&0xff == sqliteBusy:
+		return &Error{Kind: ErrTimeout, Err: err}
+	}
+	return err
+}
+
+func submatch(re *regexp.Regexp, s string) string {
+	if m := re.FindStringSubmatch(s); len(m) > 1 {
+		return m[1]
+	}
+	return ""
+}
+
+// isNotFound whether err reports no record found
+func isNotFound(err error) bool {
+	return errors.Is(err, ErrRecordNotFound) || errors.Is(err, gorm.ErrRecordNotFound)
+}
@@ -0,0 +1,70 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/go-sql-driver/mysql"
+	"github.com/jackc/pgconn"
+	"github.com/stretchr/testify/assert"
+	"gorm.io/gorm"
+)
+
+func TestTranslate(t *testing.T) {
+	cases := []struct {
+		name string
+		err  error
+		kind error
+		key  string
+	}{
+		{"not found", gorm.ErrRecordNotFound, ErrRecordNotFound, ""},
+		{"duplicate", &mysql.MySQLError{Number: 1062, Message: "Duplicate entry 'a@b.c' for key 'users.email'"}, ErrDuplicate, "users.email"},
+		{"foreign key", &mysql.MySQLError{Number: 1452, Message: "Cannot add or update a child row: a foreign key constraint fails (`db`.`books`, CONSTRAINT `fk_books_author` FOREIGN KEY (`author_id`) REFERENCES `users` (`id`))"}, ErrForeignKey, "fk_books_author"},
+		{"referenced", &mysql.MySQLError{Number: 1451, Message: "Cannot delete or update a parent row: a foreign key constraint fails (`db`.`books`, CONSTRAINT `fk_books_author` FOREIGN KEY (`author_id`) REFERENCES `users` (`id`))"}, ErrForeignKey, "fk_books_author"},
+		{"deadlock", &mysql.MySQLError{Number: 1213, Message: "Deadlock found when trying to get lock"}, ErrDeadlock, ""},
+		{"lock wait timeout", &mysql.MySQLError{Number: 1205, Message: "Lock wait timeout exceeded"}, ErrTimeout, ""},
+		{"postgres duplicate", &pgconn.PgError{Code: "23505", ConstraintName: "users_email_key"}, ErrDuplicate, "users_email_key"},
+		{"postgres foreign key", &pgconn.PgError{Code: "23503", ConstraintName: "fk_books_author"}, ErrForeignKey, "fk_books_author"},
+		{"postgres deadlock", &pgconn.PgError{Code: "40P01"}, ErrDeadlock, ""},
+		{"postgres statement timeout", &pgconn.PgError{Code: "57014"}, ErrTimeout, ""},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			err := translate(c.err)
+			assert.ErrorIs(t, err, c.kind)
+			assert.ErrorIs(t, err, c.err)
+			var dbErr *Error
+			assert.True(t, errors.As(err, &dbErr))
+			assert.Equal(t, c.key, dbErr.Key)
+		})
+	}
+	unknown := errors.New("unknown")
+	assert.Equal(t, unknown, translate(unknown))
+}
+
+func TestGormRepository_Errors(t *testing.T) {
+	db, mock, gdb := mockDB(t)
+	defer db.Close()
+	repo := NewGormRepository(gdb)
+	func() {
+		mock.ExpectQuery("^SELECT \\* FROM `users` ORDER BY `users`\\.`id` LIMIT 1$").
+			WillReturnRows(sqlmock.NewRows([]string{"id", "name"}))
+		mock.ExpectBegin()
+		mock.ExpectExec("^INSERT INTO `users`").
+			WillReturnError(&mysql.MySQLError{Number: 1062, Message: "Duplicate entry '1' for key 'PRIMARY'"})
+		mock.ExpectRollback()
+	}()
+	var user User
+	err := repo.First(context.Background(), &user)
+	assert.ErrorIs(t, err, ErrRecordNotFound)
+	assert.ErrorIs(t, err, gorm.ErrRecordNotFound)
+
+	err = repo.Create(context.Background(), &User{ID: "1"})
+	assert.ErrorIs(t, err, ErrDuplicate)
+	var dbErr *Error
+	assert.True(t, errors.As(err, &dbErr))
+	assert.Equal(t, "PRIMARY", dbErr.Key)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
@@ -2,50 +2,148 @@ package database
 
 import (
 	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"reflect"
+	"sort"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/yang-zzhong/structs"
 	"github.com/yang-zzhong/xl/utils"
 
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
-func (f Field) DESC() string {
-	return "`" + string(f) + "` DESC"
+var operatorMap = map[Operator]string{
+	EQ:    "=",
+	NEQ:   "!=",
+	LT:    "<",
+	LTE:   "<=",
+	GT:    ">",
+	GTE:   ">=",
+	IN:    "IN",
+	NOTIN: "NOT IN",
+	LIKE:  "LIKE",
 }
 
-func (f Field) ASC() string {
-	return "`" + string(f) + "` ASC"
+// jsonValue marshal v to the json document when it's sent to the db
+type jsonValue struct {
+	v interface{}
 }
 
-var operatorMap = map[Operator]string{
-	EQ:  "=",
-	NEQ: "!=",
-	LT:  "<",
-	LTE: "<=",
-	GT:  ">",
-	GTE: ">=",
-	IN:  "IN",
+func (j jsonValue) Value() (driver.Value, error) {
+	if raw, ok := j.v.(json.RawMessage); ok {
+		return string(raw), nil
+	}
+	bs, err := json.Marshal(j.v)
+	return string(bs), err
 }
 
 type tableNamer interface {
 	TableName() string
 }
 
-type GormStack interface {
-	Push(db *gorm.DB)
-	Pop()
+// valueTabler a model whose table is decided by the value rather than by the type, like the AuditEntry of
+// an audited repository writing to a configured table
+type valueTabler interface {
+	valueTable() string
+}
+
+// txKey the key of the transaction carried in context, keyed by the root db so that
+// repositories of different databases never share a transaction
+type txKey struct {
+	db *gorm.DB
+}
+
+// txEnd the hooks run once the outermost transaction carried by a ctx ends, whether it's committed or
+// rolled back. unlike txKey it's not keyed by the db, so that the decorators tell the ctx in a transaction
+type txEnd struct {
+	lock  sync.Mutex
+	hooks []func()
+}
+
+type txEndKey struct{}
+
+func (end *txEnd) run() {
+	end.lock.Lock()
+	hooks := end.hooks
+	end.hooks = nil
+	end.lock.Unlock()
+	for _, hook := range hooks {
+		hook()
+	}
+}
+
+// inTransaction whether ctx carries a transaction
+func inTransaction(ctx context.Context) bool {
+	_, ok := ctx.Value(txEndKey{}).(*txEnd)
+	return ok
+}
+
+// afterTransaction run hook once the transaction carried by ctx ends, or right away if ctx carries none
+func afterTransaction(ctx context.Context, hook func()) {
+	end, ok := ctx.Value(txEndKey{}).(*txEnd)
+	if !ok {
+		hook()
+		return
+	}
+	end.lock.Lock()
+	end.hooks = append(end.hooks, hook)
+	end.lock.Unlock()
 }
 
 type gormRepository struct {
-	db []*gorm.DB
+	db       *gorm.DB
+	tx       *gorm.DB
+	opts     GormOptions
+	replicas []*replica
+	next     uint32
+}
+
+// GormOptions options of the gorm repository
+type GormOptions struct {
+	// Timeout default timeout of every operation, zero means no timeout
+	Timeout time.Duration
+	// BatchSize default count of records written per statement by the bulk operations
+	BatchSize int
+	// Replicas the read only dbs the reads are routed to
+	Replicas []*gorm.DB
+	// EjectFor how long a replica is ejected after its connection fails
+	EjectFor time.Duration
+	// TableSuffix the suffix of the table of every model, for the tables sharded in one db
+	TableSuffix string
+}
+
+// DefaultBatchSize the batch size of the bulk operations if BatchSize is not given
+const DefaultBatchSize = 100
+
+type GormOption func(*GormOptions)
+
+// DefaultTimeout set the default timeout of every operation, it can be overridden by the Timeout MatchOption
+func DefaultTimeout(timeout time.Duration) GormOption {
+	return func(opts *GormOptions) { opts.Timeout = timeout }
+}
+
+// BatchSize set the default count of records written per statement by the bulk operations
+func BatchSize(size int) GormOption {
+	return func(opts *GormOptions) { opts.BatchSize = size }
+}
+
+// TableSuffix suffix the table of every model with suffix, the tables joined are not suffixed
+//   shard1 := NewGormRepository(db, TableSuffix("_1")) // orders_1
+func TableSuffix(suffix string) GormOption {
+	return func(opts *GormOptions) { opts.TableSuffix = suffix }
 }
 
 // NewGormRepository
 // usage:
-//   repo := NewGormRepository(db)
+//   repo := NewGormRepository(db, DefaultTimeout(3*time.Second))
 //   // find
 //   var users []User
 //   ctx := context.Background()
@@ -68,127 +166,694 @@ type gormRepository struct {
 //   	}
 //   }
 //   err := repo.Find(ctx, database.M(&books, &Book{}).With(&User{}, AuthorID(Field("users.id"))), Limit(20))
-func NewGormRepository(db *gorm.DB) Repository {
-	return &gormRepository{db: []*gorm.DB{db}}
+func NewGormRepository(db *gorm.DB, opts ...GormOption) Repository {
+	repo := &gormRepository{db: db, opts: GormOptions{BatchSize: DefaultBatchSize}}
+	for _, apply := range opts {
+		apply(&repo.opts)
+	}
+	for _, db := range repo.opts.Replicas {
+		repo.replicas = append(repo.replicas, &replica{db: db})
+	}
+	return repo
 }
 
-func (db *gormRepository) recentDB() *gorm.DB {
-	return db.db[len(db.db)-1]
+// conn the db bound to ctx, so that cancellation and deadline of ctx abort the query.
+// the transaction carried by ctx or the one the repository scoped in is preferred
+func (repo *gormRepository) conn(ctx context.Context) *gorm.DB {
+	if tx, ok := repo.txOf(ctx); ok {
+		return tx.WithContext(ctx)
+	}
+	return repo.db.WithContext(ctx)
 }
 
-func (db *gormRepository) First(ctx context.Context, v interface{}, opts ...MatchOption) error {
-	selector, result := db.model(v)
-	db.applyOptions(selector, opts...)
-	return selector.First(result).Error
+func (repo *gormRepository) txOf(ctx context.Context) (*gorm.DB, bool) {
+	if tx, ok := ctx.Value(txKey{db: repo.db}).(*gorm.DB); ok {
+		return tx, true
+	}
+	return repo.tx, repo.tx != nil
+}
+
+// withTimeout derive ctx with the per-call timeout, or the default timeout if it's not given
+func (repo *gormRepository) withTimeout(ctx context.Context, timeout *time.Duration) (context.Context, context.CancelFunc) {
+	d := repo.opts.Timeout
+	if timeout != nil {
+		d = *timeout
+	}
+	if d <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, d)
+}
+
+// error map the error caused by ctx to ContextError, and translate the others, see Error
+func (repo *gormRepository) error(ctx context.Context, op string, err error) error {
+	if err == nil {
+		return nil
+	}
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return &ContextError{Op: op, Err: ctxErr}
+	}
+	return translate(err)
+}
+
+// wrote map err like error, and mark ctx as having written for the reads of the sticky ctx
+func (repo *gormRepository) wrote(ctx context.Context, op string, err error) error {
+	written(ctx)
+	return repo.error(ctx, op, err)
+}
+
+func (repo *gormRepository) First(ctx context.Context, v interface{}, opts ...MatchOption) error {
+	opt := &MatchOptions{}
+	opt.Apply(opts...)
+	ctx, cancel := repo.withTimeout(ctx, opt.Timeout)
+	defer cancel()
+	return repo.error(ctx, "first", repo.read(ctx, func(db *gorm.DB) error {
+		selector, result, err := repo.model(db, v)
+		if err != nil {
+			return err
+		}
+		if err := repo.applyOptions(selector, opt); err != nil {
+			return err
+		}
+		return selector.First(result).Error
+	}))
 }
 
-func (db *gormRepository) Find(ctx context.Context, v interface{}, opts ...MatchOption) error {
-	selector, result := db.model(v)
-	db.applyOptions(selector, opts...)
-	return selector.Find(result).Error
+func (repo *gormRepository) Find(ctx context.Context, v interface{}, opts ...MatchOption) error {
+	opt := &MatchOptions{}
+	opt.Apply(opts...)
+	ctx, cancel := repo.withTimeout(ctx, opt.Timeout)
+	defer cancel()
+	return repo.error(ctx, "find", repo.read(ctx, func(db *gorm.DB) error {
+		selector, result, err := repo.model(db, v)
+		if err != nil {
+			return err
+		}
+		if err := repo.applyOptions(selector, opt); err != nil {
+			return err
+		}
+		return selector.Find(result).Error
+	}))
 }
 
 // db.Count(ctx, database.M(result, &User{}))
-func (db *gormRepository) Count(ctx context.Context, v interface{}, result *int64, opts ...MatchOption) error {
-	selector, _ := db.model(v)
-	db.applyOptions(selector, opts...)
-	return selector.Count(result).Error
+func (repo *gormRepository) Count(ctx context.Context, v interface{}, result *int64, opts ...MatchOption) error {
+	opt := &MatchOptions{}
+	opt.Apply(opts...)
+	ctx, cancel := repo.withTimeout(ctx, opt.Timeout)
+	defer cancel()
+	return repo.error(ctx, "count", repo.read(ctx, func(db *gorm.DB) error {
+		selector, _, err := repo.model(db, v)
+		if err != nil {
+			return err
+		}
+		if err := repo.applyOptions(selector, opt); err != nil {
+			return err
+		}
+		return selector.Count(result).Error
+	}))
 }
 
-func (db *gormRepository) Update(ctx context.Context, v interface{}) error {
-	return db.recentDB().Save(v).Error
+// Paginate
+//   var books []Book
+//   var page Page
+//   err := repo.Paginate(ctx, &books, &page, Sort(Field("created_at").DESC()), Limit(20), After(cursor))
+func (repo *gormRepository) Paginate(ctx context.Context, v interface{}, page *Page, opts ...MatchOption) error {
+	return paginate(ctx, repo, v, page, opts...)
 }
 
-func (db *gormRepository) Delete(ctx context.Context, v interface{}, opts ...MatchOption) error {
-	deletor := db.recentDB().Model(v)
-	db.applyOptions(deletor, opts...)
-	return deletor.Delete(v).Error
+// Rows
+//   rows, err := repo.Rows(ctx, &User{}, Role("member"))
+//   defer rows.Close()
+//   for rows.Next() {
+//       var user User
+//       if err := rows.Scan(&user); err != nil {
+//           return err
+//       }
+//   }
+//   return rows.Err()
+func (repo *gormRepository) Rows(ctx context.Context, v interface{}, opts ...MatchOption) (Rows, error) {
+	opt := &MatchOptions{}
+	opt.Apply(opts...)
+	ctx, cancel := repo.withTimeout(ctx, opt.Timeout)
+	var selector *gorm.DB
+	var rows *sql.Rows
+	err := repo.read(ctx, func(db *gorm.DB) error {
+		var err error
+		if selector, _, err = repo.model(db, v); err != nil {
+			return err
+		}
+		if err := repo.applyOptions(selector, opt); err != nil {
+			return err
+		}
+		rows, err = selector.Rows()
+		return err
+	})
+	if err != nil {
+		cancel()
+		return nil, repo.error(ctx, "rows", err)
+	}
+	return &gormRows{repo: repo, db: selector, rows: rows, ctx: ctx, cancel: cancel}, nil
+}
+
+// Each
+//   var users []User
+//   err := repo.Each(ctx, &users, 500, func(ctx context.Context) error {
+//       return notify(ctx, users)
+//   }, Role("member"))
+func (repo *gormRepository) Each(ctx context.Context, v interface{}, size int, do func(ctx context.Context) error, opts ...MatchOption) error {
+	return each(ctx, repo, v, size, do, opts...)
+}
+
+// Update save all the fields of v. if v has a field tagged lock:"version", the record is updated only
+// if its version is still the one of v, and the version is increased. ErrConflict is returned if the
+// record was updated by others since v was read
+//   type Article struct {
+//       ID      string
+//       Body    string
+//       Version int64 `lock:"version"`
+//   }
+//   err := repo.Update(ctx, &article)
+//   if errors.Is(err, database.ErrConflict) {
+//       // reload the article and retry
+//   }
+func (repo *gormRepository) Update(ctx context.Context, v interface{}) error {
+	ctx, cancel := repo.withTimeout(ctx, nil)
+	defer cancel()
+	field, column, ok := versionField(reflect.ValueOf(v))
+	if !ok {
+		return repo.wrote(ctx, "update", repo.table(repo.conn(ctx), v).Save(v).Error)
+	}
+	quoted, err := repo.quote(column)
+	if err != nil {
+		return err
+	}
+	version := reflect.New(field.Type()).Elem()
+	version.Set(field)
+	if field.CanSet() {
+		increase(field)
+	}
+	// all the fields are selected, so that gorm never falls back to create the record when no row is updated
+	result := repo.table(repo.conn(ctx), v).Where(quoted+" = ?", version.Interface()).Select("*").Save(v)
+	if result.Error == nil && result.RowsAffected == 0 {
+		result.Error = &Error{Kind: ErrConflict, Err: fmt.Errorf("%T of version %v was updated by others", v, version.Interface())}
+	}
+	if result.Error != nil && field.CanSet() {
+		field.Set(version)
+	}
+	return repo.wrote(ctx, "update", result.Error)
+}
+
+// increase the integer field by 1
+func increase(field reflect.Value) {
+	switch field.Kind() {
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		field.SetUint(field.Uint() + 1)
+	default:
+		field.SetInt(field.Int() + 1)
+	}
+}
+
+// Delete the records are soft deleted if the model has a gorm.DeletedAt field, Trashed of opts is
+// ignored so that the soft deleted records are never deleted for good by Delete, see ForceDelete
+func (repo *gormRepository) Delete(ctx context.Context, v interface{}, opts ...MatchOption) error {
+	opt := &MatchOptions{}
+	opt.Apply(opts...)
+	opt.Trashed = TrashedExcluded
+	ctx, cancel := repo.withTimeout(ctx, opt.Timeout)
+	defer cancel()
+	deletor := repo.table(repo.conn(ctx).Model(v), v)
+	if err := repo.applyOptions(deletor, opt); err != nil {
+		return err
+	}
+	return repo.wrote(ctx, "delete", deletor.Delete(v).Error)
+}
+
+// Restore
+//   err := repo.Restore(ctx, &User{}, ID("1"))
+func (repo *gormRepository) Restore(ctx context.Context, v interface{}, opts ...MatchOption) error {
+	column, ok := deletedAtColumn(v)
+	if !ok {
+		return fmt.Errorf("restore: %T has no gorm.DeletedAt field", v)
+	}
+	opt := &MatchOptions{}
+	opt.Apply(opts...)
+	opt.Trashed = TrashedOnly
+	ctx, cancel := repo.withTimeout(ctx, opt.Timeout)
+	defer cancel()
+	restorer := repo.table(repo.conn(ctx).Model(v), v)
+	if err := repo.applyOptions(restorer, opt); err != nil {
+		return err
+	}
+	return repo.wrote(ctx, "restore", restorer.UpdateColumn(column, nil).Error)
+}
+
+// ForceDelete the soft deleted records are deleted as well, unless OnlyTrashed is given to purge only them
+//   err := repo.ForceDelete(ctx, &User{}, OnlyTrashed(), func(opts *MatchOptions) {
+//       opts.LT("deleted_at", time.Now().AddDate(0, -1, 0))
+//   })
+func (repo *gormRepository) ForceDelete(ctx context.Context, v interface{}, opts ...MatchOption) error {
+	opt := &MatchOptions{}
+	opt.Apply(opts...)
+	if opt.Trashed == TrashedExcluded {
+		opt.Trashed = TrashedIncluded
+	}
+	ctx, cancel := repo.withTimeout(ctx, opt.Timeout)
+	defer cancel()
+	deletor := repo.table(repo.conn(ctx).Model(v), v)
+	if err := repo.applyOptions(deletor, opt); err != nil {
+		return err
+	}
+	return repo.wrote(ctx, "force delete", deletor.Delete(v).Error)
+}
+
+func (repo *gormRepository) Create(ctx context.Context, v interface{}) error {
+	ctx, cancel := repo.withTimeout(ctx, nil)
+	defer cancel()
+	return repo.wrote(ctx, "create", repo.table(repo.conn(ctx), v).Create(v).Error)
+}
+
+func (repo *gormRepository) UpdateFields(ctx context.Context, v interface{}, fields Fields, opts ...MatchOption) error {
+	opt := &MatchOptions{}
+	opt.Apply(opts...)
+	ctx, cancel := repo.withTimeout(ctx, opt.Timeout)
+	defer cancel()
+	updator := repo.table(repo.conn(ctx).Model(v), v)
+	if err := repo.applyOptions(updator, opt); err != nil {
+		return err
+	}
+	return repo.wrote(ctx, "update fields", updator.UpdateColumns(map[string]interface{}(fields)).Error)
+}
+
+// CreateInBatches
+//   users := []User{{Name: "a"}, {Name: "b"}, {Name: "c"}}
+//   err := repo.CreateInBatches(ctx, &users, 2)
+func (repo *gormRepository) CreateInBatches(ctx context.Context, v interface{}, batchSize int) error {
+	ctx, cancel := repo.withTimeout(ctx, nil)
+	defer cancel()
+	return repo.wrote(ctx, "create in batches", repo.table(repo.conn(ctx), v).CreateInBatches(v, repo.batchSize(batchSize)).Error)
+}
+
+// Upsert
+//   // INSERT ... ON DUPLICATE KEY UPDATE `name`=VALUES(`name`)
+//   err := repo.Upsert(ctx, &users, []string{"email"}, "name")
+func (repo *gormRepository) Upsert(ctx context.Context, v interface{}, conflict []string, update ...string) error {
+	onConflict := clause.OnConflict{UpdateAll: len(update) == 0}
+	for _, name := range conflict {
+		column, err := Identifier(name)
+		if err != nil {
+			return err
+		}
+		onConflict.Columns = append(onConflict.Columns, clause.Column{Name: column})
+	}
+	if len(update) > 0 {
+		columns := make([]string, len(update))
+		for i, name := range update {
+			var err error
+			if columns[i], err = Identifier(name); err != nil {
+				return err
+			}
+		}
+		onConflict.DoUpdates = clause.AssignmentColumns(columns)
+	}
+	ctx, cancel := repo.withTimeout(ctx, nil)
+	defer cancel()
+	return repo.wrote(ctx, "upsert", repo.table(repo.conn(ctx), v).Clauses(onConflict).CreateInBatches(v, repo.batchSize(0)).Error)
+}
+
+// BulkUpdateFields update every column with a CASE of the primary key, the records are updated
+// in batches of the repository's batch size, all batches in a transaction
+//   err := repo.BulkUpdateFields(ctx, &User{}, map[interface{}]Fields{
+//       "1": {"name": "a"},
+//       "2": {"name": "b", "role": "admin"},
+//   })
+func (repo *gormRepository) BulkUpdateFields(ctx context.Context, v interface{}, rows map[interface{}]Fields) error {
+	if len(rows) == 0 {
+		return nil
+	}
+	name, ok := primaryKeyColumn(reflect.TypeOf(v))
+	if !ok {
+		return fmt.Errorf("bulk update fields: %T has no primary key", v)
+	}
+	pk, err := repo.quote(name)
+	if err != nil {
+		return err
+	}
+	keys := make([]interface{}, 0, len(rows))
+	for key := range rows {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool { return fmt.Sprint(keys[i]) < fmt.Sprint(keys[j]) })
+	ctx, cancel := repo.withTimeout(ctx, nil)
+	defer cancel()
+	update := func(db *gorm.DB) error {
+		size := repo.batchSize(0)
+		for i := 0; i < len(keys); i += size {
+			end := i + size
+			if end > len(keys) {
+				end = len(keys)
+			}
+			fields, err := repo.caseFields(pk, keys[i:end], rows)
+			if err != nil {
+				return err
+			}
+			if err := repo.table(db.Model(v), v).Where(pk+" IN ?", keys[i:end]).UpdateColumns(fields).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	db := repo.conn(ctx)
+	if len(keys) > repo.batchSize(0) {
+		return repo.wrote(ctx, "bulk update fields", db.Transaction(update))
+	}
+	return repo.wrote(ctx, "bulk update fields", update(db))
 }
 
-func (db *gormRepository) Create(ctx context.Context, v interface{}) error {
-	return db.recentDB().Create(v).Error
+// caseFields compile the fields of the records keyed by keys to `column` = CASE `pk` WHEN ? THEN ? ... ELSE `column` END
+func (repo *gormRepository) caseFields(pk string, keys []interface{}, rows map[interface{}]Fields) (map[string]interface{}, error) {
+	columns := []string{}
+	seen := map[string]bool{}
+	for _, key := range keys {
+		for column := range rows[key] {
+			if !seen[column] {
+				seen[column] = true
+				columns = append(columns, column)
+			}
+		}
+	}
+	sort.Strings(columns)
+	fields := make(map[string]interface{}, len(columns))
+	for _, column := range columns {
+		ident, err := Identifier(column)
+		if err != nil {
+			return nil, err
+		}
+		quoted, err := repo.quote(ident)
+		if err != nil {
+			return nil, err
+		}
+		var b strings.Builder
+		args := []interface{}{}
+		b.WriteString("CASE " + pk)
+		for _, key := range keys {
+			if value, ok := rows[key][column]; ok {
+				b.WriteString(" WHEN ? THEN ?")
+				args = append(args, key, value)
+			}
+		}
+		b.WriteString(" ELSE " + quoted + " END")
+		fields[ident] = gorm.Expr(b.String(), args...)
+	}
+	return fields, nil
 }
 
-func (db *gormRepository) UpdateFields(ctx context.Context, v interface{}, fields Fields, opts ...MatchOption) error {
-	updator := db.recentDB().Model(v)
-	db.applyOptions(updator, opts...)
-	return updator.UpdateColumns(fields).Error
+func (repo *gormRepository) batchSize(size int) int {
+	if size > 0 {
+		return size
+	}
+	if repo.opts.BatchSize > 0 {
+		return repo.opts.BatchSize
+	}
+	return DefaultBatchSize
 }
 
 func (repo *gormRepository) tableName(v interface{}) string {
+	if t, ok := v.(valueTabler); ok && t.valueTable() != "" {
+		return t.valueTable()
+	}
 	if t, ok := v.(tableNamer); ok {
 		return t.TableName()
 	}
-	ptrv := reflect.ValueOf(v)
-	if ptrv.Kind() == reflect.Ptr {
-		ptrv = ptrv.Elem()
+	t := indirectType(reflect.TypeOf(v))
+	if tn, ok := reflect.New(t).Interface().(tableNamer); ok {
+		return tn.TableName()
 	}
-	return repo.recentDB().NamingStrategy.TableName(ptrv.Type().Name())
+	return repo.db.NamingStrategy.TableName(t.Name())
 }
 
-func (repo *gormRepository) Push(db *gorm.DB) {
-	repo.db = append(repo.db, db)
+// table scope db to the suffixed table of the model v if TableSuffix is given, or to the table of v
+// if it's decided by the value
+func (repo *gormRepository) table(db *gorm.DB, v interface{}) *gorm.DB {
+	if t, ok := v.(valueTabler); ok && t.valueTable() != "" {
+		return db.Table(t.valueTable() + repo.opts.TableSuffix)
+	}
+	if repo.opts.TableSuffix == "" {
+		return db
+	}
+	return db.Table(repo.tableName(v) + repo.opts.TableSuffix)
 }
 
-func (repo *gormRepository) Pop() {
-	if len(repo.db) <= 1 {
-		return
+// Transaction run do in a transaction. the transaction is carried by the ctx passed to do, and
+// the repo passed to do is scoped in the transaction. calling Transaction inside do starts a
+// savepoint of the outer transaction. the outermost transaction is retried on deadlock if RetryOnDeadlock given
+func (repo *gormRepository) Transaction(ctx context.Context, do func(ctx context.Context, repo Repository) error, opts ...TxOption) error {
+	opt := &TxOptions{}
+	for _, apply := range opts {
+		apply(opt)
+	}
+	run := func(tx *gorm.DB) error {
+		return do(context.WithValue(ctx, txKey{db: repo.db}, tx), &gormRepository{db: repo.db, tx: tx, opts: repo.opts})
 	}
-	repo.db = repo.db[:len(repo.db)-1]
+	if tx, ok := repo.txOf(ctx); ok {
+		return repo.wrote(ctx, "transaction", tx.WithContext(ctx).Transaction(run))
+	}
+	end := &txEnd{}
+	ctx = context.WithValue(ctx, txEndKey{}, end)
+	defer end.run()
+	var err error
+	for i := 0; i <= opt.Retries; i++ {
+		if err = repo.db.WithContext(ctx).Transaction(run, opt.sqlTxOptions()); err == nil || !isDeadlock(err) {
+			break
+		}
+	}
+	return repo.wrote(ctx, "transaction", err)
 }
 
-func (db *gormRepository) Transaction(do func() error) {
-	db.recentDB().Transaction(func(tx *gorm.DB) error {
-		db.Push(tx)
-		defer db.Pop()
-		return do()
-	})
+func isDeadlock(err error) bool {
+	return errors.Is(translate(err), ErrDeadlock)
 }
 
-func (repo *gormRepository) compileMatchOptions(opts MatchOptions) (string, []interface{}) {
-	ret := ""
-	values := []interface{}{}
-	for i, opt := range opts.Matches {
-		switch opt.Operator {
-		case NULL:
-			if i > 0 {
-				ret += " AND "
-			}
-			ret += fmt.Sprintf("%s IS NULL", opt.Field)
-		case NOTNULL:
-			if i > 0 {
-				ret += " AND "
+// quote validate name and quote it per dialect. aggregates of a column like count(id) are allowed too
+func (repo *gormRepository) quote(name string) (string, error) {
+	if fn, distinct, column, ok := Aggregate(name); ok {
+		quoted := "*"
+		if column != "*" {
+			var err error
+			if quoted, err = repo.quote(column); err != nil {
+				return "", err
 			}
-			ret += fmt.Sprintf("%s IS NULL", opt.Field)
-		case OR:
-			str, subValues := repo.compileMatchOptions(opt.Value.(MatchOptions))
-			ret += fmt.Sprintf(" OR (%s)", str)
-			values = append(values, subValues...)
-		case AND:
-			str, subValues := repo.compileMatchOptions(opt.Value.(MatchOptions))
-			ret += fmt.Sprintf(" AND (%s)", str)
-			values = append(values, subValues...)
-		default:
-			if i > 0 {
-				ret += " AND "
+		}
+		if distinct {
+			quoted = "DISTINCT " + quoted
+		}
+		return fmt.Sprintf("%s(%s)", fn, quoted), nil
+	}
+	ident, err := Identifier(name)
+	if err != nil {
+		return "", err
+	}
+	var b strings.Builder
+	repo.db.Dialector.QuoteTo(&b, ident)
+	return b.String(), nil
+}
+
+// aggregation compile the aggregation to FUNC(`column`) AS `alias`
+func (repo *gormRepository) aggregation(agg Aggregation) (string, error) {
+	fn := strings.ToUpper(agg.Func)
+	switch fn {
+	case "SUM", "AVG", "MIN", "MAX", "COUNT":
+	default:
+		return "", fmt.Errorf("%w: %q", ErrInvalidIdentifier, agg.Func)
+	}
+	column := "*"
+	if agg.Field != "*" || fn != "COUNT" || agg.Distinct {
+		var err error
+		if column, err = repo.quote(agg.Field); err != nil {
+			return "", err
+		}
+	}
+	if agg.Distinct {
+		column = "DISTINCT " + column
+	}
+	alias, err := Identifier(agg.as())
+	if err != nil || strings.Contains(alias, ".") {
+		return "", fmt.Errorf("%w: %q", ErrInvalidIdentifier, agg.as())
+	}
+	var b strings.Builder
+	repo.db.Dialector.QuoteTo(&b, alias)
+	return fmt.Sprintf("%s(%s) AS %s", fn, column, b.String()), nil
+}
+
+// compileMatchOptions compile opts to the condition used in WHERE, JOIN ON and HAVING
+func (repo *gormRepository) compileMatchOptions(opts MatchOptions) (string, []interface{}, error) {
+	return repo.compileMatches(opts.Matches, " AND ")
+}
+
+// compileWhere compile a top level match of WHERE. gorm parenthesizes the conditions joined
+// by AND or OR itself, so the groups are compiled without parentheses
+func (repo *gormRepository) compileWhere(item MatchItem) (string, []interface{}, error) {
+	switch item.Operator {
+	case OR:
+		return repo.compileMatches(item.Value.(MatchOptions).Matches, " OR ")
+	case AND:
+		return repo.compileMatches(item.Value.(MatchOptions).Matches, " AND ")
+	}
+	return repo.compileMatchItem(item)
+}
+
+func (repo *gormRepository) compileMatches(items []MatchItem, sep string) (string, []interface{}, error) {
+	conds := make([]string, 0, len(items))
+	values := []interface{}{}
+	for _, item := range items {
+		cond, subValues, err := repo.compileMatchItem(item)
+		if err != nil {
+			return "", nil, err
+		}
+		if cond == "" {
+			continue
+		}
+		conds = append(conds, cond)
+		values = append(values, subValues...)
+	}
+	return strings.Join(conds, sep), values, nil
+}
+
+// compileMatchItem compile a node of the match tree, groups are always parenthesized so that
+// the precedence never depends on where the node is placed. empty groups compile to nothing.
+// fields are validated and quoted, values are always bound as args
+func (repo *gormRepository) compileMatchItem(item MatchItem) (string, []interface{}, error) {
+	switch item.Operator {
+	case OR, AND, NOT:
+		sep := " AND "
+		if item.Operator == OR {
+			sep = " OR "
+		}
+		cond, values, err := repo.compileMatches(item.Value.(MatchOptions).Matches, sep)
+		if err != nil || cond == "" {
+			return "", nil, err
+		}
+		if item.Operator == NOT {
+			return fmt.Sprintf("NOT (%s)", cond), values, nil
+		}
+		return fmt.Sprintf("(%s)", cond), values, nil
+	case EXISTS, NOTEXISTS:
+		query, args := "", []interface{}{}
+		switch sub := item.Value.(type) {
+		case SQL:
+			query, args = sub.Query, sub.Args
+		case *Model:
+			subquery, err := repo.subquery(sub)
+			if err != nil {
+				return "", nil, err
 			}
-			if field, ok := opt.Value.(Field); ok {
-				ret += fmt.Sprintf("%s %s %s", opt.Field, operatorMap[opt.Operator], field)
-				continue
+			query, args = "?", []interface{}{subquery}
+		}
+		if item.Operator == NOTEXISTS {
+			return fmt.Sprintf("NOT EXISTS (%s)", query), args, nil
+		}
+		return fmt.Sprintf("EXISTS (%s)", query), args, nil
+	case FULLTEXT:
+		search := item.Value.(FullText)
+		fields := make([]string, len(search.Fields))
+		for i, f := range search.Fields {
+			var err error
+			if fields[i], err = repo.quote(f); err != nil {
+				return "", nil, err
 			}
-			values = append(values, opt.Value)
-			ret += fmt.Sprintf("%s %s ?", opt.Field, operatorMap[opt.Operator])
 		}
+		return repo.compileFullText(fields, search)
+	}
+	field, err := repo.quote(item.Field)
+	if err != nil {
+		return "", nil, err
+	}
+	values := []interface{}{}
+	switch item.Operator {
+	case NULL:
+		return fmt.Sprintf("%s IS NULL", field), nil, nil
+	case NOTNULL:
+		return fmt.Sprintf("%s IS NOT NULL", field), nil, nil
+	case JSONCONTAINS:
+		return repo.compileJSONContains(field, item.Path, item.Value)
+	}
+	if item.Path != "" {
+		field, values = repo.compileJSONExtract(field, item.Path)
+	}
+	switch item.Operator {
+	case BETWEEN:
+		bounds := item.Value.([]interface{})
+		return fmt.Sprintf("%s BETWEEN ? AND ?", field), append(values, bounds...), nil
+	case ILIKE:
+		return fmt.Sprintf("LOWER(%s) LIKE LOWER(?)%s", field, repo.likeEscape()), append(values, item.Value), nil
+	case LIKE:
+		return fmt.Sprintf("%s LIKE ?%s", field, repo.likeEscape()), append(values, item.Value), nil
+	case REGEXP:
+		oper, err := repo.regexpOperator()
+		if err != nil {
+			return "", nil, err
+		}
+		return fmt.Sprintf("%s %s ?", field, oper), append(values, item.Value), nil
 	}
-	return ret, values
+	oper, ok := operatorMap[item.Operator]
+	if !ok {
+		return "", nil, fmt.Errorf("unknown operator [%d] of field %s", item.Operator, item.Field)
+	}
+	if sub, ok := item.Value.(*Model); ok {
+		subquery, err := repo.subquery(sub)
+		if err != nil {
+			return "", nil, err
+		}
+		return fmt.Sprintf("%s %s (?)", field, oper), append(values, subquery), nil
+	}
+	if ref, ok := item.Value.(Field); ok {
+		quoted, err := repo.quote(string(ref))
+		if err != nil {
+			return "", nil, err
+		}
+		return fmt.Sprintf("%s %s %s", field, oper, quoted), values, nil
+	}
+	return fmt.Sprintf("%s %s ?", field, oper), append(values, item.Value), nil
 }
 
-func (repo *gormRepository) model(v interface{}) (*gorm.DB, interface{}) {
+// compileSort compile the sort specs to ORDER BY, see ParseSort for the spec
+func (repo *gormRepository) compileSort(sort []string) (string, error) {
+	cols := make([]string, len(sort))
+	for i, spec := range sort {
+		column, desc, err := ParseSort(spec)
+		if err != nil {
+			return "", err
+		}
+		if cols[i], err = repo.quote(column); err != nil {
+			return "", err
+		}
+		if desc {
+			cols[i] += " DESC"
+		}
+	}
+	return strings.Join(cols, ","), nil
+}
+
+func (repo *gormRepository) model(db *gorm.DB, v interface{}) (*gorm.DB, interface{}, error) {
 	m, ok := v.(*Model)
 	if !ok {
-		return repo.recentDB().Model(v), v
+		return repo.table(db.Model(v), v), v, nil
+	}
+	if len(m.Unions) > 0 {
+		return repo.union(db, m)
+	}
+	model := repo.table(db.Model(m.From), m.From)
+	var from string
+	if m.Alias != "" {
+		alias, err := repo.alias(m.Alias)
+		if err != nil {
+			return nil, nil, err
+		}
+		model.Table(repo.tableName(m.From) + repo.opts.TableSuffix + " AS " + alias)
+		// the columns gorm qualifies by itself are qualified by the alias rather than the table
+		model.Statement.Table = m.Alias
+		from = m.Alias
 	}
-	model := repo.recentDB().Model(m.From)
 	for _, join := range m.Joins {
 		str := ""
 		switch join.Type {
@@ -199,59 +864,217 @@ func (repo *gormRepository) model(v interface{}) (*gorm.DB, interface{}) {
 		case InnerJoin:
 			str += "Inner JOIN "
 		}
-		str += repo.tableName(join.Model) + " ON "
-		condi, values := repo.compileMatchOptions(join.Opts)
+		values := []interface{}{}
+		if sub, ok := join.Model.(*Model); ok {
+			name := join.Alias
+			if name == "" {
+				name = sub.Alias
+			}
+			alias, err := repo.alias(name)
+			if err != nil {
+				return nil, nil, err
+			}
+			// the alias is of the subquery, not of the table inside it
+			inner := *sub
+			inner.Alias = ""
+			subquery, err := repo.subquery(&inner)
+			if err != nil {
+				return nil, nil, err
+			}
+			str += "(?) AS " + alias + " ON "
+			values = append(values, subquery)
+		} else if join.Alias != "" {
+			alias, err := repo.alias(join.Alias)
+			if err != nil {
+				return nil, nil, err
+			}
+			str += repo.tableName(join.Model) + " AS " + alias + " ON "
+		} else {
+			str += repo.tableName(join.Model) + " ON "
+		}
+		condi, condValues, err := repo.compileMatchOptions(join.Opts)
+		if err != nil {
+			return nil, nil, err
+		}
 		str += condi
-		model.Joins(str, values...)
+		model.Joins(str, append(values, condValues...)...)
 	}
-	if m.Grp != nil {
-		model.Group(m.Grp.By)
+	if m.Grp != nil && m.Grp.By != "" {
+		for _, by := range strings.Split(m.Grp.By, ",") {
+			column, err := Identifier(by)
+			if err != nil {
+				return nil, nil, err
+			}
+			model.Group(column)
+		}
 		if m.Grp.Having != nil {
-			condi, values := repo.compileMatchOptions(*m.Grp.Having)
+			having := *m.Grp.Having
+			if repo.dialect() == Postgres {
+				having = unaliased(having, m.Aggs)
+			}
+			condi, values, err := repo.compileMatchOptions(having)
+			if err != nil {
+				return nil, nil, err
+			}
 			model.Having(condi, values...)
 		}
 	}
+	for _, preload := range m.Preloads {
+		field, err := Identifier(preload.Field)
+		if err != nil {
+			return nil, nil, err
+		}
+		opts := preload.Opts
+		model.Preload(field, func(db *gorm.DB) *gorm.DB {
+			// the preload db is a session cloned by every chained call, so an instance is taken to apply opts to
+			db = db.Scopes()
+			if err := repo.applyOptions(db, &opts); err != nil {
+				db.AddError(err)
+			}
+			return db
+		})
+	}
+	if err := repo.applyOptions(model, &m.Opts); err != nil {
+		return nil, nil, err
+	}
+	if len(m.Aggs) > 0 {
+		columns := []string{}
+		if m.Grp != nil && m.Grp.By != "" {
+			for _, by := range strings.Split(m.Grp.By, ",") {
+				column, err := repo.quote(by)
+				if err != nil {
+					return nil, nil, err
+				}
+				columns = append(columns, column)
+			}
+		}
+		for _, agg := range m.Aggs {
+			column, err := repo.aggregation(agg)
+			if err != nil {
+				return nil, nil, err
+			}
+			columns = append(columns, column)
+		}
+		model.Select(columns)
+		return model, m.Result, nil
+	}
 	if m.Result == nil {
-		return model, nil
+		return model, nil, nil
 	}
-	vm := reflect.ValueOf(m.Result)
-	for vm.Kind() == reflect.Slice || vm.Kind() == reflect.Array || vm.Kind() == reflect.Ptr {
-		vm = vm.Elem()
+	vt := reflect.TypeOf(m.Result)
+	for vt.Kind() == reflect.Slice || vt.Kind() == reflect.Array || vt.Kind() == reflect.Ptr {
+		vt = vt.Elem()
 	}
-	if vm.Kind() != reflect.Struct {
-		return model, m.Result
+	if vt.Kind() != reflect.Struct {
+		return model, m.Result, nil
 	}
-	fields := structs.Fields(m.Result)
-	fieldNames := make([]string, len(fields))
-	for j, f := range fields {
-		fieldNames[j] = fmt.Sprintf("%s AS %s", f.Tag("field"), utils.ToSnakeCase(f.Name()))
+	fieldNames := []string{}
+	for _, f := range structs.Fields(reflect.New(vt).Interface()) {
+		field := f.Tag("field")
+		if field == "" {
+			continue
+		}
+		// a bare column is of the aliased table of the model
+		if ident, err := Identifier(field); from != "" && err == nil && !strings.Contains(ident, ".") {
+			field = from + "." + ident
+		}
+		fieldNames = append(fieldNames, fmt.Sprintf("%s AS %s", field, utils.ToSnakeCase(f.Name())))
+	}
+	if len(fieldNames) > 0 {
+		model.Select(fieldNames)
 	}
-	model.Select(fieldNames)
 
-	return model, m.Result
+	return model, m.Result, nil
 }
 
-func (repo *gormRepository) applyOptions(db *gorm.DB, opts ...MatchOption) {
-	opt := &MatchOptions{}
-	opt.Apply(opts...)
+// subquery the query of the model m, which is rendered with its args in place where it's used as an arg
+func (repo *gormRepository) subquery(m *Model) (*gorm.DB, error) {
+	sub, _, err := repo.model(repo.db.Session(&gorm.Session{NewDB: true}), m)
+	return sub, err
+}
+
+// alias validate and quote the alias of a model
+func (repo *gormRepository) alias(alias string) (string, error) {
+	ident, err := Identifier(alias)
+	if err != nil || strings.Contains(ident, ".") {
+		return "", fmt.Errorf("%w: %q", ErrInvalidIdentifier, alias)
+	}
+	var b strings.Builder
+	repo.db.Dialector.QuoteTo(&b, ident)
+	return b.String(), nil
+}
+
+// union select from the union of m and the models united with it, aliased as u if m has no alias
+func (repo *gormRepository) union(db *gorm.DB, m *Model) (*gorm.DB, interface{}, error) {
+	first := *m
+	first.Unions = nil
+	first.Alias = ""
+	parts := []string{"(?)"}
+	subs := []interface{}{}
+	sub, err := repo.subquery(&first)
+	if err != nil {
+		return nil, nil, err
+	}
+	subs = append(subs, sub)
+	for _, union := range m.Unions {
+		if sub, err = repo.subquery(union.Model); err != nil {
+			return nil, nil, err
+		}
+		if union.All {
+			parts = append(parts, "UNION ALL (?)")
+		} else {
+			parts = append(parts, "UNION (?)")
+		}
+		subs = append(subs, sub)
+	}
+	name := m.Alias
+	if name == "" {
+		name = "u"
+	}
+	alias, err := repo.alias(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	return db.Table("("+strings.Join(parts, " ")+") AS "+alias, subs...), m.Result, nil
+}
+
+func (repo *gormRepository) applyOptions(db *gorm.DB, opt *MatchOptions) error {
+	switch opt.Trashed {
+	case TrashedIncluded:
+		db.Statement.Unscoped = true
+	case TrashedOnly:
+		db.Statement.Unscoped = true
+		column, ok := deletedAtColumn(db.Statement.Model)
+		if !ok {
+			column = "deleted_at"
+		}
+		db.Where(clause.Expr{SQL: "? IS NOT NULL", Vars: []interface{}{clause.Column{Table: clause.CurrentTable, Name: column}}})
+	}
 	for _, match := range opt.Matches {
-		switch match.Operator {
-		case NULL:
-			db.Where(fmt.Sprintf("%s IS NULL", match.Field))
-		case NOTNULL:
-			db.Where(fmt.Sprintf("%s IS NOT NULL", match.Field))
-		case OR:
-			str, values := repo.compileMatchOptions(*match.Value.(*MatchOptions))
-			db.Where(fmt.Sprintf("OR (%s)", str), values...)
-		case AND:
-			str, values := repo.compileMatchOptions(*match.Value.(*MatchOptions))
-			db.Where(fmt.Sprintf("AND (%s)", str), values...)
-		default:
-			db.Where(fmt.Sprintf("%s %s ?", match.Field, operatorMap[match.Operator]), match.Value)
+		cond, values, err := repo.compileWhere(match)
+		if err != nil {
+			return err
+		}
+		if cond != "" {
+			db.Where(cond, values...)
 		}
 	}
 	if len(opt.Sort) > 0 {
-		db.Order(strings.Join(opt.Sort, ","))
+		order, err := repo.compileSort(opt.Sort)
+		if err != nil {
+			return err
+		}
+		db.Order(order)
+	}
+	if len(opt.Select) > 0 {
+		columns := make([]string, len(opt.Select))
+		for i, name := range opt.Select {
+			var err error
+			if columns[i], err = repo.quote(name); err != nil {
+				return err
+			}
+		}
+		db.Select(strings.Join(columns, ","))
 	}
 	if opt.Limit != nil {
 		db.Limit(*opt.Limit)
@@ -259,4 +1082,8 @@ func (repo *gormRepository) applyOptions(db *gorm.DB, opts ...MatchOption) {
 	if opt.Offset != nil {
 		db.Offset(*opt.Offset)
 	}
+	if opt.ForUpdate {
+		db.Clauses(clause.Locking{Strength: "UPDATE"})
+	}
+	return nil
 }
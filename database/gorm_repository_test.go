@@ -4,13 +4,15 @@ import (
 	"context"
 	"database/sql"
 	"database/sql/driver"
+	"errors"
 	"reflect"
 	"testing"
 	"time"
 
 	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/go-sql-driver/mysql"
 	"github.com/stretchr/testify/assert"
-	"gorm.io/driver/mysql"
+	gormmysql "gorm.io/driver/mysql"
 	"gorm.io/gorm"
 )
 
@@ -69,7 +71,7 @@ func (a AnyTime) Match(v driver.Value) bool {
 }
 
 func dialector(db *sql.DB) gorm.Dialector {
-	return mysql.New(mysql.Config{
+	return gormmysql.New(gormmysql.Config{
 		Conn:                      db,
 		DriverName:                "mysql",
 		SkipInitializeWithVersion: true,
@@ -85,7 +87,7 @@ func TestGormRepository_Join(t *testing.T) {
 	assert.Nil(t, err)
 	repo := NewGormRepository(gdb)
 	func() {
-		execSql := "^SELECT books\\.id AS id,books\\.name AS name,users\\.id AS author_id,users\\.name AS author_name FROM `books` LEFT JOIN users ON book\\.author_id = user\\.id WHERE book\\.author_id IN \\(\\?,\\?,\\?\\)$"
+		execSql := "^SELECT books\\.id AS id,books\\.name AS name,users\\.id AS author_id,users\\.name AS author_name FROM `books` LEFT JOIN users ON `book`\\.`author_id` = `user`\\.`id` WHERE `book`\\.`author_id` IN \\(\\?,\\?,\\?\\)$"
 		mock.ExpectQuery(execSql).
 			WithArgs("1", "2", "3").
 			WillReturnRows(sqlmock.NewRows([]string{"id", "name", "author_id", "author_name"}))
@@ -107,7 +109,7 @@ func TestGormRepository_Group(t *testing.T) {
 	assert.Nil(t, err)
 	repo := NewGormRepository(gdb)
 	func() {
-		execSql := "^SELECT author_id AS author_id,count\\(id\\) AS books FROM `books` WHERE book\\.author_id IN \\(\\?,\\?,\\?\\) GROUP BY `author_id` HAVING count\\(id\\) >= \\?$"
+		execSql := "^SELECT author_id AS author_id,count\\(id\\) AS books FROM `books` WHERE `book`\\.`author_id` IN \\(\\?,\\?,\\?\\) GROUP BY `author_id` HAVING count\\(`id`\\) >= \\?$"
 		mock.ExpectQuery(execSql).
 			WithArgs("1", "2", "3", 10).
 			WillReturnRows(sqlmock.NewRows([]string{"author_id", "books"}))
@@ -119,3 +121,510 @@ func TestGormRepository_Group(t *testing.T) {
 	)
 	assert.Nil(t, err)
 }
+
+func TestGormRepository_Timeout(t *testing.T) {
+	db, mock, err := sqlmock.New() // mock sql.DB
+	assert.Nil(t, err)
+	defer db.Close()
+	gdb, err := gorm.Open(dialector(db)) // open gorm db
+	assert.Nil(t, err)
+	repo := NewGormRepository(gdb)
+	func() {
+		execSql := "^SELECT \\* FROM `books` WHERE `book`\\.`author_id` = \\?$"
+		mock.ExpectQuery(execSql).
+			WithArgs("1").
+			WillDelayFor(time.Second).
+			WillReturnRows(sqlmock.NewRows([]string{"id", "name", "author_id"}))
+	}()
+	var books []Book
+	err = repo.Find(context.Background(), &books, AuthorID("1"), func(opts *MatchOptions) { opts.SetTimeout(10 * time.Millisecond) })
+	assert.True(t, errors.Is(err, ErrTimeout))
+	assert.True(t, errors.Is(err, context.DeadlineExceeded))
+	var ctxErr *ContextError
+	assert.True(t, errors.As(err, &ctxErr))
+	assert.Equal(t, "find", ctxErr.Op)
+}
+
+func TestGormRepository_DefaultTimeout(t *testing.T) {
+	db, mock, err := sqlmock.New() // mock sql.DB
+	assert.Nil(t, err)
+	defer db.Close()
+	gdb, err := gorm.Open(dialector(db)) // open gorm db
+	assert.Nil(t, err)
+	repo := NewGormRepository(gdb, DefaultTimeout(10*time.Millisecond))
+	func() {
+		execSql := "^SELECT count\\(\\*\\) FROM `books` WHERE `book`\\.`author_id` = \\?$"
+		mock.ExpectQuery(execSql).
+			WithArgs("1").
+			WillDelayFor(time.Second).
+			WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(1))
+	}()
+	var count int64
+	err = repo.Count(context.Background(), &Book{}, &count, AuthorID("1"))
+	assert.True(t, errors.Is(err, ErrTimeout))
+}
+
+func TestGormRepository_Canceled(t *testing.T) {
+	db, mock, err := sqlmock.New() // mock sql.DB
+	assert.Nil(t, err)
+	defer db.Close()
+	gdb, err := gorm.Open(dialector(db)) // open gorm db
+	assert.Nil(t, err)
+	repo := NewGormRepository(gdb)
+	func() {
+		execSql := "^SELECT \\* FROM `users` WHERE `id` = \\? ORDER BY `users`\\.`id` LIMIT 1$"
+		mock.ExpectQuery(execSql).
+			WithArgs("1").
+			WillDelayFor(time.Second).
+			WillReturnRows(sqlmock.NewRows([]string{"id", "name"}))
+	}()
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		cancel()
+	}()
+	var user User
+	err = repo.First(ctx, &user, func(opts *MatchOptions) { opts.EQ("id", "1") })
+	assert.True(t, errors.Is(err, ErrCanceled))
+	assert.False(t, errors.Is(err, ErrTimeout))
+}
+
+func TestGormRepository_Transaction(t *testing.T) {
+	db, mock, err := sqlmock.New() // mock sql.DB
+	assert.Nil(t, err)
+	defer db.Close()
+	gdb, err := gorm.Open(dialector(db)) // open gorm db
+	assert.Nil(t, err)
+	repo := NewGormRepository(gdb)
+	func() {
+		mock.ExpectBegin()
+		mock.ExpectExec("^INSERT INTO `users` (.*) VALUES (.*)$").
+			WithArgs("1", "author1").
+			WillReturnResult(sqlmock.NewResult(1, 1))
+		mock.ExpectExec("^INSERT INTO `books` (.*) VALUES (.*)$").
+			WithArgs("1", "book1", "1").
+			WillReturnResult(sqlmock.NewResult(1, 1))
+		mock.ExpectCommit().WillReturnError(errors.New("commit failed"))
+	}()
+	err = repo.Transaction(context.Background(), func(ctx context.Context, tx Repository) error {
+		if err := tx.Create(ctx, &User{ID: "1", Name: "author1"}); err != nil {
+			return err
+		}
+		// the outer repository joins the transaction carried by ctx
+		return repo.Create(ctx, &Book{ID: "1", Name: "book1", AuthorID: "1"})
+	})
+	assert.EqualError(t, err, "commit failed")
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestGormRepository_TransactionRollback(t *testing.T) {
+	db, mock, err := sqlmock.New() // mock sql.DB
+	assert.Nil(t, err)
+	defer db.Close()
+	gdb, err := gorm.Open(dialector(db)) // open gorm db
+	assert.Nil(t, err)
+	repo := NewGormRepository(gdb)
+	func() {
+		mock.ExpectBegin()
+		mock.ExpectExec("^INSERT INTO `users` (.*) VALUES (.*)$").
+			WithArgs("1", "author1").
+			WillReturnResult(sqlmock.NewResult(1, 1))
+		mock.ExpectRollback()
+	}()
+	failed := errors.New("failed")
+	err = repo.Transaction(context.Background(), func(ctx context.Context, tx Repository) error {
+		if err := tx.Create(ctx, &User{ID: "1", Name: "author1"}); err != nil {
+			return err
+		}
+		return failed
+	})
+	assert.Equal(t, failed, err)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestGormRepository_NestedTransaction(t *testing.T) {
+	db, mock, err := sqlmock.New() // mock sql.DB
+	assert.Nil(t, err)
+	defer db.Close()
+	gdb, err := gorm.Open(dialector(db)) // open gorm db
+	assert.Nil(t, err)
+	repo := NewGormRepository(gdb)
+	func() {
+		mock.ExpectBegin()
+		mock.ExpectExec("^INSERT INTO `users` (.*) VALUES (.*)$").
+			WithArgs("1", "author1").
+			WillReturnResult(sqlmock.NewResult(1, 1))
+		mock.ExpectExec("^SAVEPOINT sp.*$").WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectExec("^INSERT INTO `books` (.*) VALUES (.*)$").
+			WithArgs("1", "book1", "1").
+			WillReturnError(errors.New("insert failed"))
+		mock.ExpectExec("^ROLLBACK TO SAVEPOINT sp.*$").WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectCommit()
+	}()
+	err = repo.Transaction(context.Background(), func(ctx context.Context, tx Repository) error {
+		if err := tx.Create(ctx, &User{ID: "1", Name: "author1"}); err != nil {
+			return err
+		}
+		err := tx.Transaction(ctx, func(ctx context.Context, tx Repository) error {
+			return tx.Create(ctx, &Book{ID: "1", Name: "book1", AuthorID: "1"})
+		})
+		assert.EqualError(t, err, "insert failed")
+		return nil
+	})
+	assert.Nil(t, err)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestGormRepository_TransactionRetryOnDeadlock(t *testing.T) {
+	db, mock, err := sqlmock.New() // mock sql.DB
+	assert.Nil(t, err)
+	defer db.Close()
+	gdb, err := gorm.Open(dialector(db)) // open gorm db
+	assert.Nil(t, err)
+	repo := NewGormRepository(gdb)
+	func() {
+		mock.ExpectBegin()
+		mock.ExpectExec("^INSERT INTO `users` (.*) VALUES (.*)$").
+			WithArgs("1", "author1").
+			WillReturnError(&mysql.MySQLError{Number: 1213, Message: "Deadlock found when trying to get lock"})
+		mock.ExpectRollback()
+		mock.ExpectBegin()
+		mock.ExpectExec("^INSERT INTO `users` (.*) VALUES (.*)$").
+			WithArgs("1", "author1").
+			WillReturnResult(sqlmock.NewResult(1, 1))
+		mock.ExpectCommit()
+	}()
+	tries := 0
+	err = repo.Transaction(context.Background(), func(ctx context.Context, tx Repository) error {
+		tries++
+		return tx.Create(ctx, &User{ID: "1", Name: "author1"})
+	}, RetryOnDeadlock(3), Isolation(sql.LevelSerializable))
+	assert.Nil(t, err)
+	assert.Equal(t, 2, tries)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestGormRepository_MatchOptions(t *testing.T) {
+	eq := func(field string, val interface{}) MatchOption {
+		return func(opts *MatchOptions) { opts.EQ(field, val) }
+	}
+	cases := []struct {
+		name  string
+		opts  []MatchOption
+		where string
+		args  []driver.Value
+	}{
+		{
+			name: "comparison",
+			opts: []MatchOption{func(opts *MatchOptions) {
+				opts.EQ("a", 1).NEQ("b", 2).LT("c", 3).LTE("d", 4).GT("e", 5).GTE("f", 6)
+			}},
+			where: "`a` = \\? AND `b` != \\? AND `c` < \\? AND `d` <= \\? AND `e` > \\? AND `f` >= \\?",
+			args:  []driver.Value{1, 2, 3, 4, 5, 6},
+		},
+		{
+			name:  "in",
+			opts:  []MatchOption{func(opts *MatchOptions) { opts.IN("a", []int{1, 2}) }},
+			where: "`a` IN \\(\\?,\\?\\)",
+			args:  []driver.Value{1, 2},
+		},
+		{
+			name:  "null",
+			opts:  []MatchOption{func(opts *MatchOptions) { opts.Null("a").NotNull("b") }},
+			where: "`a` IS NULL AND `b` IS NOT NULL",
+		},
+		{
+			name:  "field",
+			opts:  []MatchOption{eq("a", Field("b"))},
+			where: "`a` = `b`",
+		},
+		{
+			name:  "or",
+			opts:  []MatchOption{Or(eq("a", 1), eq("b", 2))},
+			where: "`a` = \\? OR `b` = \\?",
+			args:  []driver.Value{1, 2},
+		},
+		{
+			name:  "or and or",
+			opts:  []MatchOption{Or(eq("a", 1), eq("b", 2)), Or(eq("c", 3), eq("d", 4))},
+			where: "\\(`a` = \\? OR `b` = \\?\\) AND \\(`c` = \\? OR `d` = \\?\\)",
+			args:  []driver.Value{1, 2, 3, 4},
+		},
+		{
+			name:  "and or",
+			opts:  []MatchOption{eq("a", 1), Or(eq("b", 2), eq("c", 3))},
+			where: "`a` = \\? AND \\(`b` = \\? OR `c` = \\?\\)",
+			args:  []driver.Value{1, 2, 3},
+		},
+		{
+			name:  "or and",
+			opts:  []MatchOption{Or(And(eq("a", 1), eq("b", 2)), eq("c", 3))},
+			where: "\\(`a` = \\? AND `b` = \\?\\) OR `c` = \\?",
+			args:  []driver.Value{1, 2, 3},
+		},
+		{
+			name:  "deep",
+			opts:  []MatchOption{Or(eq("a", 1), And(eq("b", 2), Or(eq("c", 3), Not(eq("d", 4)))))},
+			where: "`a` = \\? OR \\(`b` = \\? AND \\(`c` = \\? OR NOT \\(`d` = \\?\\)\\)\\)",
+			args:  []driver.Value{1, 2, 3, 4},
+		},
+		{
+			name:  "not",
+			opts:  []MatchOption{Not(eq("a", 1), eq("b", 2))},
+			where: "NOT \\(`a` = \\? AND `b` = \\?\\)",
+			args:  []driver.Value{1, 2},
+		},
+		{
+			name:  "not or",
+			opts:  []MatchOption{Not(Or(eq("a", 1), eq("b", 2)))},
+			where: "NOT \\(\\(`a` = \\? OR `b` = \\?\\)\\)",
+			args:  []driver.Value{1, 2},
+		},
+		{
+			name:  "null in group",
+			opts:  []MatchOption{Or(func(opts *MatchOptions) { opts.NotNull("a") }, eq("b", 1))},
+			where: "`a` IS NOT NULL OR `b` = \\?",
+			args:  []driver.Value{1},
+		},
+		{
+			name:  "not in",
+			opts:  []MatchOption{func(opts *MatchOptions) { opts.NotIN("a", []string{"x", "y"}) }},
+			where: "`a` NOT IN \\(\\?,\\?\\)",
+			args:  []driver.Value{"x", "y"},
+		},
+		{
+			name:  "like",
+			opts:  []MatchOption{func(opts *MatchOptions) { opts.Like("a", "x%").ILike("b", "%Y") }},
+			where: "`a` LIKE \\? AND LOWER\\(`b`\\) LIKE LOWER\\(\\?\\)",
+			args:  []driver.Value{"x%", "%Y"},
+		},
+		{
+			name:  "like escaped",
+			opts:  []MatchOption{func(opts *MatchOptions) { opts.Contains("a", `50%_off\`).StartsWith("b", "x_").EndsWith("c", "%") }},
+			where: "`a` LIKE \\? AND `b` LIKE \\? AND `c` LIKE \\?",
+			args:  []driver.Value{`%50\%\_off\\%`, `x\_%`, `%\%`},
+		},
+		{
+			name:  "between",
+			opts:  []MatchOption{func(opts *MatchOptions) { opts.Between("a", 1, 10) }},
+			where: "`a` BETWEEN \\? AND \\?",
+			args:  []driver.Value{1, 10},
+		},
+		{
+			name: "exists",
+			opts: []MatchOption{func(opts *MatchOptions) {
+				opts.Exists(Raw("SELECT 1 FROM users WHERE users.id = books.author_id AND users.name = ?", "author1")).
+					NotExists(Raw("SELECT 1 FROM orders WHERE orders.book_id = books.id"))
+			}},
+			where: "\\(EXISTS \\(SELECT 1 FROM users WHERE users\\.id = books\\.author_id AND users\\.name = \\?\\)\\) AND NOT EXISTS \\(SELECT 1 FROM orders WHERE orders\\.book_id = books\\.id\\)",
+			args:  []driver.Value{"author1"},
+		},
+		{
+			name: "json",
+			opts: []MatchOption{func(opts *MatchOptions) {
+				opts.JSONContains("tags", []string{"go"}).JSONContains("attrs", "red", "$.colors").JSONPath("attrs", "$.size", GTE, 10)
+			}},
+			where: "JSON_CONTAINS\\(`tags`, \\?\\) AND JSON_CONTAINS\\(`attrs`, \\?, \\?\\) AND JSON_UNQUOTE\\(JSON_EXTRACT\\(`attrs`, \\?\\)\\) >= \\?",
+			args:  []driver.Value{`["go"]`, `"red"`, "$.colors", "$.size", 10},
+		},
+		{
+			name: "full text",
+			opts: []MatchOption{func(opts *MatchOptions) {
+				opts.Search("+go -java", BooleanMode, "name", "summary").Search("database", "", "name")
+			}},
+			where: "MATCH \\(`name`,`summary`\\) AGAINST \\(\\? IN BOOLEAN MODE\\) AND MATCH \\(`name`\\) AGAINST \\(\\?\\)",
+			args:  []driver.Value{"+go -java", "database"},
+		},
+		{
+			name:  "empty group",
+			opts:  []MatchOption{eq("a", 1), Or(), Not(And())},
+			where: "`a` = \\?",
+			args:  []driver.Value{1},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			db, mock, err := sqlmock.New() // mock sql.DB
+			assert.Nil(t, err)
+			defer db.Close()
+			gdb, err := gorm.Open(dialector(db)) // open gorm db
+			assert.Nil(t, err)
+			repo := NewGormRepository(gdb)
+			mock.ExpectQuery("^SELECT \\* FROM `books` WHERE " + c.where + "$").
+				WithArgs(c.args...).
+				WillReturnRows(sqlmock.NewRows([]string{"id", "name", "author_id"}))
+			var books []Book
+			assert.Nil(t, repo.Find(context.Background(), &books, c.opts...))
+			assert.Nil(t, mock.ExpectationsWereMet())
+		})
+	}
+}
+
+func TestGormRepository_JoinMatchOptions(t *testing.T) {
+	db, mock, err := sqlmock.New() // mock sql.DB
+	assert.Nil(t, err)
+	defer db.Close()
+	gdb, err := gorm.Open(dialector(db)) // open gorm db
+	assert.Nil(t, err)
+	repo := NewGormRepository(gdb)
+	func() {
+		execSql := "^SELECT books\\.id AS id,books\\.name AS name,users\\.id AS author_id,users\\.name AS author_name FROM `books` " +
+			"LEFT JOIN users ON `books`\\.`author_id` = `users`\\.`id` AND \\(`users`\\.`name` = \\? OR `users`\\.`name` IS NOT NULL\\) " +
+			"WHERE `books`\\.`name` = \\? OR `books`\\.`name` = \\?$"
+		mock.ExpectQuery(execSql).
+			WithArgs("author1", "book1", "book2").
+			WillReturnRows(sqlmock.NewRows([]string{"id", "name", "author_id", "author_name"}))
+	}()
+	var bookWithUser []BookWithUser
+	err = repo.Find(context.Background(),
+		M(&bookWithUser, &Book{}).With(&User{}, func(opts *MatchOptions) {
+			opts.EQ("books.author_id", Field("users.id"))
+		}, Or(func(opts *MatchOptions) { opts.EQ("users.name", "author1") }, func(opts *MatchOptions) { opts.NotNull("users.name") })),
+		Or(func(opts *MatchOptions) { opts.EQ("books.name", "book1") }, func(opts *MatchOptions) { opts.EQ("books.name", "book2") }),
+	)
+	assert.Nil(t, err)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestGormRepository_HavingMatchOptions(t *testing.T) {
+	db, mock, err := sqlmock.New() // mock sql.DB
+	assert.Nil(t, err)
+	defer db.Close()
+	gdb, err := gorm.Open(dialector(db)) // open gorm db
+	assert.Nil(t, err)
+	repo := NewGormRepository(gdb)
+	func() {
+		execSql := "^SELECT author_id AS author_id,count\\(id\\) AS books FROM `books` GROUP BY `author_id` HAVING \\(count\\(`id`\\) >= \\? OR count\\(`id`\\) = \\?\\)$"
+		mock.ExpectQuery(execSql).
+			WithArgs(10, 0).
+			WillReturnRows(sqlmock.NewRows([]string{"author_id", "books"}))
+	}()
+	var g []GroupTest
+	err = repo.Find(context.Background(),
+		M(&g, &Book{}).Group("author_id", Or(
+			func(opts *MatchOptions) { opts.GTE("count(id)", 10) },
+			func(opts *MatchOptions) { opts.EQ("count(id)", 0) },
+		)),
+	)
+	assert.Nil(t, err)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestGormRepository_InvalidIdentifier(t *testing.T) {
+	db, mock, err := sqlmock.New() // mock sql.DB
+	assert.Nil(t, err)
+	defer db.Close()
+	gdb, err := gorm.Open(dialector(db)) // open gorm db
+	assert.Nil(t, err)
+	repo := NewGormRepository(gdb)
+	var books []Book
+	cases := []MatchOption{
+		func(opts *MatchOptions) { opts.EQ("name = '' OR 1=1 --", "1") },
+		func(opts *MatchOptions) { opts.EQ("name", Field("(SELECT password FROM users)")) },
+		func(opts *MatchOptions) { opts.SetSort("name, (SELECT SLEEP(10))") },
+		Or(func(opts *MatchOptions) { opts.Null("name) OR (1") }),
+	}
+	for _, opt := range cases {
+		err = repo.Find(context.Background(), &books, opt)
+		assert.True(t, errors.Is(err, ErrInvalidIdentifier) || errors.Is(err, ErrInvalidSort), err)
+	}
+	err = repo.Find(context.Background(), M(&books).Group("author_id; DROP TABLE books"))
+	assert.True(t, errors.Is(err, ErrInvalidIdentifier))
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestGormRepository_Sort(t *testing.T) {
+	db, mock, err := sqlmock.New() // mock sql.DB
+	assert.Nil(t, err)
+	defer db.Close()
+	gdb, err := gorm.Open(dialector(db)) // open gorm db
+	assert.Nil(t, err)
+	repo := NewGormRepository(gdb)
+	func() {
+		execSql := "^SELECT \\* FROM `books` ORDER BY `books`\\.`name` DESC,`id`,`author_id` DESC$"
+		mock.ExpectQuery(execSql).
+			WillReturnRows(sqlmock.NewRows([]string{"id", "name", "author_id"}))
+	}()
+	var books []Book
+	err = repo.Find(context.Background(), &books, func(opts *MatchOptions) {
+		opts.SetSort(Field("books.name").DESC(), Field("id").ASC(), "-author_id")
+	})
+	assert.Nil(t, err)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestGormRepository_CreateInBatches(t *testing.T) {
+	db, mock, err := sqlmock.New() // mock sql.DB
+	assert.Nil(t, err)
+	defer db.Close()
+	gdb, err := gorm.Open(dialector(db)) // open gorm db
+	assert.Nil(t, err)
+	repo := NewGormRepository(gdb)
+	func() {
+		mock.ExpectBegin()
+		mock.ExpectExec("^INSERT INTO `users` \\(`id`,`name`\\) VALUES \\(\\?,\\?\\),\\(\\?,\\?\\)$").
+			WithArgs("1", "a", "2", "b").
+			WillReturnResult(sqlmock.NewResult(0, 2))
+		mock.ExpectExec("^INSERT INTO `users` \\(`id`,`name`\\) VALUES \\(\\?,\\?\\)$").
+			WithArgs("3", "c").
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectCommit()
+	}()
+	users := []User{{ID: "1", Name: "a"}, {ID: "2", Name: "b"}, {ID: "3", Name: "c"}}
+	err = repo.CreateInBatches(context.Background(), &users, 2)
+	assert.Nil(t, err)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestGormRepository_Upsert(t *testing.T) {
+	db, mock, err := sqlmock.New() // mock sql.DB
+	assert.Nil(t, err)
+	defer db.Close()
+	gdb, err := gorm.Open(dialector(db)) // open gorm db
+	assert.Nil(t, err)
+	repo := NewGormRepository(gdb)
+	func() {
+		mock.ExpectBegin()
+		mock.ExpectExec("^INSERT INTO `users` \\(`id`,`name`\\) VALUES \\(\\?,\\?\\),\\(\\?,\\?\\) ON DUPLICATE KEY UPDATE `name`=VALUES\\(`name`\\)$").
+			WithArgs("1", "a", "2", "b").
+			WillReturnResult(sqlmock.NewResult(0, 2))
+		mock.ExpectCommit()
+	}()
+	users := []User{{ID: "1", Name: "a"}, {ID: "2", Name: "b"}}
+	err = repo.Upsert(context.Background(), &users, []string{"id"}, "name")
+	assert.Nil(t, err)
+
+	err = repo.Upsert(context.Background(), &users, []string{"id"}, "name = 1")
+	assert.ErrorIs(t, err, ErrInvalidIdentifier)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestGormRepository_BulkUpdateFields(t *testing.T) {
+	db, mock, err := sqlmock.New() // mock sql.DB
+	assert.Nil(t, err)
+	defer db.Close()
+	gdb, err := gorm.Open(dialector(db)) // open gorm db
+	assert.Nil(t, err)
+	repo := NewGormRepository(gdb, BatchSize(2))
+	func() {
+		execSql := "^UPDATE `books` SET " +
+			"`author_id`=CASE `id` WHEN \\? THEN \\? ELSE `author_id` END," +
+			"`name`=CASE `id` WHEN \\? THEN \\? WHEN \\? THEN \\? ELSE `name` END " +
+			"WHERE `id` IN \\(\\?,\\?\\)$"
+		mock.ExpectBegin()
+		mock.ExpectExec(execSql).
+			WithArgs("2", "9", "1", "a", "2", "b", "1", "2").
+			WillReturnResult(sqlmock.NewResult(0, 2))
+		mock.ExpectExec("^UPDATE `books` SET `name`=CASE `id` WHEN \\? THEN \\? ELSE `name` END WHERE `id` IN \\(\\?\\)$").
+			WithArgs("3", "c", "3").
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectCommit()
+	}()
+	err = repo.BulkUpdateFields(context.Background(), &Book{}, map[interface{}]Fields{
+		"1": {"name": "a"},
+		"2": {"name": "b", "author_id": "9"},
+		"3": {"name": "c"},
+	})
+	assert.Nil(t, err)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
@@ -0,0 +1,69 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+var (
+	ErrInvalidIdentifier = errors.New("invalid identifier")
+	ErrInvalidSort       = errors.New("invalid sort")
+)
+
+var (
+	identifierRegexp = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*(\.[A-Za-z_][A-Za-z0-9_]*){0,2}$`)
+	aggregateRegexp  = regexp.MustCompile(`^(?i)(count|sum|avg|min|max)\(\s*(distinct\s+)?([^()]+?)\s*\)$`)
+	identQuoter      = strings.NewReplacer("`", "", `"`, "")
+)
+
+// DESC the sort spec of f in descending order
+func (f Field) DESC() string {
+	return string(f) + " DESC"
+}
+
+// ASC the sort spec of f in ascending order
+func (f Field) ASC() string {
+	return string(f) + " ASC"
+}
+
+// Identifier the unquoted column name of name if name is a valid column, e.g. `users`.`id`, users.id or id
+func Identifier(name string) (string, error) {
+	ident := identQuoter.Replace(strings.TrimSpace(name))
+	if !identifierRegexp.MatchString(ident) {
+		return "", fmt.Errorf("%w: %q", ErrInvalidIdentifier, name)
+	}
+	return ident, nil
+}
+
+// Aggregate split the aggregate of a column like count(id) or sum(distinct amount) into
+// the function, the distinct flag and the column. ok is false if name is not an aggregate
+func Aggregate(name string) (fn string, distinct bool, column string, ok bool) {
+	m := aggregateRegexp.FindStringSubmatch(strings.TrimSpace(name))
+	if m == nil {
+		return "", false, "", false
+	}
+	return m[1], m[2] != "", m[3], true
+}
+
+// ParseSort parse the sort spec, which is `column`, `column ASC`, `column DESC` or `-column` for descending
+func ParseSort(spec string) (column string, desc bool, err error) {
+	spec = strings.TrimSpace(spec)
+	if strings.HasPrefix(spec, "-") {
+		desc = true
+		spec = spec[1:]
+	}
+	parts := strings.Fields(spec)
+	switch {
+	case len(parts) == 2 && !desc && strings.EqualFold(parts[1], "DESC"):
+		desc = true
+	case len(parts) == 2 && !desc && strings.EqualFold(parts[1], "ASC"):
+	case len(parts) != 1:
+		return "", false, fmt.Errorf("%w: %q", ErrInvalidSort, spec)
+	}
+	if column, err = Identifier(parts[0]); err != nil {
+		return "", false, err
+	}
+	return column, desc, nil
+}
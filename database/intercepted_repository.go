@@ -0,0 +1,211 @@
+package database
+
+import (
+	"context"
+	"time"
+)
+
+// the operations of Repository, the Op of a Call
+const (
+	OpFirst            = "first"
+	OpFind             = "find"
+	OpCount            = "count"
+	OpPaginate         = "paginate"
+	OpUpdate           = "update"
+	OpDelete           = "delete"
+	OpRestore          = "restore"
+	OpForceDelete      = "force delete"
+	OpCreate           = "create"
+	OpUpdateFields     = "update fields"
+	OpCreateInBatches  = "create in batches"
+	OpUpsert           = "upsert"
+	OpBulkUpdateFields = "bulk update fields"
+	OpRows             = "rows"
+	OpEach             = "each"
+	OpTransaction      = "transaction"
+)
+
+// Call a Repository operation passing an interceptor
+type Call struct {
+	// Op the operation, one of the Op constants
+	Op string
+	// Model the v of the operation, nil for Transaction
+	Model interface{}
+	// Opts the match options of the operation. an interceptor may change them before calling next,
+	// like scoping the operation to a tenant
+	Opts []MatchOption
+	// Duration how long the operation took, set once next returns. for Rows it's the time to open the rows
+	Duration time.Duration
+	// Err the error of the operation, set once next returns
+	Err error
+}
+
+// Options the match options of the call applied
+func (call *Call) Options() MatchOptions {
+	opts := MatchOptions{}
+	return opts.Apply(call.Opts...)
+}
+
+// Interceptor run around a Repository operation, next runs the interceptors after it and then the
+// operation. the operation is not run if next is not called
+//   logging := func(ctx context.Context, call *Call, next func(ctx context.Context) error) error {
+//       err := next(ctx)
+//       log.Printf("%s %T took %s: %v", call.Op, call.Model, call.Duration, err)
+//       return err
+//   }
+type Interceptor func(ctx context.Context, call *Call, next func(ctx context.Context) error) error
+
+// Hook an Interceptor calling before ahead of the operation and after behind it, either may be nil.
+// the ctx returned by before is passed down, and the operation is not run if before returns an error
+//   metrics := Hook(nil, func(ctx context.Context, call *Call) {
+//       histogram.WithLabelValues(call.Op).Observe(call.Duration.Seconds())
+//   })
+func Hook(before func(ctx context.Context, call *Call) (context.Context, error), after func(ctx context.Context, call *Call)) Interceptor {
+	return func(ctx context.Context, call *Call, next func(ctx context.Context) error) error {
+		if before != nil {
+			var err error
+			if ctx, err = before(ctx, call); err != nil {
+				return err
+			}
+		}
+		err := next(ctx)
+		if after != nil {
+			after(ctx, call)
+		}
+		return err
+	}
+}
+
+type interceptedRepository struct {
+	Repository
+	interceptors []Interceptor
+}
+
+// Intercept run every operation of repo through the interceptors, the first interceptor is the
+// outermost. the repo passed to the do of Transaction is intercepted as well
+// usage:
+//   repo := Intercept(NewGormRepository(db), tracing, Hook(nil, metrics), logging)
+func Intercept(repo Repository, interceptors ...Interceptor) Repository {
+	return &interceptedRepository{Repository: repo, interceptors: interceptors}
+}
+
+// call run do through the interceptors, do gets the match options which the interceptors may have changed
+func (r *interceptedRepository) call(ctx context.Context, op string, v interface{}, opts []MatchOption, do func(ctx context.Context, opts []MatchOption) error) error {
+	call := &Call{Op: op, Model: v, Opts: opts}
+	var chain func(i int) func(ctx context.Context) error
+	chain = func(i int) func(ctx context.Context) error {
+		if i < len(r.interceptors) {
+			return func(ctx context.Context) error {
+				return r.interceptors[i](ctx, call, chain(i+1))
+			}
+		}
+		return func(ctx context.Context) error {
+			start := time.Now()
+			call.Err = do(ctx, call.Opts)
+			call.Duration = time.Since(start)
+			return call.Err
+		}
+	}
+	return chain(0)(ctx)
+}
+
+func (r *interceptedRepository) First(ctx context.Context, v interface{}, opts ...MatchOption) error {
+	return r.call(ctx, OpFirst, v, opts, func(ctx context.Context, opts []MatchOption) error {
+		return r.Repository.First(ctx, v, opts...)
+	})
+}
+
+func (r *interceptedRepository) Find(ctx context.Context, v interface{}, opts ...MatchOption) error {
+	return r.call(ctx, OpFind, v, opts, func(ctx context.Context, opts []MatchOption) error {
+		return r.Repository.Find(ctx, v, opts...)
+	})
+}
+
+func (r *interceptedRepository) Count(ctx context.Context, v interface{}, count *int64, opts ...MatchOption) error {
+	return r.call(ctx, OpCount, v, opts, func(ctx context.Context, opts []MatchOption) error {
+		return r.Repository.Count(ctx, v, count, opts...)
+	})
+}
+
+func (r *interceptedRepository) Paginate(ctx context.Context, v interface{}, page *Page, opts ...MatchOption) error {
+	return r.call(ctx, OpPaginate, v, opts, func(ctx context.Context, opts []MatchOption) error {
+		return r.Repository.Paginate(ctx, v, page, opts...)
+	})
+}
+
+func (r *interceptedRepository) Update(ctx context.Context, v interface{}) error {
+	return r.call(ctx, OpUpdate, v, nil, func(ctx context.Context, _ []MatchOption) error {
+		return r.Repository.Update(ctx, v)
+	})
+}
+
+func (r *interceptedRepository) Delete(ctx context.Context, v interface{}, opts ...MatchOption) error {
+	return r.call(ctx, OpDelete, v, opts, func(ctx context.Context, opts []MatchOption) error {
+		return r.Repository.Delete(ctx, v, opts...)
+	})
+}
+
+func (r *interceptedRepository) Restore(ctx context.Context, v interface{}, opts ...MatchOption) error {
+	return r.call(ctx, OpRestore, v, opts, func(ctx context.Context, opts []MatchOption) error {
+		return r.Repository.Restore(ctx, v, opts...)
+	})
+}
+
+func (r *interceptedRepository) ForceDelete(ctx context.Context, v interface{}, opts ...MatchOption) error {
+	return r.call(ctx, OpForceDelete, v, opts, func(ctx context.Context, opts []MatchOption) error {
+		return r.Repository.ForceDelete(ctx, v, opts...)
+	})
+}
+
+func (r *interceptedRepository) Create(ctx context.Context, v interface{}) error {
+	return r.call(ctx, OpCreate, v, nil, func(ctx context.Context, _ []MatchOption) error {
+		return r.Repository.Create(ctx, v)
+	})
+}
+
+func (r *interceptedRepository) UpdateFields(ctx context.Context, v interface{}, fields Fields, opts ...MatchOption) error {
+	return r.call(ctx, OpUpdateFields, v, opts, func(ctx context.Context, opts []MatchOption) error {
+		return r.Repository.UpdateFields(ctx, v, fields, opts...)
+	})
+}
+
+func (r *interceptedRepository) CreateInBatches(ctx context.Context, v interface{}, batchSize int) error {
+	return r.call(ctx, OpCreateInBatches, v, nil, func(ctx context.Context, _ []MatchOption) error {
+		return r.Repository.CreateInBatches(ctx, v, batchSize)
+	})
+}
+
+func (r *interceptedRepository) Upsert(ctx context.Context, v interface{}, conflict []string, update ...string) error {
+	return r.call(ctx, OpUpsert, v, nil, func(ctx context.Context, _ []MatchOption) error {
+		return r.Repository.Upsert(ctx, v, conflict, update...)
+	})
+}
+
+func (r *interceptedRepository) BulkUpdateFields(ctx context.Context, v interface{}, rows map[interface{}]Fields) error {
+	return r.call(ctx, OpBulkUpdateFields, v, nil, func(ctx context.Context, _ []MatchOption) error {
+		return r.Repository.BulkUpdateFields(ctx, v, rows)
+	})
+}
+
+func (r *interceptedRepository) Rows(ctx context.Context, v interface{}, opts ...MatchOption) (Rows, error) {
+	var rows Rows
+	err := r.call(ctx, OpRows, v, opts, func(ctx context.Context, opts []MatchOption) (err error) {
+		rows, err = r.Repository.Rows(ctx, v, opts...)
+		return err
+	})
+	return rows, err
+}
+
+func (r *interceptedRepository) Each(ctx context.Context, v interface{}, size int, do func(ctx context.Context) error, opts ...MatchOption) error {
+	return r.call(ctx, OpEach, v, opts, func(ctx context.Context, opts []MatchOption) error {
+		return r.Repository.Each(ctx, v, size, do, opts...)
+	})
+}
+
+func (r *interceptedRepository) Transaction(ctx context.Context, do func(ctx context.Context, repo Repository) error, opts ...TxOption) error {
+	return r.call(ctx, OpTransaction, nil, nil, func(ctx context.Context, _ []MatchOption) error {
+		return r.Repository.Transaction(ctx, func(ctx context.Context, repo Repository) error {
+			return do(ctx, &interceptedRepository{Repository: repo, interceptors: r.interceptors})
+		}, opts...)
+	})
+}
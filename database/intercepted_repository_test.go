@@ -0,0 +1,85 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIntercept(t *testing.T) {
+	db, mock, gdb := mockDB(t)
+	defer db.Close()
+	calls := []string{}
+	var last *Call
+	outer := func(ctx context.Context, call *Call, next func(ctx context.Context) error) error {
+		calls = append(calls, "outer "+call.Op)
+		err := next(ctx)
+		calls = append(calls, "outer done")
+		return err
+	}
+	scope := Hook(func(ctx context.Context, call *Call) (context.Context, error) {
+		calls = append(calls, "scope "+call.Op)
+		call.Opts = append(call.Opts, func(opts *MatchOptions) { opts.EQ("name", "a") })
+		return ctx, nil
+	}, func(ctx context.Context, call *Call) {
+		last = call
+	})
+	repo := Intercept(NewGormRepository(gdb), outer, scope)
+	mock.ExpectQuery("^SELECT \\* FROM `users` WHERE `id` = \\? AND `name` = \\?$").
+		WithArgs("1", "a").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name"}).AddRow("1", "a"))
+	var users []User
+	err := repo.Find(context.Background(), &users, func(opts *MatchOptions) { opts.EQ("id", "1") })
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"outer find", "scope find", "outer done"}, calls)
+	assert.Equal(t, OpFind, last.Op)
+	assert.Equal(t, &users, last.Model)
+	assert.Len(t, last.Options().Matches, 2)
+	assert.True(t, last.Duration > 0)
+	assert.Nil(t, last.Err)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestIntercept_Refuse(t *testing.T) {
+	db, mock, gdb := mockDB(t)
+	defer db.Close()
+	refused := errors.New("refused")
+	repo := Intercept(NewGormRepository(gdb), Hook(func(ctx context.Context, call *Call) (context.Context, error) {
+		if call.Op == OpDelete {
+			return ctx, refused
+		}
+		return ctx, nil
+	}, nil))
+	err := repo.Delete(context.Background(), &User{}, func(opts *MatchOptions) { opts.EQ("id", "1") })
+	assert.Equal(t, refused, err)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestIntercept_Transaction(t *testing.T) {
+	db, mock, gdb := mockDB(t)
+	defer db.Close()
+	ops := []string{}
+	repo := Intercept(NewGormRepository(gdb), Hook(nil, func(ctx context.Context, call *Call) {
+		ops = append(ops, call.Op)
+	}))
+	mock.ExpectBegin()
+	mock.ExpectExec("^INSERT INTO `users`").
+		WithArgs("1", "a").
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec("^UPDATE `users` SET `name`=\\? WHERE `id` = \\?$").
+		WithArgs("b", "1").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	err := repo.Transaction(context.Background(), func(ctx context.Context, repo Repository) error {
+		if err := repo.Create(ctx, &User{ID: "1", Name: "a"}); err != nil {
+			return err
+		}
+		return repo.UpdateFields(ctx, &User{}, Fields{"name": "b"}, func(opts *MatchOptions) { opts.EQ("id", "1") })
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{OpCreate, OpUpdateFields, OpTransaction}, ops)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
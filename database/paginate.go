@@ -0,0 +1,190 @@
+package database
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+var (
+	ErrInvalidCursor = errors.New("invalid cursor")
+	ErrSortRequired  = errors.New("sort required")
+	DefaultPageSize  = 20
+)
+
+// Page the page fetched by Paginate
+type Page struct {
+	// Total the total of the records following the match condition, only counted when CountTotal is given
+	Total *int64 `json:"total,omitempty"`
+	// HasNext whether there are records after the page
+	HasNext bool `json:"has_next"`
+	// Next the cursor of the next page, pass it to After to fetch the next page
+	Next string `json:"next,omitempty"`
+}
+
+// cursor the sort columns and the values of them of the last record of the page
+type cursor struct {
+	Sort   []string          `json:"s"`
+	Values []json.RawMessage `json:"v"`
+}
+
+// After fetch the records after the cursor returned by Paginate
+func (opts *MatchOptions) After(cursor string) *MatchOptions {
+	opts.Cursor = cursor
+	return opts
+}
+
+// CountTotal count the total of the records following the match condition when Paginate
+func (opts *MatchOptions) CountTotal() *MatchOptions {
+	opts.Total = true
+	return opts
+}
+
+// paginate fetch a page of the records into v following the keyset of the sort columns of opts. the primary key
+// is appended to the sort columns so that the keyset is unique. Find and Count of repo are used to fetch, so any
+// repository can paginate with it
+func paginate(ctx context.Context, repo Repository, v interface{}, page *Page, opts ...MatchOption) error {
+	opt := &MatchOptions{}
+	opt.Apply(opts...)
+	result, from := v, v
+	if m, ok := v.(*Model); ok {
+		result, from = m.Result, m.From
+	}
+	rv := reflect.ValueOf(result)
+	if rv.Kind() != reflect.Ptr || rv.Elem().Kind() != reflect.Slice {
+		return fmt.Errorf("paginate: result must be a pointer of slice, but %T given", result)
+	}
+	*page = Page{}
+	if opt.Total {
+		countOpts := MatchOptions{Matches: opt.Matches, Timeout: opt.Timeout}
+		var total int64
+		if err := repo.Count(ctx, v, &total, countOpts.Option()); err != nil {
+			return err
+		}
+		page.Total = &total
+	}
+	sort, err := keysetSort(opt.Sort, from)
+	if err != nil {
+		return err
+	}
+	if opt.Cursor != "" {
+		keyset, err := decodeCursor(opt.Cursor, sort, indirectType(rv.Type()))
+		if err != nil {
+			return err
+		}
+		opt.Matches = append(opt.Matches, keyset)
+	}
+	limit := DefaultPageSize
+	if opt.Limit != nil {
+		limit = *opt.Limit
+	}
+	opt.SetSort(sort...).SetLimit(limit + 1)
+	if err := repo.Find(ctx, v, func(o *MatchOptions) { *o = *opt }); err != nil {
+		return err
+	}
+	items := rv.Elem()
+	if items.Len() <= limit {
+		return nil
+	}
+	items.Set(items.Slice(0, limit))
+	page.HasNext = true
+	page.Next, err = encodeCursor(sort, items.Index(limit-1))
+	return err
+}
+
+// keysetSort the sort specs with the primary key of model appended if it's not sorted by
+func keysetSort(sort []string, model interface{}) ([]string, error) {
+	ret := make([]string, 0, len(sort)+1)
+	pk, hasPK := primaryKeyColumn(reflect.TypeOf(model))
+	sortedByPK := false
+	for _, spec := range sort {
+		column, desc, err := ParseSort(spec)
+		if err != nil {
+			return nil, err
+		}
+		if hasPK && lastSegment(column) == pk {
+			sortedByPK = true
+		}
+		if desc {
+			ret = append(ret, Field(column).DESC())
+			continue
+		}
+		ret = append(ret, Field(column).ASC())
+	}
+	if hasPK && !sortedByPK {
+		ret = append(ret, Field(pk).ASC())
+	}
+	if len(ret) == 0 {
+		return nil, ErrSortRequired
+	}
+	return ret, nil
+}
+
+func encodeCursor(sort []string, last reflect.Value) (string, error) {
+	c := cursor{Sort: sort, Values: make([]json.RawMessage, len(sort))}
+	for i, spec := range sort {
+		column, _, _ := ParseSort(spec)
+		field, ok := fieldByColumn(last, column)
+		if !ok {
+			return "", fmt.Errorf("paginate: no field of the sort column %s", column)
+		}
+		bs, err := json.Marshal(field.Interface())
+		if err != nil {
+			return "", err
+		}
+		c.Values[i] = bs
+	}
+	bs, err := json.Marshal(c)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(bs), nil
+}
+
+// decodeCursor decode the cursor into the keyset condition, which matches the records after the cursor:
+// (c1 > v1) OR (c1 = v1 AND c2 > v2) OR ... with < for the descending columns
+func decodeCursor(token string, sort []string, elem reflect.Type) (MatchItem, error) {
+	bs, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return MatchItem{}, ErrInvalidCursor
+	}
+	c := cursor{}
+	if err := json.Unmarshal(bs, &c); err != nil || strings.Join(c.Sort, ",") != strings.Join(sort, ",") || len(c.Values) != len(sort) {
+		return MatchItem{}, ErrInvalidCursor
+	}
+	sample := reflect.New(elem)
+	keyset := MatchOptions{}
+	for i := range sort {
+		branch := MatchOptions{}
+		for j := 0; j <= i; j++ {
+			column, desc, _ := ParseSort(sort[j])
+			field, ok := fieldByColumn(sample, column)
+			if !ok {
+				return MatchItem{}, fmt.Errorf("paginate: no field of the sort column %s", column)
+			}
+			val := reflect.New(field.Type())
+			if err := json.Unmarshal(c.Values[j], val.Interface()); err != nil {
+				return MatchItem{}, ErrInvalidCursor
+			}
+			switch {
+			case j < i:
+				branch.EQ(column, val.Elem().Interface())
+			case desc:
+				branch.LT(column, val.Elem().Interface())
+			default:
+				branch.GT(column, val.Elem().Interface())
+			}
+		}
+		keyset.AND(branch)
+	}
+	return MatchItem{Operator: OR, Value: keyset}, nil
+}
+
+func lastSegment(column string) string {
+	parts := strings.Split(column, ".")
+	return parts[len(parts)-1]
+}
@@ -0,0 +1,74 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+	"gorm.io/gorm"
+)
+
+func TestGormRepository_Paginate(t *testing.T) {
+	db, mock, err := sqlmock.New() // mock sql.DB
+	assert.Nil(t, err)
+	defer db.Close()
+	gdb, err := gorm.Open(dialector(db)) // open gorm db
+	assert.Nil(t, err)
+	repo := NewGormRepository(gdb)
+	func() {
+		mock.ExpectQuery("^SELECT count\\(\\*\\) FROM `books` WHERE `author_id` = \\?$").
+			WithArgs("1").
+			WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(3))
+		mock.ExpectQuery("^SELECT \\* FROM `books` WHERE `author_id` = \\? ORDER BY `name` DESC,`id` LIMIT 3$").
+			WithArgs("1").
+			WillReturnRows(sqlmock.NewRows([]string{"id", "name", "author_id"}).
+				AddRow("3", "book3", "1").
+				AddRow("1", "book2", "1").
+				AddRow("2", "book2", "1"))
+		mock.ExpectQuery("^SELECT \\* FROM `books` WHERE `author_id` = \\? AND \\(\\(`name` < \\?\\) OR \\(`name` = \\? AND `id` > \\?\\)\\) ORDER BY `name` DESC,`id` LIMIT 3$").
+			WithArgs("1", "book2", "book2", "1").
+			WillReturnRows(sqlmock.NewRows([]string{"id", "name", "author_id"}).
+				AddRow("2", "book2", "1"))
+	}()
+	byAuthor := func(opts *MatchOptions) {
+		opts.EQ("author_id", "1").SetSort(Field("name").DESC()).SetLimit(2)
+	}
+	var books []Book
+	var page Page
+	err = repo.Paginate(context.Background(), &books, &page, byAuthor, func(opts *MatchOptions) { opts.CountTotal() })
+	assert.Nil(t, err)
+	assert.Equal(t, []Book{{ID: "3", Name: "book3", AuthorID: "1"}, {ID: "1", Name: "book2", AuthorID: "1"}}, books)
+	assert.Equal(t, int64(3), *page.Total)
+	assert.True(t, page.HasNext)
+	assert.NotEmpty(t, page.Next)
+
+	books = nil
+	err = repo.Paginate(context.Background(), &books, &page, byAuthor, func(opts *MatchOptions) { opts.After(page.Next) })
+	assert.Nil(t, err)
+	assert.Equal(t, []Book{{ID: "2", Name: "book2", AuthorID: "1"}}, books)
+	assert.Equal(t, Page{}, page)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestGormRepository_PaginateInvalidCursor(t *testing.T) {
+	db, mock, err := sqlmock.New() // mock sql.DB
+	assert.Nil(t, err)
+	defer db.Close()
+	gdb, err := gorm.Open(dialector(db)) // open gorm db
+	assert.Nil(t, err)
+	repo := NewGormRepository(gdb)
+	next, err := encodeCursor([]string{"name ASC", "id ASC"}, reflect.ValueOf(&Book{ID: "1", Name: "book1"}))
+	assert.Nil(t, err)
+	var books []Book
+	var page Page
+	for _, cursor := range []string{"not a cursor", next} {
+		err = repo.Paginate(context.Background(), &books, &page, func(opts *MatchOptions) {
+			opts.SetSort(Field("name").DESC()).After(cursor)
+		})
+		assert.True(t, errors.Is(err, ErrInvalidCursor))
+	}
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
@@ -0,0 +1,88 @@
+package database
+
+import (
+	"context"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+)
+
+type Author struct {
+	ID      string
+	Name    string
+	Profile *Profile
+	Novels  []Novel
+}
+
+type Profile struct {
+	ID       string
+	AuthorID string
+	Bio      string
+}
+
+type Novel struct {
+	ID       string
+	Title    string
+	AuthorID string
+	Author   *Author
+}
+
+func TestGormRepository_PreloadBelongsTo(t *testing.T) {
+	db, mock, gdb := mockDB(t)
+	defer db.Close()
+	repo := NewGormRepository(gdb)
+	func() {
+		mock.ExpectQuery("^SELECT \\* FROM `novels` LIMIT 2$").
+			WillReturnRows(sqlmock.NewRows([]string{"id", "title", "author_id"}).
+				AddRow("1", "novel1", "1").
+				AddRow("2", "novel2", "1"))
+		mock.ExpectQuery("^SELECT \\* FROM `authors` WHERE `authors`\\.`id` = \\?$").
+			WithArgs("1").
+			WillReturnRows(sqlmock.NewRows([]string{"id", "name"}).AddRow("1", "author1"))
+	}()
+	var novels []Novel
+	err := repo.Find(context.Background(), M(&novels).Preload("Author"), func(opts *MatchOptions) { opts.SetLimit(2) })
+	assert.Nil(t, err)
+	author := &Author{ID: "1", Name: "author1"}
+	assert.Equal(t, []Novel{
+		{ID: "1", Title: "novel1", AuthorID: "1", Author: author},
+		{ID: "2", Title: "novel2", AuthorID: "1", Author: author},
+	}, novels)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestGormRepository_PreloadHasOneAndHasMany(t *testing.T) {
+	db, mock, gdb := mockDB(t)
+	defer db.Close()
+	repo := NewGormRepository(gdb)
+	func() {
+		mock.ExpectQuery("^SELECT \\* FROM `authors` WHERE `id` IN \\(\\?,\\?\\)$").
+			WithArgs("1", "2").
+			WillReturnRows(sqlmock.NewRows([]string{"id", "name"}).
+				AddRow("1", "author1").
+				AddRow("2", "author2"))
+		mock.ExpectQuery("^SELECT \\* FROM `novels` WHERE `title` LIKE \\? AND `novels`\\.`author_id` IN \\(\\?,\\?\\) ORDER BY `title` DESC$").
+			WithArgs("novel%", "1", "2").
+			WillReturnRows(sqlmock.NewRows([]string{"id", "title", "author_id"}).
+				AddRow("2", "novel2", "1").
+				AddRow("1", "novel1", "1"))
+		mock.ExpectQuery("^SELECT \\* FROM `profiles` WHERE `profiles`\\.`author_id` IN \\(\\?,\\?\\)$").
+			WithArgs("1", "2").
+			WillReturnRows(sqlmock.NewRows([]string{"id", "author_id", "bio"}).AddRow("1", "2", "bio2"))
+	}()
+	var authors []Author
+	m := M(&authors).
+		Preload("Novels", func(opts *MatchOptions) { opts.StartsWith("title", "novel").SetSort("-title") }).
+		Preload("Profile")
+	err := repo.Find(context.Background(), m, func(opts *MatchOptions) { opts.IN("id", []string{"1", "2"}) })
+	assert.Nil(t, err)
+	assert.Equal(t, []Author{
+		{ID: "1", Name: "author1", Novels: []Novel{
+			{ID: "2", Title: "novel2", AuthorID: "1"},
+			{ID: "1", Title: "novel1", AuthorID: "1"},
+		}},
+		{ID: "2", Name: "author2", Profile: &Profile{ID: "1", AuthorID: "2", Bio: "bio2"}, Novels: []Novel{}},
+	}, authors)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
@@ -0,0 +1,163 @@
+package database
+
+import (
+	"reflect"
+	"strings"
+
+	"github.com/yang-zzhong/xl/utils"
+	"gorm.io/gorm"
+	"gorm.io/gorm/schema"
+)
+
+// indirectType the struct type behind pointers, slices and arrays
+func indirectType(t reflect.Type) reflect.Type {
+	for t.Kind() == reflect.Ptr || t.Kind() == reflect.Slice || t.Kind() == reflect.Array {
+		t = t.Elem()
+	}
+	return t
+}
+
+// modelTable the table of the struct type t by the default naming of gorm, unless t has TableName
+func modelTable(t reflect.Type) string {
+	if tn, ok := reflect.New(t).Interface().(tableNamer); ok {
+		return tn.TableName()
+	}
+	return schema.NamingStrategy{}.TableName(t.Name())
+}
+
+// columnName the column of the struct field, which is the column setting of the gorm tag or the snake case of its name
+func columnName(f reflect.StructField) string {
+	for _, setting := range strings.Split(f.Tag.Get("gorm"), ";") {
+		kv := strings.SplitN(setting, ":", 2)
+		if len(kv) == 2 && strings.EqualFold(strings.TrimSpace(kv[0]), "column") {
+			return strings.TrimSpace(kv[1])
+		}
+	}
+	return utils.ToSnakeCase(f.Name)
+}
+
+// primaryKeyColumn the column of the field tagged primarykey, or of the field ID if no field is tagged
+func primaryKeyColumn(t reflect.Type) (string, bool) {
+	t = indirectType(t)
+	if t.Kind() != reflect.Struct {
+		return "", false
+	}
+	fallback := ""
+	var walk func(t reflect.Type) string
+	walk = func(t reflect.Type) string {
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if f.Anonymous && indirectType(f.Type).Kind() == reflect.Struct {
+				if column := walk(indirectType(f.Type)); column != "" {
+					return column
+				}
+				continue
+			}
+			tag := strings.ToLower(strings.ReplaceAll(f.Tag.Get("gorm"), "_", ""))
+			if strings.Contains(tag, "primarykey") {
+				return columnName(f)
+			}
+			if f.Name == "ID" && fallback == "" {
+				fallback = columnName(f)
+			}
+		}
+		return ""
+	}
+	if column := walk(t); column != "" {
+		return column, true
+	}
+	return fallback, fallback != ""
+}
+
+// fieldByColumn the field of the struct v which is mapped to column, column may be qualified by the table.
+// false if v is nil or not a struct
+func fieldByColumn(v reflect.Value, column string) (reflect.Value, bool) {
+	for v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			return reflect.Value{}, false
+		}
+		v = v.Elem()
+	}
+	if v.Kind() != reflect.Struct {
+		return reflect.Value{}, false
+	}
+	parts := strings.Split(column, ".")
+	column = parts[len(parts)-1]
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.Anonymous && indirectType(f.Type).Kind() == reflect.Struct {
+			if v.Field(i).Kind() == reflect.Ptr && v.Field(i).IsNil() {
+				continue
+			}
+			if fv, ok := fieldByColumn(v.Field(i), column); ok {
+				return fv, true
+			}
+			continue
+		}
+		if f.IsExported() && columnName(f) == column {
+			return v.Field(i), true
+		}
+	}
+	return reflect.Value{}, false
+}
+
+// versionField the field tagged lock:"version" of the struct v and its column, the field must be an integer
+func versionField(v reflect.Value) (reflect.Value, string, bool) {
+	for v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			return reflect.Value{}, "", false
+		}
+		v = v.Elem()
+	}
+	if v.Kind() != reflect.Struct {
+		return reflect.Value{}, "", false
+	}
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.Anonymous && indirectType(f.Type).Kind() == reflect.Struct {
+			if fv, column, ok := versionField(v.Field(i)); ok {
+				return fv, column, true
+			}
+			continue
+		}
+		if f.Tag.Get("lock") != "version" {
+			continue
+		}
+		switch f.Type.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+			reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			return v.Field(i), columnName(f), true
+		}
+	}
+	return reflect.Value{}, "", false
+}
+
+var deletedAtType = reflect.TypeOf(gorm.DeletedAt{})
+
+// deletedAtColumn the column of the gorm.DeletedAt field of the model v, false if v is not soft deleted
+func deletedAtColumn(v interface{}) (string, bool) {
+	if v == nil {
+		return "", false
+	}
+	var walk func(t reflect.Type) (string, bool)
+	walk = func(t reflect.Type) (string, bool) {
+		if t.Kind() != reflect.Struct {
+			return "", false
+		}
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if f.Type == deletedAtType {
+				return columnName(f), true
+			}
+			if f.Anonymous {
+				if column, ok := walk(indirectType(f.Type)); ok {
+					return column, true
+				}
+			}
+		}
+		return "", false
+	}
+	return walk(indirectType(reflect.TypeOf(v)))
+}
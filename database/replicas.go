@@ -0,0 +1,115 @@
+package database
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"gorm.io/gorm"
+)
+
+// DefaultEjectFor how long a replica is ejected after its connection fails if EjectReplicaFor is not given
+const DefaultEjectFor = 30 * time.Second
+
+// replica a read only db, it's ejected from routing for a while once its connection fails
+type replica struct {
+	db           *gorm.DB
+	ejectedUntil int64
+}
+
+func (r *replica) healthy(now time.Time) bool {
+	return atomic.LoadInt64(&r.ejectedUntil) <= now.UnixNano()
+}
+
+func (r *replica) eject(d time.Duration) {
+	atomic.StoreInt64(&r.ejectedUntil, time.Now().Add(d).UnixNano())
+}
+
+// Replicas route First, Find, Count and Rows to the replicas, while writes and transactions go to the primary.
+// the replicas are picked by turns, and a replica whose connection fails is ejected for a while
+//   repo := NewGormRepository(primary, Replicas(replica1, replica2), EjectReplicaFor(time.Minute))
+func Replicas(dbs ...*gorm.DB) GormOption {
+	return func(opts *GormOptions) { opts.Replicas = append(opts.Replicas, dbs...) }
+}
+
+// EjectReplicaFor set how long a replica is ejected after its connection fails
+func EjectReplicaFor(d time.Duration) GormOption {
+	return func(opts *GormOptions) { opts.EjectFor = d }
+}
+
+type stickyKey struct{}
+
+type sticky struct {
+	primary bool
+	written int32
+}
+
+// Sticky derive a ctx reading its own writes: once a write is done with the ctx, the following
+// reads with it go to the primary instead of the replicas which may lag behind
+//   ctx = database.Sticky(ctx)
+//   err := repo.Create(ctx, &user)
+//   err = repo.First(ctx, &user, ID(user.ID)) // read from the primary
+func Sticky(ctx context.Context) context.Context {
+	return context.WithValue(ctx, stickyKey{}, &sticky{})
+}
+
+// UsePrimary derive a ctx whose reads always go to the primary
+func UsePrimary(ctx context.Context) context.Context {
+	return context.WithValue(ctx, stickyKey{}, &sticky{primary: true})
+}
+
+func (s *sticky) usePrimary() bool {
+	return s.primary || atomic.LoadInt32(&s.written) == 1
+}
+
+// written mark ctx as having written, if it's sticky
+func written(ctx context.Context) {
+	if s, ok := ctx.Value(stickyKey{}).(*sticky); ok {
+		atomic.StoreInt32(&s.written, 1)
+	}
+}
+
+// isBadConn whether err is caused by the connection rather than the query
+func isBadConn(err error) bool {
+	var netErr net.Error
+	return errors.Is(err, driver.ErrBadConn) || errors.Is(err, mysql.ErrInvalidConn) || errors.As(err, &netErr)
+}
+
+// reader the db a read with ctx goes to, and the replica it belongs to if it's a replica
+func (repo *gormRepository) reader(ctx context.Context) (*gorm.DB, *replica) {
+	if _, ok := repo.txOf(ctx); ok || len(repo.replicas) == 0 {
+		return repo.conn(ctx), nil
+	}
+	if s, ok := ctx.Value(stickyKey{}).(*sticky); ok && s.usePrimary() {
+		return repo.conn(ctx), nil
+	}
+	now := time.Now()
+	start := atomic.AddUint32(&repo.next, 1)
+	for i := 0; i < len(repo.replicas); i++ {
+		r := repo.replicas[(int(start)+i)%len(repo.replicas)]
+		if r.healthy(now) {
+			return r.db.WithContext(ctx), r
+		}
+	}
+	return repo.conn(ctx), nil
+}
+
+// read run query on the db picked by reader. if the connection of the replica fails, the replica
+// is ejected and query is run again on the primary
+func (repo *gormRepository) read(ctx context.Context, query func(db *gorm.DB) error) error {
+	db, r := repo.reader(ctx)
+	err := query(db)
+	if r == nil || !isBadConn(err) || ctx.Err() != nil {
+		return err
+	}
+	ejectFor := repo.opts.EjectFor
+	if ejectFor <= 0 {
+		ejectFor = DefaultEjectFor
+	}
+	r.eject(ejectFor)
+	return query(repo.conn(ctx))
+}
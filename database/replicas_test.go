@@ -0,0 +1,105 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+	"gorm.io/gorm"
+)
+
+func mockDB(t *testing.T) (*sql.DB, sqlmock.Sqlmock, *gorm.DB) {
+	db, mock, err := sqlmock.New() // mock sql.DB
+	assert.Nil(t, err)
+	gdb, err := gorm.Open(dialector(db)) // open gorm db
+	assert.Nil(t, err)
+	return db, mock, gdb
+}
+
+func TestGormRepository_Replicas(t *testing.T) {
+	pdb, primary, pgdb := mockDB(t)
+	defer pdb.Close()
+	rdb1, replica1, rgdb1 := mockDB(t)
+	defer rdb1.Close()
+	rdb2, replica2, rgdb2 := mockDB(t)
+	defer rdb2.Close()
+	repo := NewGormRepository(pgdb, Replicas(rgdb1, rgdb2))
+	func() {
+		execSql := "^SELECT \\* FROM `users` WHERE `id` = \\? ORDER BY `users`\\.`id` LIMIT 1$"
+		replica2.ExpectQuery(execSql).WithArgs("1").
+			WillReturnRows(sqlmock.NewRows([]string{"id", "name"}).AddRow("1", "a"))
+		replica1.ExpectQuery(execSql).WithArgs("2").
+			WillReturnRows(sqlmock.NewRows([]string{"id", "name"}).AddRow("2", "b"))
+		primary.ExpectBegin()
+		primary.ExpectExec("^INSERT INTO `users`").WillReturnResult(sqlmock.NewResult(0, 1))
+		primary.ExpectCommit()
+	}()
+	ctx := context.Background()
+	var user1, user2 User
+	assert.Nil(t, repo.First(ctx, &user1, func(opts *MatchOptions) { opts.EQ("id", "1") }))
+	assert.Nil(t, repo.First(ctx, &user2, func(opts *MatchOptions) { opts.EQ("id", "2") }))
+	assert.Nil(t, repo.Create(ctx, &User{ID: "3", Name: "c"}))
+	assert.Nil(t, primary.ExpectationsWereMet())
+	assert.Nil(t, replica1.ExpectationsWereMet())
+	assert.Nil(t, replica2.ExpectationsWereMet())
+}
+
+func TestGormRepository_ReplicasSticky(t *testing.T) {
+	pdb, primary, pgdb := mockDB(t)
+	defer pdb.Close()
+	rdb, replica, rgdb := mockDB(t)
+	defer rdb.Close()
+	repo := NewGormRepository(pgdb, Replicas(rgdb))
+	func() {
+		execSql := "^SELECT count\\(\\*\\) FROM `users`$"
+		replica.ExpectQuery(execSql).WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(1))
+		primary.ExpectBegin()
+		primary.ExpectExec("^UPDATE `users` SET `name`=\\? WHERE `id` = \\?$").
+			WithArgs("b", "1").
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		primary.ExpectCommit()
+		primary.ExpectQuery(execSql).WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(1))
+		// in a transaction reads go to the primary
+		primary.ExpectBegin()
+		primary.ExpectQuery(execSql).WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(1))
+		primary.ExpectCommit()
+	}()
+	ctx := Sticky(context.Background())
+	var count int64
+	assert.Nil(t, repo.Count(ctx, &User{}, &count))
+	assert.Nil(t, repo.UpdateFields(ctx, &User{}, Fields{"name": "b"}, func(opts *MatchOptions) { opts.EQ("id", "1") }))
+	assert.Nil(t, repo.Count(ctx, &User{}, &count))
+	err := repo.Transaction(context.Background(), func(ctx context.Context, repo Repository) error {
+		return repo.Count(ctx, &User{}, &count)
+	})
+	assert.Nil(t, err)
+	assert.Nil(t, primary.ExpectationsWereMet())
+	assert.Nil(t, replica.ExpectationsWereMet())
+}
+
+func TestGormRepository_ReplicaEjected(t *testing.T) {
+	pdb, primary, pgdb := mockDB(t)
+	defer pdb.Close()
+	rdb, replica, rgdb := mockDB(t)
+	defer rdb.Close()
+	repo := NewGormRepository(pgdb, Replicas(rgdb), EjectReplicaFor(time.Hour))
+	func() {
+		execSql := "^SELECT \\* FROM `users`$"
+		replica.ExpectQuery(execSql).
+			WillReturnError(&net.OpError{Op: "read", Net: "tcp", Err: errors.New("connection reset by peer")})
+		primary.ExpectQuery(execSql).WillReturnRows(sqlmock.NewRows([]string{"id", "name"}).AddRow("1", "a"))
+		primary.ExpectQuery(execSql).WillReturnRows(sqlmock.NewRows([]string{"id", "name"}).AddRow("1", "a"))
+	}()
+	var users []User
+	assert.Nil(t, repo.Find(context.Background(), &users))
+	assert.Equal(t, []User{{ID: "1", Name: "a"}}, users)
+	// the replica is ejected
+	assert.Nil(t, repo.Find(context.Background(), &users))
+	assert.Nil(t, primary.ExpectationsWereMet())
+	assert.Nil(t, replica.ExpectationsWereMet())
+}
@@ -2,7 +2,10 @@ package database
 
 import (
 	"context"
+	"database/sql"
 	"errors"
+	"strings"
+	"time"
 )
 
 type Operator int
@@ -24,38 +27,136 @@ const (
 
 	OR
 	AND
+	NOT
+
+	NOTIN
+	LIKE
+	ILIKE
+	BETWEEN
+	EXISTS
+	NOTEXISTS
+	JSONCONTAINS
+	FULLTEXT
+	REGEXP
 
 	LeftJoin  = 0
 	InnerJoin = 1
 	RightJoin = 2
 )
 
+// MatchItem a node of the match expression tree. the nodes of OR, AND and NOT are groups with
+// the child nodes in Value as MatchOptions, the others are leaves comparing Field with Value.
+// when Path is given, the value extracted from the json Field at Path is compared instead
 type MatchItem struct {
 	Field    string
 	Operator Operator
 	Value    interface{}
+	Path     string
 }
 
 type Field string
 
+// SQL a raw sql with its args, e.g. the subquery of EXISTS
+type SQL struct {
+	Query string
+	Args  []interface{}
+}
+
+func Raw(query string, args ...interface{}) SQL {
+	return SQL{Query: query, Args: args}
+}
+
+// Subquery the subquery of EXISTS, a raw SQL or a *Model
+type Subquery interface {
+	subquery()
+}
+
+func (SQL) subquery() {}
+
+func (*Model) subquery() {}
+
+type SearchMode string
+
+const (
+	NaturalLanguageMode SearchMode = "IN NATURAL LANGUAGE MODE"
+	BooleanMode         SearchMode = "IN BOOLEAN MODE"
+	QueryExpansionMode  SearchMode = "WITH QUERY EXPANSION"
+)
+
+// FullText the full-text search of Query against the FULLTEXT index of Fields
+type FullText struct {
+	Fields []string
+	Query  string
+	Mode   SearchMode
+}
+
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+// EscapeLike escape the wildcards of LIKE in s, so that s is matched literally
+func EscapeLike(s string) string {
+	return likeEscaper.Replace(s)
+}
+
 type Fields map[string]interface{}
 
 type Join struct {
 	Model interface{}
+	// Alias the alias of the joined table, see As
+	Alias string
 	Opts  MatchOptions
 	Type  int
 }
 
+// Aliased a model joined under an alias, see As
+type Aliased struct {
+	Model interface{}
+	Alias string
+}
+
+// As join model under alias, so that a table is joined to itself or joined more than once
+//   // SELECT e.name AS name,m.name AS manager FROM employees AS `e` LEFT JOIN employees AS `m` ON `m`.`id` = `e`.`manager_id`
+//   var rows []struct {
+//       Name    string `field:"name"`
+//       Manager string `field:"m.name"`
+//   }
+//   M(&rows, &Employee{}).As("e").With(As(&Employee{}, "m"), func(opts *MatchOptions) {
+//       opts.EQ("m.id", Field("e.manager_id"))
+//   })
+func As(model interface{}, alias string) Aliased {
+	return Aliased{Model: model, Alias: alias}
+}
+
 type Group struct {
 	By     string
 	Having *MatchOptions
 }
 
+// Union a model united with the model, see Model.Union
+type Union struct {
+	Model *Model
+	All   bool
+}
+
+// Preload the relation of Field loaded with the records, see Model.Preload
+type Preload struct {
+	Field string
+	Opts  MatchOptions
+}
+
+// Model the source of a query. a *Model is also a subquery when it's the value of a MatchItem,
+// the source of a join or a part of a union
 type Model struct {
-	Result interface{}
-	From   interface{}
-	Joins  []Join
-	Grp    *Group
+	Result   interface{}
+	From     interface{}
+	Joins    []Join
+	Grp      *Group
+	Preloads []Preload
+	Aggs     []Aggregation
+	// Opts the condition of the model itself, see Where
+	Opts MatchOptions
+	// Alias the alias of the model as a join source or a union
+	Alias  string
+	Unions []Union
 }
 
 func M(result interface{}, froms ...interface{}) *Model {
@@ -77,6 +178,59 @@ func (m *Model) Group(group string, having ...MatchOption) *Model {
 	return m
 }
 
+// Preload load the relation of the struct field named field into the records fetched. has-one, has-many and
+// belongs-to relations are supported following the gorm associations of the model, the related records of
+// all the records fetched are loaded in one IN query with opts applied. the relations of the relation are
+// preloaded by the dotted field, like Author.Profile. the Result must be a (slice of) the model itself
+//   var books []Book
+//   err := repo.Find(ctx, M(&books).Preload("Author").Preload("Reviews", Rating(5)), Limit(20))
+func (m *Model) Preload(field string, opts ...MatchOption) *Model {
+	p := Preload{Field: field}
+	p.Opts.Apply(opts...)
+	m.Preloads = append(m.Preloads, p)
+	return m
+}
+
+// Where filter the model itself, it's mostly used by the model as a subquery
+//   // WHERE `id` IN (SELECT `author_id` FROM `books` WHERE `name` LIKE ?)
+//   opts.IN("id", M(nil, &Book{}).Where(func(opts *MatchOptions) {
+//       opts.StartsWith("name", "go").SetSelect("author_id")
+//   }))
+func (m *Model) Where(opts ...MatchOption) *Model {
+	m.Opts.Apply(opts...)
+	return m
+}
+
+// As alias the model. the table of From is aliased when the model is queried, and the fields of
+// the Result without a table in its field tag are selected from the alias. a model as a join
+// source must be aliased
+//   // LEFT JOIN (SELECT `author_id`,COUNT(*) AS `count` FROM `books` GROUP BY `author_id`) AS `b` ON `b`.`author_id` = `users`.`id`
+//   M(&users, &User{}).With(M(nil, &Book{}).GroupBy("author_id").Aggregate(Count("*")).As("b"), func(opts *MatchOptions) {
+//       opts.EQ("b.author_id", Field("users.id"))
+//   })
+func (m *Model) As(alias string) *Model {
+	m.Alias = alias
+	return m
+}
+
+// Union unite the records of the models with the ones of m, the duplicated records are removed
+//   // SELECT * FROM ((SELECT * FROM `books` WHERE ...) UNION (SELECT * FROM `books` WHERE ...)) AS `u`
+//   err := repo.Find(ctx, M(&books, &Book{}).Where(AuthorID("1")).Union(M(nil, &Book{}).Where(Name("go"))), Limit(20))
+func (m *Model) Union(models ...*Model) *Model {
+	for _, model := range models {
+		m.Unions = append(m.Unions, Union{Model: model})
+	}
+	return m
+}
+
+// UnionAll unite the records of the models with the ones of m, keeping the duplicated records
+func (m *Model) UnionAll(models ...*Model) *Model {
+	for _, model := range models {
+		m.Unions = append(m.Unions, Union{Model: model, All: true})
+	}
+	return m
+}
+
 func (m *Model) With(model interface{}, opts ...MatchOption) *Model {
 	return m.with(model, LeftJoin, opts...)
 }
@@ -94,6 +248,9 @@ func (m *Model) with(model interface{}, j int, opts ...MatchOption) *Model {
 		Model: model,
 		Type:  j,
 	}
+	if aliased, ok := model.(Aliased); ok {
+		mj.Model, mj.Alias = aliased.Model, aliased.Alias
+	}
 	for _, apply := range opts {
 		apply(&mj.Opts)
 	}
@@ -101,15 +258,64 @@ func (m *Model) with(model interface{}, j int, opts ...MatchOption) *Model {
 	return m
 }
 
+// MatchOptions the Matches are joined by AND
 type MatchOptions struct {
 	Matches []MatchItem
 	Sort    []string
 	Limit   *int
 	Offset  *int
+	Timeout *time.Duration
+	// Cursor fetch the records after the cursor when Paginate
+	Cursor string
+	// Total count the total when Paginate
+	Total bool
+	// Select fetch only the columns, all columns are fetched if it's empty
+	Select []string
+	// Trashed whether the soft deleted records are matched, see WithTrashed and OnlyTrashed
+	Trashed Trashed
+	// ForUpdate lock the records matched until the transaction ends, see ForUpdate
+	ForUpdate bool
 }
 
+// Trashed how the soft deleted records are matched
+type Trashed int
+
+const (
+	// TrashedExcluded the soft deleted records are not matched, the default
+	TrashedExcluded Trashed = iota
+	// TrashedIncluded the soft deleted records are matched along with the others
+	TrashedIncluded
+	// TrashedOnly only the soft deleted records are matched
+	TrashedOnly
+)
+
 type MatchOption func(*MatchOptions)
 
+// Or match any of subs
+//   repo.Find(ctx, &users, Or(Role("admin"), And(Role("member"), Active())))
+func Or(subs ...MatchOption) MatchOption {
+	return func(opts *MatchOptions) {
+		sub := MatchOptions{}
+		opts.OR(sub.Apply(subs...))
+	}
+}
+
+// And match all of subs
+func And(subs ...MatchOption) MatchOption {
+	return func(opts *MatchOptions) {
+		sub := MatchOptions{}
+		opts.AND(sub.Apply(subs...))
+	}
+}
+
+// Not match none of the records which match all of subs
+func Not(subs ...MatchOption) MatchOption {
+	return func(opts *MatchOptions) {
+		sub := MatchOptions{}
+		opts.NOT(sub.Apply(subs...))
+	}
+}
+
 func (opts *MatchOptions) oper(field string, oper Operator, val interface{}) *MatchOptions {
 	opts.Matches = append(opts.Matches, MatchItem{
 		Field: field, Operator: oper, Value: val,
@@ -124,16 +330,82 @@ func (opts *MatchOptions) Apply(newOptions ...MatchOption) MatchOptions {
 	return *opts
 }
 
+// Option the MatchOption which appends the matches of opts, and overrides the sort, limit, offset and timeout if opts has them
+func (opts MatchOptions) Option() MatchOption {
+	return func(target *MatchOptions) {
+		target.Matches = append(target.Matches, opts.Matches...)
+		if len(opts.Sort) > 0 {
+			target.Sort = opts.Sort
+		}
+		if opts.Limit != nil {
+			target.Limit = opts.Limit
+		}
+		if opts.Offset != nil {
+			target.Offset = opts.Offset
+		}
+		if opts.Timeout != nil {
+			target.Timeout = opts.Timeout
+		}
+		if opts.Cursor != "" {
+			target.Cursor = opts.Cursor
+		}
+		if opts.Total {
+			target.Total = true
+		}
+		if len(opts.Select) > 0 {
+			target.Select = opts.Select
+		}
+		if opts.Trashed != TrashedExcluded {
+			target.Trashed = opts.Trashed
+		}
+		if opts.ForUpdate {
+			target.ForUpdate = true
+		}
+	}
+}
+
+// WithTrashed match the soft deleted records along with the others
+//   err := repo.Find(ctx, &users, WithTrashed(), Role("admin"))
+func WithTrashed() MatchOption {
+	return func(opts *MatchOptions) { opts.WithTrashed() }
+}
+
+// ForUpdate lock the records read by SELECT ... FOR UPDATE until the transaction carried by ctx ends.
+// sqlite has no row lock, its transactions lock the whole database
+//   err := repo.Transaction(ctx, func(ctx context.Context, repo Repository) error {
+//       if err := repo.First(ctx, &account, ID(id), ForUpdate()); err != nil {
+//           return err
+//       }
+//       ...
+//   })
+func ForUpdate() MatchOption {
+	return func(opts *MatchOptions) { opts.ForUpdate = true }
+}
+
+// OnlyTrashed match only the soft deleted records
+//   err := repo.Find(ctx, &users, OnlyTrashed())
+func OnlyTrashed() MatchOption {
+	return func(opts *MatchOptions) { opts.OnlyTrashed() }
+}
+
+// OR match any of the matches of sub
 func (opts *MatchOptions) OR(sub MatchOptions) *MatchOptions {
 	opts.Matches = append(opts.Matches, MatchItem{Operator: OR, Value: sub})
 	return opts
 }
 
+// AND match all of the matches of sub
 func (opts *MatchOptions) AND(sub MatchOptions) *MatchOptions {
 	opts.Matches = append(opts.Matches, MatchItem{Operator: AND, Value: sub})
 	return opts
 }
 
+// NOT match none of the records which match all of the matches of sub
+func (opts *MatchOptions) NOT(sub MatchOptions) *MatchOptions {
+	opts.Matches = append(opts.Matches, MatchItem{Operator: NOT, Value: sub})
+	return opts
+}
+
 func (opts *MatchOptions) EQ(field string, val interface{}) *MatchOptions {
 	return opts.oper(field, EQ, val)
 }
@@ -162,6 +434,84 @@ func (opts *MatchOptions) IN(field string, val interface{}) *MatchOptions {
 	return opts.oper(field, IN, val)
 }
 
+func (opts *MatchOptions) NotIN(field string, val interface{}) *MatchOptions {
+	return opts.oper(field, NOTIN, val)
+}
+
+// Like match field with the LIKE pattern, the wildcards in pattern work as is
+func (opts *MatchOptions) Like(field string, pattern string) *MatchOptions {
+	return opts.oper(field, LIKE, pattern)
+}
+
+// ILike match field with the LIKE pattern case-insensitively
+func (opts *MatchOptions) ILike(field string, pattern string) *MatchOptions {
+	return opts.oper(field, ILIKE, pattern)
+}
+
+// Regexp match field with the regular expression pattern, REGEXP of mysql and ~ of postgres. sqlite
+// supports it once RegisterSQLiteRegexp is called
+func (opts *MatchOptions) Regexp(field string, pattern string) *MatchOptions {
+	return opts.oper(field, REGEXP, pattern)
+}
+
+// Contains match field containing s, the wildcards in s are escaped
+func (opts *MatchOptions) Contains(field string, s string) *MatchOptions {
+	return opts.Like(field, "%"+EscapeLike(s)+"%")
+}
+
+// StartsWith match field starting with s, the wildcards in s are escaped
+func (opts *MatchOptions) StartsWith(field string, s string) *MatchOptions {
+	return opts.Like(field, EscapeLike(s)+"%")
+}
+
+// EndsWith match field ending with s, the wildcards in s are escaped
+func (opts *MatchOptions) EndsWith(field string, s string) *MatchOptions {
+	return opts.Like(field, "%"+EscapeLike(s))
+}
+
+// Between match field in the closed interval [from, to]
+func (opts *MatchOptions) Between(field string, from, to interface{}) *MatchOptions {
+	return opts.oper(field, BETWEEN, []interface{}{from, to})
+}
+
+// Exists match when the subquery returns any row, the subquery is correlated by matching the Field of the outer table
+//   opts.Exists(Raw("SELECT 1 FROM books WHERE books.author_id = users.id AND books.name = ?", name))
+//   opts.Exists(M(nil, &Book{}).Where(func(opts *MatchOptions) {
+//       opts.EQ("books.author_id", Field("users.id")).EQ("books.name", name)
+//   }))
+func (opts *MatchOptions) Exists(subquery Subquery) *MatchOptions {
+	return opts.oper("", EXISTS, subquery)
+}
+
+// NotExists match when the subquery returns no row
+func (opts *MatchOptions) NotExists(subquery Subquery) *MatchOptions {
+	return opts.oper("", NOTEXISTS, subquery)
+}
+
+// JSONContains match when the json field contains val, or the value at path of field contains val if path given.
+// on sqlite val must be a scalar, which matches an element of the array or the value itself
+func (opts *MatchOptions) JSONContains(field string, val interface{}, path ...string) *MatchOptions {
+	item := MatchItem{Field: field, Operator: JSONCONTAINS, Value: val}
+	if len(path) > 0 {
+		item.Path = path[0]
+	}
+	opts.Matches = append(opts.Matches, item)
+	return opts
+}
+
+// JSONPath compare the value extracted from the json field at path with val
+//   opts.JSONPath("attrs", "$.color", EQ, "red")
+func (opts *MatchOptions) JSONPath(field, path string, oper Operator, val interface{}) *MatchOptions {
+	opts.Matches = append(opts.Matches, MatchItem{Field: field, Operator: oper, Value: val, Path: path})
+	return opts
+}
+
+// Search the full-text search of query against fields which have a FULLTEXT index. on postgres the tsvector of
+// the fields is searched and QueryExpansionMode is not supported, sqlite is not supported
+func (opts *MatchOptions) Search(query string, mode SearchMode, fields ...string) *MatchOptions {
+	return opts.oper("", FULLTEXT, FullText{Fields: fields, Query: query, Mode: mode})
+}
+
 func (opts *MatchOptions) Null(field string) *MatchOptions {
 	return opts.oper(field, NULL, nil)
 }
@@ -180,11 +530,64 @@ func (opts *MatchOptions) SetOffset(offset int) *MatchOptions {
 	return opts
 }
 
+// SetTimeout abort the operation when it runs longer than timeout
+func (opts *MatchOptions) SetTimeout(timeout time.Duration) *MatchOptions {
+	opts.Timeout = &timeout
+	return opts
+}
+
 func (opts *MatchOptions) SetSort(sort ...string) *MatchOptions {
 	opts.Sort = sort
 	return opts
 }
 
+// SetSelect fetch only the columns
+func (opts *MatchOptions) SetSelect(columns ...string) *MatchOptions {
+	opts.Select = columns
+	return opts
+}
+
+// WithTrashed match the soft deleted records along with the others
+func (opts *MatchOptions) WithTrashed() *MatchOptions {
+	opts.Trashed = TrashedIncluded
+	return opts
+}
+
+// OnlyTrashed match only the soft deleted records
+func (opts *MatchOptions) OnlyTrashed() *MatchOptions {
+	opts.Trashed = TrashedOnly
+	return opts
+}
+
+// TxOptions options of a transaction
+type TxOptions struct {
+	Isolation sql.IsolationLevel
+	ReadOnly  bool
+	// Retries times to retry the transaction when it's aborted by a deadlock
+	Retries int
+}
+
+type TxOption func(*TxOptions)
+
+// Isolation run the transaction in the isolation level
+func Isolation(level sql.IsolationLevel) TxOption {
+	return func(opts *TxOptions) { opts.Isolation = level }
+}
+
+// ReadOnly run a read only transaction
+func ReadOnly() TxOption {
+	return func(opts *TxOptions) { opts.ReadOnly = true }
+}
+
+// RetryOnDeadlock rerun the whole transaction at most times when it's aborted by a deadlock
+func RetryOnDeadlock(times int) TxOption {
+	return func(opts *TxOptions) { opts.Retries = times }
+}
+
+func (opts *TxOptions) sqlTxOptions() *sql.TxOptions {
+	return &sql.TxOptions{Isolation: opts.Isolation, ReadOnly: opts.ReadOnly}
+}
+
 type RepositoryCodeGenerator interface {
 	GenerateRepositoryCode(modelName, packageName string)
 }
@@ -196,14 +599,34 @@ type Repository interface {
 	Find(ctx context.Context, v interface{}, opts ...MatchOption) error
 	// Count record following the match condition
 	Count(ctx context.Context, v interface{}, count *int64, opts ...MatchOption) error
-	// Update a record
+	// Paginate fetch a page of the records following the match condition into v, and the page info into page
+	Paginate(ctx context.Context, v interface{}, page *Page, opts ...MatchOption) error
+	// Update a record, ErrConflict is returned if its version field was changed since it was read
 	Update(ctx context.Context, v interface{}) error
-	// Delete record following the match condition
+	// Delete record following the match condition, the record is soft deleted if its model has a gorm.DeletedAt field
 	Delete(ctx context.Context, v interface{}, opts ...MatchOption) error
+	// Restore the soft deleted records following the match condition
+	Restore(ctx context.Context, v interface{}, opts ...MatchOption) error
+	// ForceDelete delete the records following the match condition for good, the soft deleted ones included
+	ForceDelete(ctx context.Context, v interface{}, opts ...MatchOption) error
 	// Create records
 	Create(ctx context.Context, v interface{}) error
 	// UpdateField field
 	UpdateFields(ctx context.Context, v interface{}, fields Fields, opts ...MatchOption) error
-	// Transaction
-	Transaction(func() error)
+	// CreateInBatches create the records of the slice v, batchSize records per statement. the repository's batch size
+	// is used if batchSize is not positive
+	CreateInBatches(ctx context.Context, v interface{}, batchSize int) error
+	// Upsert create records, the ones conflicting on the unique columns conflict get the columns update updated instead.
+	// all columns but the primary key are updated if update is empty
+	Upsert(ctx context.Context, v interface{}, conflict []string, update ...string) error
+	// BulkUpdateFields update the fields of many records of model v at once, rows is keyed by the primary key of the records
+	BulkUpdateFields(ctx context.Context, v interface{}, rows map[interface{}]Fields) error
+	// Rows stream the records following the match condition, v is the model. the rows must be closed after use
+	Rows(ctx context.Context, v interface{}, opts ...MatchOption) (Rows, error)
+	// Each stream the records following the match condition into the slice v, and call do every size records
+	// with v holding them. the records are never loaded into memory all at once
+	Each(ctx context.Context, v interface{}, size int, do func(ctx context.Context) error, opts ...MatchOption) error
+	// Transaction run do in a transaction, the transaction is committed when do returns nil, otherwise rolled back.
+	// do must use the ctx or the repo it receives to run in the transaction
+	Transaction(ctx context.Context, do func(ctx context.Context, repo Repository) error, opts ...TxOption) error
 }
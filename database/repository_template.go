@@ -9,19 +9,27 @@ import (
 )
 
 var (
-	ErrModelRequired = errors.New("template.Model required")
+	ErrModelRequired  = errors.New("template.Model required")
+	ErrUnknownDialect = errors.New("template.Dialect unknown")
 )
 
 type RepositoryTemplate struct {
 	RootDirectory string
 	Package       string
 	Model         string
+	// Dialect the dialect the generated tests expect, one of MySQL, Postgres and SQLite. MySQL if it's empty
+	Dialect string
 }
 
 func (template RepositoryTemplate) Create() error {
 	if template.Model == "" {
 		return ErrModelRequired
 	}
+	switch template.Dialect {
+	case "", MySQL, Postgres, SQLite:
+	default:
+		return fmt.Errorf("%w: %s", ErrUnknownDialect, template.Dialect)
+	}
 	var dir string
 	if err := template.makePackageDirectory(&dir); err != nil {
 		return err
@@ -101,6 +109,7 @@ type __model__ struct {
 	CreatedAt time.Time		__sql_quote__gorm:"<-:create,autoCreateTime"__sql_quote__
 	UpdatedAt time.Time		__sql_quote__gorm:"autoUpdateTime"__sql_quote__
 	DeletedAt gorm.DeletedAt __sql_quote__gorm:"index"__sql_quote__
+	Version   int64			__sql_quote__lock:"version"__sql_quote__
 }
 
 func (m *__model__) BeforeCreate(tx *gorm.DB) error {
@@ -148,7 +157,7 @@ func Limit(limit int) database.MatchOption {
 type Repository interface {
 	// Create __model__
 	Create(ctx context.Context, m *__model__) error
-	// Update __model__
+	// Update __model__, database.ErrConflict is returned if it was updated by others since it was read
 	Update(ctx context.Context, m *__model__) error
 	// Fetch __model__[s]
 	Fetch(ctx context.Context, result *[]__model__, opts ...database.MatchOption) error
@@ -158,6 +167,10 @@ type Repository interface {
 	Count(ctx context.Context, result *int64, opts ...database.MatchOption) error
 	// Delete __model__
 	Delete(ctx context.Context, opts ...database.MatchOption) error
+	// Restore the deleted __model__
+	Restore(ctx context.Context, opts ...database.MatchOption) error
+	// ForceDelete __model__ for good
+	ForceDelete(ctx context.Context, opts ...database.MatchOption) error
 }
 	
 	`
@@ -214,6 +227,16 @@ func (repo *repository) Delete(ctx context.Context, opts ...database.MatchOption
 	return repo.Repository.Delete(ctx, &__model__{}, opts...)
 }
 
+// Restore
+func (repo *repository) Restore(ctx context.Context, opts ...database.MatchOption) error {
+	return repo.Repository.Restore(ctx, &__model__{}, opts...)
+}
+
+// ForceDelete
+func (repo *repository) ForceDelete(ctx context.Context, opts ...database.MatchOption) error {
+	return repo.Repository.ForceDelete(ctx, &__model__{}, opts...)
+}
+
 	`
 	ctt = strings.ReplaceAll(ctt, "__package_name__", template.packageName())
 	ctt = strings.ReplaceAll(ctt, "__sql_quote__", "`")
@@ -235,7 +258,7 @@ import (
 	"github.com/DATA-DOG/go-sqlmock"
 	"github.com/stretchr/testify/assert"
 	"github.com/yang-zzhong/xl/database"
-	"gorm.io/driver/mysql"
+	__dialect_import__
 	"gorm.io/gorm"
 )
 
@@ -259,20 +282,14 @@ func (a AnyTime) Match(v driver.Value) bool {
 	return ok
 }
 
-func dialector(db *sql.DB) gorm.Dialector {
-	return mysql.New(mysql.Config{
-		Conn:                      db,
-		DriverName:                "mysql",
-		SkipInitializeWithVersion: true,
-	})
-}
+__dialector__
 
 func TestGormRepository_Create(t *testing.T) {
 	db, mock, err := sqlmock.New() // mock sql.DB
 	assert.Nil(t, err)
 	defer db.Close()
 	defer assert.Nil(t, mock.ExpectationsWereMet())
-	gdb, err := gorm.Open(dialector(db)) // open gorm db
+	gdb, err := gorm.Open(dialector(db, mock)) // open gorm db
 	assert.Nil(t, err)
 	repo := NewRepository(database.NewGormRepository(gdb))
 	func() {
@@ -281,7 +298,7 @@ func TestGormRepository_Create(t *testing.T) {
 		execSql := fmt.Sprintf("^INSERT INTO __sql_quote__%s__sql_quote__ (.*) VALUES (.*)$", tableName)
 		mock.ExpectBegin()
 		mock.ExpectExec(execSql).
-			WithArgs("1", AnyTime{}, AnyTime{}, Any{}).
+			WithArgs("1", AnyTime{}, AnyTime{}, Any{}, int64(0)).
 			WillReturnResult(sqlmock.NewResult(1, 1))
 		mock.ExpectCommit()
 	}()
@@ -297,24 +314,55 @@ func TestGormRepository_Update(t *testing.T) {
 	assert.Nil(t, err)
 	defer db.Close()
 	defer assert.Nil(t, mock.ExpectationsWereMet())
-	gdb, err := gorm.Open(dialector(db)) // open gorm db
+	gdb, err := gorm.Open(dialector(db, mock)) // open gorm db
 	assert.Nil(t, err)
 	repo := NewRepository(database.NewGormRepository(gdb))
 	func() {
 		// TODO put your mock here
 		tableName := "__table_name__"
-		execSql := fmt.Sprintf("^UPDATE __sql_quote__%s__sql_quote__ SET __sql_quote__updated_at__sql_quote__=\\?,__sql_quote__deleted_at__sql_quote__=\\? WHERE __sql_quote__%s__sql_quote__\\.__sql_quote__deleted_at__sql_quote__ IS NULL AND __sql_quote__id__sql_quote__ = \\?$", tableName, tableName)
+		execSql := fmt.Sprintf("^UPDATE __sql_quote__%s__sql_quote__ SET __sql_quote__updated_at__sql_quote__=__bind__,__sql_quote__deleted_at__sql_quote__=__bind__,__sql_quote__version__sql_quote__=__bind__ WHERE __sql_quote__version__sql_quote__ = __bind__ AND __sql_quote__%s__sql_quote__\\.__sql_quote__deleted_at__sql_quote__ IS NULL AND __sql_quote__id__sql_quote__ = __bind__$", tableName, tableName)
 		mock.ExpectBegin()
 		mock.ExpectExec(execSql).
-			WithArgs(AnyTime{}, Any{}, "1").
+			WithArgs(AnyTime{}, Any{}, int64(2), int64(1), "1").
 			WillReturnResult(sqlmock.NewResult(0, 1))
 		mock.ExpectCommit()
 	}()
 	var ctx = context.Background()
-	err = repo.Update(ctx, &__model__{
-		ID: "1",
-	})
+	m := &__model__{
+		ID:      "1",
+		Version: 1,
+	}
+	err = repo.Update(ctx, m)
 	assert.Nil(t, err)
+	assert.Equal(t, int64(2), m.Version)
+}
+
+func TestGormRepository_UpdateConflict(t *testing.T) {
+	db, mock, err := sqlmock.New() // mock sql.DB
+	assert.Nil(t, err)
+	defer db.Close()
+	defer assert.Nil(t, mock.ExpectationsWereMet())
+	gdb, err := gorm.Open(dialector(db, mock)) // open gorm db
+	assert.Nil(t, err)
+	repo := NewRepository(database.NewGormRepository(gdb))
+	func() {
+		// the record was updated by others, so no row of version 1 is left
+		tableName := "__table_name__"
+		execSql := fmt.Sprintf("^UPDATE __sql_quote__%s__sql_quote__ SET (.*) WHERE __sql_quote__version__sql_quote__ = __bind__ (.*)$", tableName)
+		mock.ExpectBegin()
+		mock.ExpectExec(execSql).
+			WithArgs(AnyTime{}, Any{}, int64(2), int64(1), "1").
+			WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectCommit()
+	}()
+	var ctx = context.Background()
+	m := &__model__{
+		ID:      "1",
+		Version: 1,
+	}
+	err = repo.Update(ctx, m)
+	assert.ErrorIs(t, err, database.ErrConflict)
+	assert.Equal(t, int64(1), m.Version)
 }
 
 func TestGormRepository_Delete(t *testing.T) {
@@ -322,13 +370,13 @@ func TestGormRepository_Delete(t *testing.T) {
 	assert.Nil(t, err)
 	defer db.Close()
 	defer assert.Nil(t, mock.ExpectationsWereMet())
-	gdb, err := gorm.Open(dialector(db)) // open gorm db
+	gdb, err := gorm.Open(dialector(db, mock)) // open gorm db
 	assert.Nil(t, err)
 	repo := NewRepository(database.NewGormRepository(gdb))
 	func() {
 		// TODO put your mock here
 		tableName := "__table_name__"
-		execSql := fmt.Sprintf("^UPDATE __sql_quote__%s__sql_quote__ SET __sql_quote__deleted_at__sql_quote__=\\? WHERE __sql_quote__id__sql_quote__ = \\? AND __sql_quote__%s__sql_quote__\\.__sql_quote__deleted_at__sql_quote__ IS NULL LIMIT 1$", tableName, tableName)
+		execSql := fmt.Sprintf("^UPDATE __sql_quote__%s__sql_quote__ SET __sql_quote__deleted_at__sql_quote__=__bind__ WHERE __sql_quote__id__sql_quote__ = __bind__ AND __sql_quote__%s__sql_quote__\\.__sql_quote__deleted_at__sql_quote__ IS NULL__write_limit__$", tableName, tableName)
 		mock.ExpectBegin()
 		mock.ExpectExec(execSql).
 			WithArgs(AnyTime{}, "1").
@@ -340,18 +388,62 @@ func TestGormRepository_Delete(t *testing.T) {
 	assert.Nil(t, err)
 }
 
+func TestGormRepository_Restore(t *testing.T) {
+	db, mock, err := sqlmock.New() // mock sql.DB
+	assert.Nil(t, err)
+	defer db.Close()
+	defer assert.Nil(t, mock.ExpectationsWereMet())
+	gdb, err := gorm.Open(dialector(db, mock)) // open gorm db
+	assert.Nil(t, err)
+	repo := NewRepository(database.NewGormRepository(gdb))
+	func() {
+		tableName := "__table_name__"
+		execSql := fmt.Sprintf("^UPDATE __sql_quote__%s__sql_quote__ SET __sql_quote__deleted_at__sql_quote__=__bind__ WHERE __sql_quote__%s__sql_quote__\\.__sql_quote__deleted_at__sql_quote__ IS NOT NULL AND __sql_quote__id__sql_quote__ = __bind____write_limit__$", tableName, tableName)
+		mock.ExpectBegin()
+		mock.ExpectExec(execSql).
+			WithArgs(nil, "1").
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectCommit()
+	}()
+	var ctx = context.Background()
+	err = repo.Restore(ctx, ID("1"))
+	assert.Nil(t, err)
+}
+
+func TestGormRepository_ForceDelete(t *testing.T) {
+	db, mock, err := sqlmock.New() // mock sql.DB
+	assert.Nil(t, err)
+	defer db.Close()
+	defer assert.Nil(t, mock.ExpectationsWereMet())
+	gdb, err := gorm.Open(dialector(db, mock)) // open gorm db
+	assert.Nil(t, err)
+	repo := NewRepository(database.NewGormRepository(gdb))
+	func() {
+		tableName := "__table_name__"
+		execSql := fmt.Sprintf("^DELETE FROM __sql_quote__%s__sql_quote__ WHERE __sql_quote__id__sql_quote__ = __bind____write_limit__$", tableName)
+		mock.ExpectBegin()
+		mock.ExpectExec(execSql).
+			WithArgs("1").
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectCommit()
+	}()
+	var ctx = context.Background()
+	err = repo.ForceDelete(ctx, ID("1"))
+	assert.Nil(t, err)
+}
+
 func TestGormRepository_Fetch(t *testing.T) {
 	db, mock, err := sqlmock.New() // mock sql.DB
 	assert.Nil(t, err)
 	defer db.Close()
 	defer assert.Nil(t, mock.ExpectationsWereMet())
-	gdb, err := gorm.Open(dialector(db)) // open gorm db
+	gdb, err := gorm.Open(dialector(db, mock)) // open gorm db
 	assert.Nil(t, err)
 	repo := NewRepository(database.NewGormRepository(gdb))
 	func() {
 		// TODO put your mock here
 		tableName := "__table_name__"
-		querySql := fmt.Sprintf("^SELECT \\* FROM __sql_quote__%s__sql_quote__ WHERE __sql_quote__id__sql_quote__ = \\? AND __sql_quote__%s__sql_quote__\\.__sql_quote__deleted_at__sql_quote__ IS NULL LIMIT 1$", tableName, tableName)
+		querySql := fmt.Sprintf("^SELECT \\* FROM __sql_quote__%s__sql_quote__ WHERE __sql_quote__id__sql_quote__ = __bind__ AND __sql_quote__%s__sql_quote__\\.__sql_quote__deleted_at__sql_quote__ IS NULL LIMIT 1$", tableName, tableName)
 		mock.ExpectQuery(querySql).
 			WithArgs("1").
 			WillReturnRows(sqlmock.NewRows([]string{"id", "created_at", "updated_at", "deleted_at"}))
@@ -363,13 +455,77 @@ func TestGormRepository_Fetch(t *testing.T) {
 }
 `
 	ctt = strings.ReplaceAll(ctt, "__package_name__", template.packageName())
-	ctt = strings.ReplaceAll(ctt, "__sql_quote__", "`")
+	ctt = strings.ReplaceAll(ctt, "__dialect_import__", template.dialectImport())
+	ctt = strings.ReplaceAll(ctt, "__dialector__", template.dialector())
+	ctt = strings.ReplaceAll(ctt, "__sql_quote__", template.sqlQuote())
+	ctt = strings.ReplaceAll(ctt, "__bind__", template.bind())
+	ctt = strings.ReplaceAll(ctt, "__write_limit__", template.writeLimit())
 	ctt = strings.ReplaceAll(ctt, "__table_name__", strings.ToLower(template.Model)+"s")
 	ctt = strings.ReplaceAll(ctt, "__model__", template.Model)
 
 	return ctt
 }
 
+func (template RepositoryTemplate) dialectImport() string {
+	switch template.Dialect {
+	case Postgres:
+		return `"gorm.io/driver/postgres"`
+	case SQLite:
+		return `"github.com/glebarez/sqlite"`
+	}
+	return `"gorm.io/driver/mysql"`
+}
+
+// dialector the dialector of the generated tests, which opens the mocked db
+func (template RepositoryTemplate) dialector() string {
+	switch template.Dialect {
+	case Postgres:
+		return `func dialector(db *sql.DB, mock sqlmock.Sqlmock) gorm.Dialector {
+	return postgres.New(postgres.Config{
+		Conn: db,
+	})
+}`
+	case SQLite:
+		return `func dialector(db *sql.DB, mock sqlmock.Sqlmock) gorm.Dialector {
+	// the version of sqlite is queried once the db is opened
+	mock.ExpectQuery("select sqlite_version\\(\\)").
+		WillReturnRows(sqlmock.NewRows([]string{"version"}).AddRow("3.39.4"))
+	return &sqlite.Dialector{Conn: db}
+}`
+	}
+	return `func dialector(db *sql.DB, mock sqlmock.Sqlmock) gorm.Dialector {
+	return mysql.New(mysql.Config{
+		Conn:                      db,
+		DriverName:                "mysql",
+		SkipInitializeWithVersion: true,
+	})
+}`
+}
+
+// sqlQuote the quote of the identifiers in the sql expected, escaped for the string literal it's in
+func (template RepositoryTemplate) sqlQuote() string {
+	if template.Dialect == Postgres {
+		return `\"`
+	}
+	return "`"
+}
+
+// bind the placeholder of the args in the sql expected, which is numbered by postgres
+func (template RepositoryTemplate) bind() string {
+	if template.Dialect == Postgres {
+		return `\\$\\d+`
+	}
+	return `\\?`
+}
+
+// writeLimit the LIMIT of the updates and deletes, which only mysql supports
+func (template RepositoryTemplate) writeLimit() string {
+	if template.Dialect == "" || template.Dialect == MySQL {
+		return " LIMIT 1"
+	}
+	return ""
+}
+
 func (template RepositoryTemplate) packageName() string {
 	ss := strings.Split(template.Package, "/")
 	return ss[len(ss)-1]
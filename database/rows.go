@@ -0,0 +1,106 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"reflect"
+
+	"gorm.io/gorm"
+)
+
+// Rows a stream of records. the connection is held until the rows is closed
+type Rows interface {
+	// Next prepare the next record for Scan, false is returned when there's no more record or an error occurs
+	Next() bool
+	// Scan the current record into dest, a pointer to a struct or a map[string]interface{}
+	Scan(dest interface{}) error
+	// Err the error occurs while iterating
+	Err() error
+	// Close the rows and release the connection
+	Close() error
+}
+
+type gormRows struct {
+	repo   *gormRepository
+	db     *gorm.DB
+	rows   *sql.Rows
+	ctx    context.Context
+	cancel context.CancelFunc
+	closed bool
+}
+
+func (r *gormRows) Next() bool {
+	if r.ctx.Err() != nil {
+		return false
+	}
+	return r.rows.Next()
+}
+
+func (r *gormRows) Scan(dest interface{}) error {
+	return r.repo.error(r.ctx, "scan", r.db.ScanRows(r.rows, dest))
+}
+
+func (r *gormRows) Err() error {
+	if err := r.ctx.Err(); err != nil && !r.closed {
+		return &ContextError{Op: "rows", Err: err}
+	}
+	return r.repo.error(r.ctx, "rows", r.rows.Err())
+}
+
+func (r *gormRows) Close() error {
+	defer r.cancel()
+	r.closed = true
+	return r.rows.Close()
+}
+
+// each stream the records into the slice v by repo.Rows, v may be a *Model whose Result is the slice.
+// do is called every size records, with the slice holding them
+func each(ctx context.Context, repo Repository, v interface{}, size int, do func(ctx context.Context) error, opts ...MatchOption) error {
+	target := v
+	if m, ok := v.(*Model); ok {
+		target = m.Result
+	}
+	slice := reflect.ValueOf(target)
+	if slice.Kind() != reflect.Ptr || slice.Elem().Kind() != reflect.Slice {
+		return fmt.Errorf("each: %T is not a pointer to a slice", target)
+	}
+	slice = slice.Elem()
+	if size <= 0 {
+		size = DefaultBatchSize
+	}
+	rows, err := repo.Rows(ctx, v, opts...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	flush := func() error {
+		if slice.Len() == 0 {
+			return nil
+		}
+		if err := do(ctx); err != nil {
+			return err
+		}
+		// a new slice every chunk, so that the records passed to do are never overwritten
+		slice.Set(reflect.MakeSlice(slice.Type(), 0, size))
+		return nil
+	}
+	slice.Set(reflect.MakeSlice(slice.Type(), 0, size))
+	for rows.Next() {
+		elem := reflect.New(slice.Type().Elem())
+		if err := rows.Scan(elem.Interface()); err != nil {
+			return err
+		}
+		slice.Set(reflect.Append(slice, elem.Elem()))
+		if slice.Len() < size {
+			continue
+		}
+		if err := flush(); err != nil {
+			return err
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	return flush()
+}
@@ -0,0 +1,92 @@
+package database
+
+import (
+	"context"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+	"gorm.io/gorm"
+)
+
+func TestGormRepository_Rows(t *testing.T) {
+	db, mock, err := sqlmock.New() // mock sql.DB
+	assert.Nil(t, err)
+	defer db.Close()
+	gdb, err := gorm.Open(dialector(db)) // open gorm db
+	assert.Nil(t, err)
+	repo := NewGormRepository(gdb)
+	func() {
+		execSql := "^SELECT `id` FROM `users` WHERE `name` LIKE \\? ORDER BY `id`$"
+		mock.ExpectQuery(execSql).
+			WithArgs("a%").
+			WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("1").AddRow("2"))
+	}()
+	rows, err := repo.Rows(context.Background(), &User{}, func(opts *MatchOptions) {
+		opts.StartsWith("name", "a").SetSort("id").SetSelect("id")
+	})
+	assert.Nil(t, err)
+	ids := []string{}
+	for rows.Next() {
+		var user User
+		assert.Nil(t, rows.Scan(&user))
+		ids = append(ids, user.ID)
+	}
+	assert.Nil(t, rows.Err())
+	assert.Nil(t, rows.Close())
+	assert.Equal(t, []string{"1", "2"}, ids)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestGormRepository_Each(t *testing.T) {
+	db, mock, err := sqlmock.New() // mock sql.DB
+	assert.Nil(t, err)
+	defer db.Close()
+	gdb, err := gorm.Open(dialector(db)) // open gorm db
+	assert.Nil(t, err)
+	users := NewTypedRepository[User](NewGormRepository(gdb))
+	func() {
+		mock.ExpectQuery("^SELECT \\* FROM `users`$").
+			WillReturnRows(sqlmock.NewRows([]string{"id", "name"}).
+				AddRow("1", "a").
+				AddRow("2", "b").
+				AddRow("3", "c"))
+	}()
+	chunks := [][]User{}
+	err = users.Each(context.Background(), 2, func(ctx context.Context, ms []User) error {
+		chunks = append(chunks, ms)
+		return nil
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, [][]User{
+		{{ID: "1", Name: "a"}, {ID: "2", Name: "b"}},
+		{{ID: "3", Name: "c"}},
+	}, chunks)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestGormRepository_EachCanceled(t *testing.T) {
+	db, mock, err := sqlmock.New() // mock sql.DB
+	assert.Nil(t, err)
+	defer db.Close()
+	gdb, err := gorm.Open(dialector(db)) // open gorm db
+	assert.Nil(t, err)
+	repo := NewGormRepository(gdb)
+	func() {
+		mock.ExpectQuery("^SELECT \\* FROM `users`$").
+			WillReturnRows(sqlmock.NewRows([]string{"id", "name"}).
+				AddRow("1", "a").
+				AddRow("2", "b").
+				AddRow("3", "c"))
+	}()
+	ctx, cancel := context.WithCancel(context.Background())
+	var users []User
+	calls := 0
+	err = repo.Each(ctx, &users, 1, func(ctx context.Context) error {
+		calls++
+		cancel()
+		return nil
+	})
+	assert.ErrorIs(t, err, ErrCanceled)
+	assert.Equal(t, 1, calls)
+}
@@ -0,0 +1,589 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrShardKeyRequired = errors.New("shard key required")
+)
+
+type shardKey struct{}
+
+// WithShardKey derive a ctx whose operations go to the shard of key, unless the model or the
+// match condition of the operation carries the shard key itself. Transaction requires it
+func WithShardKey(ctx context.Context, key interface{}) context.Context {
+	return context.WithValue(ctx, shardKey{}, key)
+}
+
+// ShardingOptions options of the sharded repository
+type ShardingOptions struct {
+	// Locate the index of the shard which the records of key go to
+	Locate func(key interface{}, shards int) int
+}
+
+type ShardingOption func(*ShardingOptions)
+
+// ShardBy set how the shard of a key is located, the integer keys are located by modulo and
+// the others by the fnv hash of them if it's not given
+func ShardBy(locate func(key interface{}, shards int) int) ShardingOption {
+	return func(opts *ShardingOptions) { opts.Locate = locate }
+}
+
+type shardedRepository struct {
+	key    string
+	shards []Repository
+	opts   ShardingOptions
+}
+
+// NewShardedRepository a Repository over shards, routing every operation by the column key.
+// the shard key is taken from the model when writing, and from the EQ or IN match on key when
+// querying. queries without the shard key are scattered to all shards and the results are merged
+// following the sort, limit and offset of the match condition. the records deleted, restored or
+// updated by their primary keys go to the shards of their own keys, since the shards have the same
+// ids of different records. records of different shards are never written in one transaction
+// usage:
+//   // a shard a database
+//   orders := NewShardedRepository("tenant_id", []Repository{NewGormRepository(db0), NewGormRepository(db1)})
+//   // or a shard a table
+//   orders := NewShardedRepository("tenant_id", []Repository{
+//       NewGormRepository(db, TableSuffix("_0")),
+//       NewGormRepository(db, TableSuffix("_1")),
+//   })
+//   err := orders.Find(ctx, &list, TenantID(1), Limit(20))
+func NewShardedRepository(key string, shards []Repository, opts ...ShardingOption) Repository {
+	repo := &shardedRepository{key: key, shards: shards}
+	for _, apply := range opts {
+		apply(&repo.opts)
+	}
+	if repo.opts.Locate == nil {
+		repo.opts.Locate = locateShard
+	}
+	return repo
+}
+
+func locateShard(key interface{}, shards int) int {
+	v := reflect.Indirect(reflect.ValueOf(key))
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n := v.Int() % int64(shards)
+		if n < 0 {
+			n += int64(shards)
+		}
+		return int(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return int(v.Uint() % uint64(shards))
+	}
+	h := fnv.New32a()
+	h.Write([]byte(fmt.Sprint(key)))
+	return int(h.Sum32() % uint32(shards))
+}
+
+func (repo *shardedRepository) shard(key interface{}) Repository {
+	return repo.shards[repo.opts.Locate(key, len(repo.shards))]
+}
+
+// isKey whether field is the shard key, qualified by the table or not
+func (repo *shardedRepository) isKey(field string) bool {
+	return lastSegment(field) == lastSegment(repo.key)
+}
+
+// locate the shards the match condition goes to, all shards if the shard key is not matched
+func (repo *shardedRepository) locate(ctx context.Context, opt *MatchOptions) []Repository {
+	for _, item := range opt.Matches {
+		if !repo.isKey(item.Field) || item.Path != "" {
+			continue
+		}
+		if _, ok := item.Value.(Field); ok {
+			continue
+		}
+		switch item.Operator {
+		case EQ:
+			return []Repository{repo.shard(item.Value)}
+		case IN:
+			values := reflect.ValueOf(item.Value)
+			if values.Kind() != reflect.Slice && values.Kind() != reflect.Array {
+				continue
+			}
+			seen := map[int]bool{}
+			shards := []Repository{}
+			for i := 0; i < values.Len(); i++ {
+				idx := repo.opts.Locate(values.Index(i).Interface(), len(repo.shards))
+				if !seen[idx] {
+					seen[idx] = true
+					shards = append(shards, repo.shards[idx])
+				}
+			}
+			return shards
+		}
+	}
+	if key := ctx.Value(shardKey{}); key != nil {
+		return []Repository{repo.shard(key)}
+	}
+	return repo.shards
+}
+
+// keyOf the shard key of the record v
+func (repo *shardedRepository) keyOf(ctx context.Context, v reflect.Value) (interface{}, error) {
+	if fv, ok := fieldByColumn(v, repo.key); ok {
+		return fv.Interface(), nil
+	}
+	if key := ctx.Value(shardKey{}); key != nil {
+		return key, nil
+	}
+	return nil, ErrShardKeyRequired
+}
+
+// scatter run do on every shard concurrently and return the first error
+func scatter(shards []Repository, do func(i int, shard Repository) error) error {
+	if len(shards) == 1 {
+		return do(0, shards[0])
+	}
+	errs := make([]error, len(shards))
+	var wg sync.WaitGroup
+	for i, shard := range shards {
+		wg.Add(1)
+		go func(i int, shard Repository) {
+			defer wg.Done()
+			errs[i] = do(i, shard)
+		}(i, shard)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// write run do on the shard of the record v, or on the shard of every group of the records if v is a slice.
+// the records written are copied back to v, so that the ids generated are seen
+func (repo *shardedRepository) write(ctx context.Context, v interface{}, do func(shard Repository, v interface{}) error) error {
+	rv := reflect.ValueOf(v)
+	elems := reflect.Indirect(rv)
+	if elems.Kind() != reflect.Slice && elems.Kind() != reflect.Array {
+		key, err := repo.keyOf(ctx, rv)
+		if err != nil {
+			return err
+		}
+		return do(repo.shard(key), v)
+	}
+	groups := map[Repository][]int{}
+	shards := []Repository{}
+	for i := 0; i < elems.Len(); i++ {
+		key, err := repo.keyOf(ctx, elems.Index(i))
+		if err != nil {
+			return err
+		}
+		shard := repo.shard(key)
+		if _, ok := groups[shard]; !ok {
+			shards = append(shards, shard)
+		}
+		groups[shard] = append(groups[shard], i)
+	}
+	return scatter(shards, func(_ int, shard Repository) error {
+		indexes := groups[shard]
+		group := reflect.New(reflect.SliceOf(elems.Type().Elem()))
+		for _, i := range indexes {
+			group.Elem().Set(reflect.Append(group.Elem(), elems.Index(i)))
+		}
+		if err := do(shard, group.Interface()); err != nil {
+			return err
+		}
+		for j, i := range indexes {
+			elems.Index(i).Set(group.Elem().Index(j))
+		}
+		return nil
+	})
+}
+
+// identified whether v is a record whose primary key is set, or a slice of records, which the writes
+// matching by the primary keys go to the shards of their own keys. the primary keys of the shards overlap,
+// so these writes are never scattered
+func identified(v interface{}) bool {
+	if _, ok := v.(*Model); ok {
+		return false
+	}
+	rv := reflect.Indirect(reflect.ValueOf(v))
+	if rv.Kind() == reflect.Slice || rv.Kind() == reflect.Array {
+		return rv.Len() > 0
+	}
+	pk, ok := primaryKeyColumn(reflect.TypeOf(v))
+	if !ok {
+		return false
+	}
+	id, ok := fieldByColumn(rv, pk)
+	return ok && !id.IsZero()
+}
+
+// writeMatched run do on the shards of the records v if they're identified, otherwise on the shards the match
+// condition goes to
+func (repo *shardedRepository) writeMatched(ctx context.Context, v interface{}, opts []MatchOption, do func(shard Repository, v interface{}) error) error {
+	if identified(v) {
+		return repo.write(ctx, v, do)
+	}
+	opt := &MatchOptions{}
+	opt.Apply(opts...)
+	return scatter(repo.locate(ctx, opt), func(_ int, shard Repository) error {
+		return do(shard, v)
+	})
+}
+
+// resultOf a new result like v for a shard to fetch into, and the value the result is fetched in
+func resultOf(v interface{}) (interface{}, reflect.Value) {
+	if m, ok := v.(*Model); ok {
+		target := reflect.New(reflect.TypeOf(m.Result).Elem())
+		model := *m
+		model.Result = target.Interface()
+		return &model, target
+	}
+	target := reflect.New(reflect.TypeOf(v).Elem())
+	return target.Interface(), target
+}
+
+func (repo *shardedRepository) First(ctx context.Context, v interface{}, opts ...MatchOption) error {
+	opt := &MatchOptions{}
+	opt.Apply(opts...)
+	shards := repo.locate(ctx, opt)
+	if len(shards) == 1 {
+		return shards[0].First(ctx, v, opts...)
+	}
+	found := make([]reflect.Value, len(shards))
+	err := scatter(shards, func(i int, shard Repository) error {
+		result, target := resultOf(v)
+		if err := shard.First(ctx, result, opts...); err != nil {
+			if isNotFound(err) {
+				return nil
+			}
+			return err
+		}
+		found[i] = target.Elem()
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	// the first of a shard is ordered by the primary key if no sort is given, so are the firsts of the shards
+	sortBy := opt.Sort
+	var first reflect.Value
+	for _, f := range found {
+		if !f.IsValid() {
+			continue
+		}
+		if len(sortBy) == 0 {
+			if pk, ok := primaryKeyColumn(f.Type()); ok {
+				sortBy = []string{pk}
+			}
+		}
+		if !first.IsValid() || lessBySort(f, first, sortBy) {
+			first = f
+		}
+	}
+	if !first.IsValid() {
+		return ErrRecordNotFound
+	}
+	target := reflect.ValueOf(v)
+	if m, ok := v.(*Model); ok {
+		target = reflect.ValueOf(m.Result)
+	}
+	target.Elem().Set(first)
+	return nil
+}
+
+func (repo *shardedRepository) Find(ctx context.Context, v interface{}, opts ...MatchOption) error {
+	opt := &MatchOptions{}
+	opt.Apply(opts...)
+	shards := repo.locate(ctx, opt)
+	if len(shards) == 1 {
+		return shards[0].Find(ctx, v, opts...)
+	}
+	// every shard fetches the records up to offset+limit, the page is cut after merged
+	shardOpt := *opt
+	shardOpt.Offset = nil
+	if opt.Limit != nil {
+		limit := *opt.Limit
+		if opt.Offset != nil {
+			limit += *opt.Offset
+		}
+		shardOpt.Limit = &limit
+	}
+	found := make([]reflect.Value, len(shards))
+	err := scatter(shards, func(i int, shard Repository) error {
+		result, target := resultOf(v)
+		if err := shard.Find(ctx, result, shardOpt.Option()); err != nil {
+			return err
+		}
+		found[i] = target.Elem()
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	target := reflect.ValueOf(v)
+	if m, ok := v.(*Model); ok {
+		target = reflect.ValueOf(m.Result)
+	}
+	merged := reflect.MakeSlice(target.Elem().Type(), 0, 0)
+	for _, f := range found {
+		merged = reflect.AppendSlice(merged, f)
+	}
+	if len(opt.Sort) > 0 {
+		sort.SliceStable(merged.Interface(), func(i, j int) bool {
+			return lessBySort(merged.Index(i), merged.Index(j), opt.Sort)
+		})
+	}
+	start, end := 0, merged.Len()
+	if opt.Offset != nil {
+		start = *opt.Offset
+		if start > end {
+			start = end
+		}
+	}
+	if opt.Limit != nil && start+*opt.Limit < end {
+		end = start + *opt.Limit
+	}
+	target.Elem().Set(merged.Slice(start, end))
+	return nil
+}
+
+func (repo *shardedRepository) Count(ctx context.Context, v interface{}, count *int64, opts ...MatchOption) error {
+	opt := &MatchOptions{}
+	opt.Apply(opts...)
+	shards := repo.locate(ctx, opt)
+	counts := make([]int64, len(shards))
+	err := scatter(shards, func(i int, shard Repository) error {
+		return shard.Count(ctx, v, &counts[i], opts...)
+	})
+	if err != nil {
+		return err
+	}
+	*count = 0
+	for _, c := range counts {
+		*count += c
+	}
+	return nil
+}
+
+func (repo *shardedRepository) Paginate(ctx context.Context, v interface{}, page *Page, opts ...MatchOption) error {
+	return paginate(ctx, repo, v, page, opts...)
+}
+
+// Rows the rows of the shards one after another, the records are sorted within a shard only
+func (repo *shardedRepository) Rows(ctx context.Context, v interface{}, opts ...MatchOption) (Rows, error) {
+	opt := &MatchOptions{}
+	opt.Apply(opts...)
+	shards := repo.locate(ctx, opt)
+	if len(shards) == 1 {
+		return shards[0].Rows(ctx, v, opts...)
+	}
+	return &shardedRows{ctx: ctx, v: v, opts: opts, shards: shards}, nil
+}
+
+func (repo *shardedRepository) Each(ctx context.Context, v interface{}, size int, do func(ctx context.Context) error, opts ...MatchOption) error {
+	return each(ctx, repo, v, size, do, opts...)
+}
+
+func (repo *shardedRepository) Update(ctx context.Context, v interface{}) error {
+	return repo.write(ctx, v, func(shard Repository, v interface{}) error {
+		return shard.Update(ctx, v)
+	})
+}
+
+func (repo *shardedRepository) Delete(ctx context.Context, v interface{}, opts ...MatchOption) error {
+	return repo.writeMatched(ctx, v, opts, func(shard Repository, v interface{}) error {
+		return shard.Delete(ctx, v, opts...)
+	})
+}
+
+func (repo *shardedRepository) Restore(ctx context.Context, v interface{}, opts ...MatchOption) error {
+	return repo.writeMatched(ctx, v, opts, func(shard Repository, v interface{}) error {
+		return shard.Restore(ctx, v, opts...)
+	})
+}
+
+func (repo *shardedRepository) ForceDelete(ctx context.Context, v interface{}, opts ...MatchOption) error {
+	return repo.writeMatched(ctx, v, opts, func(shard Repository, v interface{}) error {
+		return shard.ForceDelete(ctx, v, opts...)
+	})
+}
+
+func (repo *shardedRepository) Create(ctx context.Context, v interface{}) error {
+	return repo.write(ctx, v, func(shard Repository, v interface{}) error {
+		return shard.Create(ctx, v)
+	})
+}
+
+func (repo *shardedRepository) UpdateFields(ctx context.Context, v interface{}, fields Fields, opts ...MatchOption) error {
+	return repo.writeMatched(ctx, v, opts, func(shard Repository, v interface{}) error {
+		return shard.UpdateFields(ctx, v, fields, opts...)
+	})
+}
+
+func (repo *shardedRepository) CreateInBatches(ctx context.Context, v interface{}, batchSize int) error {
+	return repo.write(ctx, v, func(shard Repository, v interface{}) error {
+		return shard.CreateInBatches(ctx, v, batchSize)
+	})
+}
+
+func (repo *shardedRepository) Upsert(ctx context.Context, v interface{}, conflict []string, update ...string) error {
+	return repo.write(ctx, v, func(shard Repository, v interface{}) error {
+		return shard.Upsert(ctx, v, conflict, update...)
+	})
+}
+
+// BulkUpdateFields the rows are keyed by the primary key, which the shards overlap in, so they go to the shard
+// of the key carried by ctx, see WithShardKey
+func (repo *shardedRepository) BulkUpdateFields(ctx context.Context, v interface{}, rows map[interface{}]Fields) error {
+	key := ctx.Value(shardKey{})
+	if key == nil {
+		return fmt.Errorf("%w: bulk update fields %T", ErrShardKeyRequired, v)
+	}
+	return repo.shard(key).BulkUpdateFields(ctx, v, rows)
+}
+
+// Transaction run do in a transaction of the shard of the key carried by ctx, see WithShardKey
+func (repo *shardedRepository) Transaction(ctx context.Context, do func(ctx context.Context, repo Repository) error, opts ...TxOption) error {
+	key := ctx.Value(shardKey{})
+	if key == nil {
+		return ErrShardKeyRequired
+	}
+	return repo.shard(key).Transaction(ctx, do, opts...)
+}
+
+// shardedRows read the rows of the shards one after another
+type shardedRows struct {
+	ctx    context.Context
+	v      interface{}
+	opts   []MatchOption
+	shards []Repository
+	rows   Rows
+	err    error
+}
+
+func (r *shardedRows) Next() bool {
+	for r.err == nil {
+		if r.rows != nil && r.rows.Next() {
+			return true
+		}
+		if r.rows != nil {
+			if r.err = r.rows.Err(); r.err != nil {
+				return false
+			}
+			r.rows.Close()
+			r.rows = nil
+		}
+		if len(r.shards) == 0 {
+			return false
+		}
+		r.rows, r.err = r.shards[0].Rows(r.ctx, r.v, r.opts...)
+		r.shards = r.shards[1:]
+	}
+	return false
+}
+
+func (r *shardedRows) Scan(dest interface{}) error {
+	if r.rows == nil {
+		return errors.New("scan: no current row")
+	}
+	return r.rows.Scan(dest)
+}
+
+func (r *shardedRows) Err() error {
+	return r.err
+}
+
+func (r *shardedRows) Close() error {
+	r.shards = nil
+	if r.rows == nil {
+		return nil
+	}
+	defer func() { r.rows = nil }()
+	return r.rows.Close()
+}
+
+// lessBySort whether the record a is ordered before b following sort
+func lessBySort(a, b reflect.Value, sort []string) bool {
+	for _, spec := range sort {
+		column, desc, err := ParseSort(spec)
+		if err != nil {
+			return false
+		}
+		if _, _, col, ok := Aggregate(column); ok {
+			column = col
+		}
+		av, aok := fieldByColumn(a, column)
+		bv, bok := fieldByColumn(b, column)
+		if !aok || !bok {
+			continue
+		}
+		if c := compareValues(av, bv); c != 0 {
+			return (c < 0) != desc
+		}
+	}
+	return false
+}
+
+// compareValues compare the values of the same type, nils are ordered first
+func compareValues(a, b reflect.Value) int {
+	for a.Kind() == reflect.Ptr || a.Kind() == reflect.Interface {
+		if a.IsNil() || b.IsNil() {
+			switch {
+			case a.IsNil() && b.IsNil():
+				return 0
+			case a.IsNil():
+				return -1
+			}
+			return 1
+		}
+		a, b = a.Elem(), b.Elem()
+	}
+	if at, ok := a.Interface().(time.Time); ok {
+		bt := b.Interface().(time.Time)
+		switch {
+		case at.Before(bt):
+			return -1
+		case at.After(bt):
+			return 1
+		}
+		return 0
+	}
+	switch a.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return compareOrdered(a.Int(), b.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return compareOrdered(a.Uint(), b.Uint())
+	case reflect.Float32, reflect.Float64:
+		return compareOrdered(a.Float(), b.Float())
+	case reflect.String:
+		return strings.Compare(a.String(), b.String())
+	case reflect.Bool:
+		return compareOrdered(boolInt(a.Bool()), boolInt(b.Bool()))
+	}
+	return strings.Compare(fmt.Sprint(a.Interface()), fmt.Sprint(b.Interface()))
+}
+
+func compareOrdered[T int | int64 | uint64 | float64](a, b T) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+func boolInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
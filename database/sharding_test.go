@@ -0,0 +1,167 @@
+package database
+
+import (
+	"context"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+)
+
+type Order struct {
+	ID       int64
+	TenantID int64
+	Amount   int
+}
+
+func TestShardedRepository_Find(t *testing.T) {
+	db0, mock0, gdb0 := mockDB(t)
+	defer db0.Close()
+	db1, mock1, gdb1 := mockDB(t)
+	defer db1.Close()
+	repo := NewShardedRepository("tenant_id", []Repository{NewGormRepository(gdb0), NewGormRepository(gdb1)})
+	func() {
+		mock1.ExpectQuery("^SELECT \\* FROM `orders` WHERE `tenant_id` = \\?$").
+			WithArgs(3).
+			WillReturnRows(sqlmock.NewRows([]string{"id", "tenant_id", "amount"}).AddRow(1, 3, 10))
+		execSql := "^SELECT \\* FROM `orders` WHERE `amount` > \\? ORDER BY `amount` DESC LIMIT 3$"
+		mock0.ExpectQuery(execSql).
+			WithArgs(5).
+			WillReturnRows(sqlmock.NewRows([]string{"id", "tenant_id", "amount"}).
+				AddRow(2, 2, 30).
+				AddRow(3, 4, 20))
+		mock1.ExpectQuery(execSql).
+			WithArgs(5).
+			WillReturnRows(sqlmock.NewRows([]string{"id", "tenant_id", "amount"}).
+				AddRow(4, 1, 40).
+				AddRow(5, 3, 10))
+	}()
+	var orders []Order
+	err := repo.Find(context.Background(), &orders, func(opts *MatchOptions) { opts.EQ("tenant_id", 3) })
+	assert.Nil(t, err)
+	assert.Equal(t, []Order{{ID: 1, TenantID: 3, Amount: 10}}, orders)
+
+	err = repo.Find(context.Background(), &orders, func(opts *MatchOptions) {
+		opts.GT("amount", 5).SetSort("-amount").SetLimit(2).SetOffset(1)
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, []Order{{ID: 2, TenantID: 2, Amount: 30}, {ID: 3, TenantID: 4, Amount: 20}}, orders)
+	assert.Nil(t, mock0.ExpectationsWereMet())
+	assert.Nil(t, mock1.ExpectationsWereMet())
+}
+
+func TestShardedRepository_FirstAndCount(t *testing.T) {
+	db0, mock0, gdb0 := mockDB(t)
+	defer db0.Close()
+	db1, mock1, gdb1 := mockDB(t)
+	defer db1.Close()
+	repo := NewShardedRepository("tenant_id", []Repository{NewGormRepository(gdb0), NewGormRepository(gdb1)})
+	func() {
+		execSql := "^SELECT \\* FROM `orders` ORDER BY `amount`,`orders`\\.`id` LIMIT 1$"
+		mock0.ExpectQuery(execSql).
+			WillReturnRows(sqlmock.NewRows([]string{"id", "tenant_id", "amount"}))
+		mock1.ExpectQuery(execSql).
+			WillReturnRows(sqlmock.NewRows([]string{"id", "tenant_id", "amount"}).AddRow(5, 3, 10))
+		mock0.ExpectQuery("^SELECT count\\(\\*\\) FROM `orders`$").WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(2))
+		mock1.ExpectQuery("^SELECT count\\(\\*\\) FROM `orders`$").WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(3))
+	}()
+	var order Order
+	err := repo.First(context.Background(), &order, func(opts *MatchOptions) { opts.SetSort("amount") })
+	assert.Nil(t, err)
+	assert.Equal(t, Order{ID: 5, TenantID: 3, Amount: 10}, order)
+
+	var count int64
+	assert.Nil(t, repo.Count(context.Background(), &Order{}, &count))
+	assert.Equal(t, int64(5), count)
+
+	// the lowest primary key of the shards without a sort
+	mock0.ExpectQuery("^SELECT \\* FROM `orders` ORDER BY `orders`\\.`id` LIMIT 1$").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "tenant_id", "amount"}).AddRow(5, 2, 10))
+	mock1.ExpectQuery("^SELECT \\* FROM `orders` ORDER BY `orders`\\.`id` LIMIT 1$").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "tenant_id", "amount"}).AddRow(3, 1, 20))
+	err = repo.First(context.Background(), &order)
+	assert.Nil(t, err)
+	assert.Equal(t, Order{ID: 3, TenantID: 1, Amount: 20}, order)
+	assert.Nil(t, mock0.ExpectationsWereMet())
+	assert.Nil(t, mock1.ExpectationsWereMet())
+}
+
+func TestShardedRepository_Create(t *testing.T) {
+	db, mock, gdb := mockDB(t)
+	defer db.Close()
+	repo := NewShardedRepository("tenant_id", []Repository{
+		NewGormRepository(gdb, TableSuffix("_0")),
+		NewGormRepository(gdb, TableSuffix("_1")),
+	})
+	func() {
+		mock.MatchExpectationsInOrder(false)
+		mock.ExpectBegin()
+		mock.ExpectExec("^INSERT INTO `orders_0` \\(`tenant_id`,`amount`\\) VALUES \\(\\?,\\?\\)$").
+			WithArgs(2, 20).
+			WillReturnResult(sqlmock.NewResult(7, 1))
+		mock.ExpectCommit()
+		mock.ExpectBegin()
+		mock.ExpectExec("^INSERT INTO `orders_1` \\(`tenant_id`,`amount`\\) VALUES \\(\\?,\\?\\),\\(\\?,\\?\\)$").
+			WithArgs(1, 10, 3, 30).
+			WillReturnResult(sqlmock.NewResult(8, 2))
+		mock.ExpectCommit()
+	}()
+	orders := []Order{{TenantID: 1, Amount: 10}, {TenantID: 2, Amount: 20}, {TenantID: 3, Amount: 30}}
+	err := repo.Create(context.Background(), &orders)
+	assert.Nil(t, err)
+	assert.Equal(t, []Order{{ID: 8, TenantID: 1, Amount: 10}, {ID: 7, TenantID: 2, Amount: 20}, {ID: 9, TenantID: 3, Amount: 30}}, orders)
+
+	err = repo.Transaction(context.Background(), func(ctx context.Context, repo Repository) error { return nil })
+	assert.ErrorIs(t, err, ErrShardKeyRequired)
+	// a nil record has no shard key
+	err = repo.CreateInBatches(context.Background(), []*Order{{TenantID: 1}, nil}, 10)
+	assert.ErrorIs(t, err, ErrShardKeyRequired)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestShardedRepository_WriteByRecord(t *testing.T) {
+	db0, mock0, gdb0 := mockDB(t)
+	defer db0.Close()
+	db1, mock1, gdb1 := mockDB(t)
+	defer db1.Close()
+	repo := NewShardedRepository("tenant_id", []Repository{NewGormRepository(gdb0), NewGormRepository(gdb1)})
+	// the order 1 of the tenant 3 is of the shard 1 only, the shard 0 has another order 1
+	func() {
+		mock1.ExpectBegin()
+		mock1.ExpectExec("^DELETE FROM `orders` WHERE `orders`\\.`id` = \\?$").
+			WithArgs(1).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		mock1.ExpectCommit()
+		mock1.ExpectBegin()
+		mock1.ExpectExec("^UPDATE `orders` SET `amount`=\\? WHERE `id` = \\?$").
+			WithArgs(5, 1).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		mock1.ExpectCommit()
+	}()
+	ctx := context.Background()
+	assert.Nil(t, repo.Delete(ctx, &Order{ID: 1, TenantID: 3}))
+	assert.Nil(t, repo.UpdateFields(ctx, &Order{ID: 1, TenantID: 3}, Fields{"amount": 5}))
+	assert.Nil(t, mock0.ExpectationsWereMet())
+	assert.Nil(t, mock1.ExpectationsWereMet())
+
+	// the bare model with a condition goes to every shard
+	for _, mock := range []sqlmock.Sqlmock{mock0, mock1} {
+		mock.ExpectBegin()
+		mock.ExpectExec("^UPDATE `orders` SET `amount`=\\? WHERE `amount` > \\?$").
+			WithArgs(0, 100).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectCommit()
+	}
+	assert.Nil(t, repo.UpdateFields(ctx, &Order{}, Fields{"amount": 0}, func(opts *MatchOptions) { opts.GT("amount", 100) }))
+
+	rows := map[interface{}]Fields{int64(1): {"amount": 5}}
+	assert.ErrorIs(t, repo.BulkUpdateFields(ctx, &Order{}, rows), ErrShardKeyRequired)
+	mock0.ExpectBegin()
+	mock0.ExpectExec("^UPDATE `orders` SET `amount`=CASE `id` WHEN \\? THEN \\? ELSE `amount` END WHERE `id` IN \\(\\?\\)$").
+		WithArgs(int64(1), 5, int64(1)).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock0.ExpectCommit()
+	assert.Nil(t, repo.BulkUpdateFields(WithShardKey(ctx, 2), &Order{}, rows))
+	assert.Nil(t, mock0.ExpectationsWereMet())
+	assert.Nil(t, mock1.ExpectationsWereMet())
+}
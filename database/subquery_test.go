@@ -0,0 +1,102 @@
+package database
+
+import (
+	"context"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGormRepository_SubqueryIN(t *testing.T) {
+	db, mock, gdb := mockDB(t)
+	defer db.Close()
+	repo := NewGormRepository(gdb)
+	func() {
+		execSql := "^SELECT \\* FROM `users` WHERE `name` != \\? AND `id` IN \\(SELECT `author_id` FROM `books` WHERE `name` LIKE \\?\\)$"
+		mock.ExpectQuery(execSql).
+			WithArgs("nobody", "go%").
+			WillReturnRows(sqlmock.NewRows([]string{"id", "name"}).AddRow("1", "a"))
+	}()
+	var users []User
+	err := repo.Find(context.Background(), &users, func(opts *MatchOptions) {
+		opts.NEQ("name", "nobody").IN("id", M(nil, &Book{}).Where(func(opts *MatchOptions) {
+			opts.StartsWith("name", "go").SetSelect("author_id")
+		}))
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, []User{{ID: "1", Name: "a"}}, users)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestGormRepository_SubqueryExists(t *testing.T) {
+	db, mock, gdb := mockDB(t)
+	defer db.Close()
+	repo := NewGormRepository(gdb)
+	func() {
+		execSql := "^SELECT \\* FROM `users` WHERE NOT EXISTS \\(SELECT `books`\\.`id` FROM `books` WHERE `books`\\.`author_id` = `users`\\.`id` AND `books`\\.`name` = \\?\\)$"
+		mock.ExpectQuery(execSql).
+			WithArgs("go").
+			WillReturnRows(sqlmock.NewRows([]string{"id", "name"}))
+	}()
+	var users []User
+	err := repo.Find(context.Background(), &users, func(opts *MatchOptions) {
+		opts.NotExists(M(nil, &Book{}).Where(func(opts *MatchOptions) {
+			opts.EQ("books.author_id", Field("users.id")).EQ("books.name", "go").SetSelect("books.id")
+		}))
+	})
+	assert.Nil(t, err)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestGormRepository_SubqueryJoin(t *testing.T) {
+	db, mock, gdb := mockDB(t)
+	defer db.Close()
+	repo := NewGormRepository(gdb)
+	func() {
+		execSql := "^SELECT users\\.id AS id,users\\.name AS name,b\\.count AS books FROM `users` " +
+			"LEFT JOIN \\(SELECT `author_id`,COUNT\\(\\*\\) AS `count` FROM `books` WHERE `name` != \\? GROUP BY `author_id`\\) AS `b` ON `b`\\.`author_id` = `users`\\.`id` " +
+			"WHERE `users`\\.`name` = \\?$"
+		mock.ExpectQuery(execSql).
+			WithArgs("", "a").
+			WillReturnRows(sqlmock.NewRows([]string{"id", "name", "books"}).AddRow("1", "a", 2))
+	}()
+	var users []struct {
+		ID    string `field:"users.id"`
+		Name  string `field:"users.name"`
+		Books int    `field:"b.count"`
+	}
+	books := M(nil, &Book{}).
+		Where(func(opts *MatchOptions) { opts.NEQ("name", "") }).
+		GroupBy("author_id").
+		Aggregate(Count("*")).
+		As("b")
+	m := M(&users, &User{}).With(books, func(opts *MatchOptions) { opts.EQ("b.author_id", Field("users.id")) })
+	err := repo.Find(context.Background(), m, func(opts *MatchOptions) { opts.EQ("users.name", "a") })
+	assert.Nil(t, err)
+	assert.Len(t, users, 1)
+	assert.Equal(t, 2, users[0].Books)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestGormRepository_UnionAll(t *testing.T) {
+	db, mock, gdb := mockDB(t)
+	defer db.Close()
+	repo := NewGormRepository(gdb)
+	func() {
+		execSql := "^SELECT \\* FROM \\(\\(SELECT \\* FROM `books` WHERE `author_id` = \\?\\) UNION ALL \\(SELECT \\* FROM `books` WHERE `name` LIKE \\?\\)\\) AS `u` ORDER BY `name` LIMIT 10$"
+		mock.ExpectQuery(execSql).
+			WithArgs("1", "%go%").
+			WillReturnRows(sqlmock.NewRows([]string{"id", "name", "author_id"}).
+				AddRow("1", "book1", "1").
+				AddRow("2", "go", "2"))
+	}()
+	var books []Book
+	m := M(&books, &Book{}).
+		Where(func(opts *MatchOptions) { opts.EQ("author_id", "1") }).
+		UnionAll(M(nil, &Book{}).Where(func(opts *MatchOptions) { opts.Contains("name", "go") }))
+	err := repo.Find(context.Background(), m, func(opts *MatchOptions) { opts.SetSort("name").SetLimit(10) })
+	assert.Nil(t, err)
+	assert.Len(t, books, 2)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
@@ -0,0 +1,357 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+)
+
+// DefaultTenantColumn the column of the tenant if TenantColumn is not given
+const DefaultTenantColumn = "tenant_id"
+
+var (
+	ErrTenantRequired = errors.New("tenant required")
+	ErrTenantMismatch = errors.New("tenant mismatch")
+)
+
+type tenantKey struct{}
+
+type tenantBypassKey struct{}
+
+// WithTenant derive a ctx whose operations are scoped to tenant
+//   ctx = database.WithTenant(r.Context(), claims.TenantID)
+func WithTenant(ctx context.Context, tenant interface{}) context.Context {
+	return context.WithValue(ctx, tenantKey{}, tenant)
+}
+
+// TenantOf the tenant carried by ctx
+func TenantOf(ctx context.Context) (interface{}, bool) {
+	tenant := ctx.Value(tenantKey{})
+	return tenant, tenant != nil
+}
+
+// WithoutTenant derive a ctx whose operations are not scoped to any tenant, for the jobs across tenants
+func WithoutTenant(ctx context.Context) context.Context {
+	return context.WithValue(ctx, tenantBypassKey{}, true)
+}
+
+func tenantBypassed(ctx context.Context) bool {
+	bypassed, _ := ctx.Value(tenantBypassKey{}).(bool)
+	return bypassed
+}
+
+// TenantOptions options of the tenant scoped repository
+type TenantOptions struct {
+	// Column the column of the tenant
+	Column string
+}
+
+type TenantOption func(*TenantOptions)
+
+// TenantColumn set the column of the tenant
+func TenantColumn(column string) TenantOption {
+	return func(opts *TenantOptions) { opts.Column = column }
+}
+
+type tenantRepository struct {
+	Repository
+	opts TenantOptions
+}
+
+// NewTenantRepository scope every operation of repo to the tenant of the ctx. the reads, updates and deletes
+// match the tenant column, the records created get the tenant set, and the records updated must be of the
+// tenant. the operations with a ctx carrying no tenant are refused with ErrTenantRequired, unless the ctx
+// is derived by WithoutTenant. so are the queries reading the tables the tenant match doesn't cover,
+// which are the joins, the unions and the subqueries
+// usage:
+//   repo := NewTenantRepository(NewGormRepository(db))
+//   err := repo.Find(database.WithTenant(ctx, tenantID), &orders, Status("paid"))
+func NewTenantRepository(repo Repository, opts ...TenantOption) Repository {
+	r := &tenantRepository{Repository: repo}
+	r.opts.Column = DefaultTenantColumn
+	for _, apply := range opts {
+		apply(&r.opts)
+	}
+	return r
+}
+
+// tenant the tenant of ctx, bypassed is true if the ctx is not scoped to any tenant
+func (r *tenantRepository) tenant(ctx context.Context, op string, v interface{}) (tenant interface{}, bypassed bool, err error) {
+	if tenantBypassed(ctx) {
+		return nil, true, nil
+	}
+	tenant, ok := TenantOf(ctx)
+	if !ok {
+		return nil, false, fmt.Errorf("%w: %s %T", ErrTenantRequired, op, v)
+	}
+	return tenant, false, nil
+}
+
+// scope append the match on the tenant of ctx to opts
+func (r *tenantRepository) scope(ctx context.Context, op string, v interface{}, opts []MatchOption) ([]MatchOption, error) {
+	tenant, bypassed, err := r.tenant(ctx, op, v)
+	if err != nil || bypassed {
+		return opts, err
+	}
+	if shape := unscoped(v, opts); shape != "" {
+		return nil, fmt.Errorf("%w: %s %T with %s, which the tenant is not matched in", ErrTenantRequired, op, v, shape)
+	}
+	column := r.opts.Column
+	if m, ok := v.(*Model); ok && m.Alias != "" {
+		column = m.Alias + "." + column
+	}
+	return append(append([]MatchOption{}, opts...), func(opts *MatchOptions) { opts.EQ(column, tenant) }), nil
+}
+
+// unscoped the shape of the query of model v matched by opts that reads records not scoped by the tenant match,
+// empty if there's none
+func unscoped(v interface{}, opts []MatchOption) string {
+	opt := &MatchOptions{}
+	opt.Apply(opts...)
+	if hasTenantSubquery(opt.Matches) {
+		return "subquery"
+	}
+	m, ok := v.(*Model)
+	if !ok {
+		return ""
+	}
+	switch {
+	case len(m.Joins) > 0:
+		return "join"
+	case len(m.Unions) > 0:
+		return "union"
+	case hasTenantSubquery(m.Opts.Matches):
+		return "subquery"
+	case m.Grp != nil && m.Grp.Having != nil && hasTenantSubquery(m.Grp.Having.Matches):
+		return "subquery"
+	}
+	return ""
+}
+
+// hasTenantSubquery whether any of items, or of the groups of items, is matched with a subquery
+func hasTenantSubquery(items []MatchItem) bool {
+	for _, item := range items {
+		switch value := item.Value.(type) {
+		case Subquery:
+			return true
+		case MatchOptions:
+			if hasTenantSubquery(value.Matches) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// assign set the tenant of ctx to the record, or the records of the slice, v. the records of other tenants are refused
+func (r *tenantRepository) assign(ctx context.Context, op string, v interface{}) error {
+	tenant, bypassed, err := r.tenant(ctx, op, v)
+	if err != nil || bypassed {
+		return err
+	}
+	value := reflect.ValueOf(v)
+	for value.Kind() == reflect.Ptr {
+		value = value.Elem()
+	}
+	if value.Kind() != reflect.Slice && value.Kind() != reflect.Array {
+		return r.assignOne(value, tenant)
+	}
+	for i := 0; i < value.Len(); i++ {
+		if err := r.assignOne(value.Index(i), tenant); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *tenantRepository) assignOne(record reflect.Value, tenant interface{}) error {
+	field, ok := fieldByColumn(record, r.opts.Column)
+	if !ok || !field.CanSet() {
+		return fmt.Errorf("%w: %s has no settable field of %s", ErrTenantRequired, record.Type(), r.opts.Column)
+	}
+	if !field.IsZero() {
+		if fmt.Sprint(field.Interface()) != fmt.Sprint(tenant) {
+			return fmt.Errorf("%w: %s of tenant %v", ErrTenantMismatch, record.Type(), field.Interface())
+		}
+		return nil
+	}
+	value := reflect.ValueOf(tenant)
+	// an integer is convertible to a string as a rune, which is never the tenant meant
+	if !value.Type().ConvertibleTo(field.Type()) || (field.Kind() == reflect.String) != (value.Kind() == reflect.String) {
+		return fmt.Errorf("%w: tenant %v can't be set to %s", ErrTenantMismatch, tenant, field.Type())
+	}
+	field.Set(value.Convert(field.Type()))
+	return nil
+}
+
+// owned check the records of model v whose primary keys are ids are all of the tenant of ctx
+func (r *tenantRepository) owned(ctx context.Context, op string, v interface{}, ids ...interface{}) error {
+	pk, ok := primaryKeyColumn(reflect.TypeOf(v))
+	if !ok {
+		return fmt.Errorf("%s: %T has no primary key", op, v)
+	}
+	opts, err := r.scope(ctx, op, v, []MatchOption{func(opts *MatchOptions) { opts.IN(pk, ids) }})
+	if err != nil {
+		return err
+	}
+	var count int64
+	if err := r.Repository.Count(ctx, reflect.New(indirectType(reflect.TypeOf(v))).Interface(), &count, opts...); err != nil {
+		return err
+	}
+	if count != int64(len(ids)) {
+		return fmt.Errorf("%w: %s %T of other tenants", ErrTenantMismatch, op, v)
+	}
+	return nil
+}
+
+func (r *tenantRepository) First(ctx context.Context, v interface{}, opts ...MatchOption) error {
+	opts, err := r.scope(ctx, "first", v, opts)
+	if err != nil {
+		return err
+	}
+	return r.Repository.First(ctx, v, opts...)
+}
+
+func (r *tenantRepository) Find(ctx context.Context, v interface{}, opts ...MatchOption) error {
+	opts, err := r.scope(ctx, "find", v, opts)
+	if err != nil {
+		return err
+	}
+	return r.Repository.Find(ctx, v, opts...)
+}
+
+func (r *tenantRepository) Count(ctx context.Context, v interface{}, count *int64, opts ...MatchOption) error {
+	opts, err := r.scope(ctx, "count", v, opts)
+	if err != nil {
+		return err
+	}
+	return r.Repository.Count(ctx, v, count, opts...)
+}
+
+func (r *tenantRepository) Paginate(ctx context.Context, v interface{}, page *Page, opts ...MatchOption) error {
+	return paginate(ctx, r, v, page, opts...)
+}
+
+func (r *tenantRepository) Rows(ctx context.Context, v interface{}, opts ...MatchOption) (Rows, error) {
+	opts, err := r.scope(ctx, "rows", v, opts)
+	if err != nil {
+		return nil, err
+	}
+	return r.Repository.Rows(ctx, v, opts...)
+}
+
+func (r *tenantRepository) Each(ctx context.Context, v interface{}, size int, do func(ctx context.Context) error, opts ...MatchOption) error {
+	return each(ctx, r, v, size, do, opts...)
+}
+
+// Update the record must be of the tenant, its tenant is set if it's empty
+func (r *tenantRepository) Update(ctx context.Context, v interface{}) error {
+	if err := r.assign(ctx, "update", v); err != nil {
+		return err
+	}
+	if !tenantBypassed(ctx) {
+		pk, _ := primaryKeyColumn(reflect.TypeOf(v))
+		if id, ok := fieldByColumn(reflect.ValueOf(v), pk); ok && !id.IsZero() {
+			if err := r.owned(ctx, "update", v, id.Interface()); err != nil {
+				return err
+			}
+		}
+	}
+	return r.Repository.Update(ctx, v)
+}
+
+func (r *tenantRepository) Delete(ctx context.Context, v interface{}, opts ...MatchOption) error {
+	opts, err := r.scope(ctx, "delete", v, opts)
+	if err != nil {
+		return err
+	}
+	return r.Repository.Delete(ctx, v, opts...)
+}
+
+func (r *tenantRepository) Restore(ctx context.Context, v interface{}, opts ...MatchOption) error {
+	opts, err := r.scope(ctx, "restore", v, opts)
+	if err != nil {
+		return err
+	}
+	return r.Repository.Restore(ctx, v, opts...)
+}
+
+func (r *tenantRepository) ForceDelete(ctx context.Context, v interface{}, opts ...MatchOption) error {
+	opts, err := r.scope(ctx, "force delete", v, opts)
+	if err != nil {
+		return err
+	}
+	return r.Repository.ForceDelete(ctx, v, opts...)
+}
+
+func (r *tenantRepository) Create(ctx context.Context, v interface{}) error {
+	if err := r.assign(ctx, "create", v); err != nil {
+		return err
+	}
+	return r.Repository.Create(ctx, v)
+}
+
+// UpdateFields the tenant column can't be updated, so that no record is moved to another tenant
+func (r *tenantRepository) UpdateFields(ctx context.Context, v interface{}, fields Fields, opts ...MatchOption) error {
+	if _, ok := fields[r.opts.Column]; ok && !tenantBypassed(ctx) {
+		return fmt.Errorf("%w: update fields %s of %T", ErrTenantMismatch, r.opts.Column, v)
+	}
+	opts, err := r.scope(ctx, "update fields", v, opts)
+	if err != nil {
+		return err
+	}
+	return r.Repository.UpdateFields(ctx, v, fields, opts...)
+}
+
+func (r *tenantRepository) CreateInBatches(ctx context.Context, v interface{}, batchSize int) error {
+	if err := r.assign(ctx, "create in batches", v); err != nil {
+		return err
+	}
+	return r.Repository.CreateInBatches(ctx, v, batchSize)
+}
+
+// Upsert the unique key of conflict must include the tenant column, otherwise the records of other tenants
+// conflicting would be updated. mysql updates on the conflict of any unique key, so every unique key of the
+// model should include the tenant column there
+func (r *tenantRepository) Upsert(ctx context.Context, v interface{}, conflict []string, update ...string) error {
+	if err := r.assign(ctx, "upsert", v); err != nil {
+		return err
+	}
+	if !tenantBypassed(ctx) {
+		scoped := false
+		for _, column := range conflict {
+			scoped = scoped || column == r.opts.Column
+		}
+		if !scoped {
+			return fmt.Errorf("%w: upsert %T conflicting on %v without %s", ErrTenantMismatch, v, conflict, r.opts.Column)
+		}
+	}
+	return r.Repository.Upsert(ctx, v, conflict, update...)
+}
+
+// BulkUpdateFields the records of rows must all be of the tenant
+func (r *tenantRepository) BulkUpdateFields(ctx context.Context, v interface{}, rows map[interface{}]Fields) error {
+	if _, bypassed, err := r.tenant(ctx, "bulk update fields", v); err != nil {
+		return err
+	} else if !bypassed && len(rows) > 0 {
+		ids := make([]interface{}, 0, len(rows))
+		for id, fields := range rows {
+			if _, ok := fields[r.opts.Column]; ok {
+				return fmt.Errorf("%w: bulk update fields %s of %T", ErrTenantMismatch, r.opts.Column, v)
+			}
+			ids = append(ids, id)
+		}
+		if err := r.owned(ctx, "bulk update fields", v, ids...); err != nil {
+			return err
+		}
+	}
+	return r.Repository.BulkUpdateFields(ctx, v, rows)
+}
+
+// Transaction the repo passed to do is scoped to the tenant as well
+func (r *tenantRepository) Transaction(ctx context.Context, do func(ctx context.Context, repo Repository) error, opts ...TxOption) error {
+	return r.Repository.Transaction(ctx, func(ctx context.Context, repo Repository) error {
+		return do(ctx, &tenantRepository{Repository: repo, opts: r.opts})
+	}, opts...)
+}
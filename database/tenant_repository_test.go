@@ -0,0 +1,135 @@
+package database
+
+import (
+	"context"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTenantRepository_Scope(t *testing.T) {
+	db, mock, gdb := mockDB(t)
+	defer db.Close()
+	repo := NewTenantRepository(NewGormRepository(gdb))
+	mock.ExpectQuery("^SELECT \\* FROM `orders` WHERE `amount` > \\? AND `tenant_id` = \\?$").
+		WithArgs(10, int64(7)).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "tenant_id", "amount"}).AddRow(1, 7, 20))
+	mock.ExpectBegin()
+	mock.ExpectExec("^UPDATE `orders` SET `amount`=\\? WHERE `id` = \\? AND `tenant_id` = \\?$").
+		WithArgs(0, 1, int64(7)).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	mock.ExpectBegin()
+	mock.ExpectExec("^DELETE FROM `orders` WHERE `id` = \\? AND `tenant_id` = \\?$").
+		WithArgs(1, int64(7)).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	ctx := WithTenant(context.Background(), int64(7))
+	var orders []Order
+	assert.Nil(t, repo.Find(ctx, &orders, func(opts *MatchOptions) { opts.GT("amount", 10) }))
+	assert.Equal(t, []Order{{ID: 1, TenantID: 7, Amount: 20}}, orders)
+	id := func(opts *MatchOptions) { opts.EQ("id", 1) }
+	assert.Nil(t, repo.UpdateFields(ctx, &Order{}, Fields{"amount": 0}, id))
+	assert.Nil(t, repo.Delete(ctx, &Order{}, id))
+	assert.ErrorIs(t, repo.UpdateFields(ctx, &Order{}, Fields{"tenant_id": 8}, id), ErrTenantMismatch)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestTenantRepository_Create(t *testing.T) {
+	db, mock, gdb := mockDB(t)
+	defer db.Close()
+	repo := NewTenantRepository(NewGormRepository(gdb))
+	mock.ExpectBegin()
+	mock.ExpectExec("^INSERT INTO `orders` \\(`tenant_id`,`amount`\\) VALUES \\(\\?,\\?\\),\\(\\?,\\?\\)$").
+		WithArgs(int64(7), 10, int64(7), 20).
+		WillReturnResult(sqlmock.NewResult(1, 2))
+	mock.ExpectCommit()
+	ctx := WithTenant(context.Background(), 7)
+	orders := []Order{{Amount: 10}, {Amount: 20}}
+	assert.Nil(t, repo.Create(ctx, &orders))
+	assert.Equal(t, int64(7), orders[1].TenantID)
+	assert.ErrorIs(t, repo.Create(ctx, &Order{TenantID: 8}), ErrTenantMismatch)
+	assert.ErrorIs(t, repo.Create(ctx, &User{ID: "1"}), ErrTenantRequired)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestTenantRepository_Update(t *testing.T) {
+	db, mock, gdb := mockDB(t)
+	defer db.Close()
+	repo := NewTenantRepository(NewGormRepository(gdb))
+	mock.ExpectQuery("^SELECT count\\(\\*\\) FROM `orders` WHERE `id` IN \\(\\?\\) AND `tenant_id` = \\?$").
+		WithArgs(int64(1), int64(7)).
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(0))
+	ctx := WithTenant(context.Background(), int64(7))
+	// the order 1 is of another tenant
+	assert.ErrorIs(t, repo.Update(ctx, &Order{ID: 1, Amount: 10}), ErrTenantMismatch)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestTenantRepository_Required(t *testing.T) {
+	db, mock, gdb := mockDB(t)
+	defer db.Close()
+	repo := NewTenantRepository(NewGormRepository(gdb))
+	var orders []Order
+	assert.ErrorIs(t, repo.Find(context.Background(), &orders), ErrTenantRequired)
+	assert.ErrorIs(t, repo.Create(context.Background(), &Order{Amount: 1}), ErrTenantRequired)
+	mock.ExpectQuery("^SELECT \\* FROM `orders`$").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "tenant_id", "amount"}))
+	assert.Nil(t, repo.Find(WithoutTenant(context.Background()), &orders))
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestTenantRepository_Upsert(t *testing.T) {
+	db, mock, gdb := mockDB(t)
+	defer db.Close()
+	repo := NewTenantRepository(NewGormRepository(gdb))
+	ctx := WithTenant(context.Background(), int64(7))
+	// the order 1 of another tenant would be updated
+	assert.ErrorIs(t, repo.Upsert(ctx, &Order{ID: 1, Amount: 10}, []string{"id"}, "amount"), ErrTenantMismatch)
+	mock.ExpectBegin()
+	mock.ExpectExec("^INSERT INTO `orders` \\(`tenant_id`,`amount`,`id`\\) VALUES \\(\\?,\\?,\\?\\) ON DUPLICATE KEY UPDATE `amount`=VALUES\\(`amount`\\)$").
+		WithArgs(int64(7), 10, int64(1)).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+	assert.Nil(t, repo.Upsert(ctx, &Order{ID: 1, Amount: 10}, []string{"tenant_id", "id"}, "amount"))
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestTenantRepository_Unscoped(t *testing.T) {
+	db, mock, gdb := mockDB(t)
+	defer db.Close()
+	repo := NewTenantRepository(NewGormRepository(gdb))
+	ctx := WithTenant(context.Background(), int64(7))
+	var orders []Order
+	subquery := M(nil, &User{}).Where(func(opts *MatchOptions) { opts.EQ("name", "a").SetSelect("id") })
+	for name, find := range map[string]func(ctx context.Context) error{
+		"subquery": func(ctx context.Context) error {
+			return repo.Find(ctx, &orders, func(opts *MatchOptions) { opts.IN("user_id", subquery) })
+		},
+		"nested subquery": func(ctx context.Context) error {
+			return repo.Find(ctx, &orders, func(opts *MatchOptions) {
+				opts.OR(*(&MatchOptions{}).GT("amount", 1).AND(*(&MatchOptions{}).Exists(Raw("SELECT 1 FROM users"))))
+			})
+		},
+		"join": func(ctx context.Context) error {
+			return repo.Find(ctx, M(&orders).As("o").With(As(&User{}, "u"), func(opts *MatchOptions) { opts.EQ("u.id", Field("o.user_id")) }))
+		},
+		"union": func(ctx context.Context) error {
+			return repo.Find(ctx, M(&orders).Union(M(nil, &Order{})))
+		},
+		"model subquery": func(ctx context.Context) error {
+			return repo.Find(ctx, M(&orders).Where(func(opts *MatchOptions) { opts.IN("user_id", subquery) }))
+		},
+		"having subquery": func(ctx context.Context) error {
+			return repo.Count(ctx, M(nil, &Order{}).Group("user_id", func(opts *MatchOptions) { opts.Exists(subquery) }), new(int64))
+		},
+	} {
+		assert.ErrorIs(t, find(ctx), ErrTenantRequired, name)
+	}
+	mock.ExpectQuery("^SELECT \\* FROM `orders` WHERE `user_id` IN \\(SELECT `id` FROM `users` WHERE `name` = \\?\\)$").
+		WithArgs("a").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "tenant_id", "amount"}))
+	assert.Nil(t, repo.Find(WithoutTenant(ctx), &orders, func(opts *MatchOptions) { opts.IN("user_id", subquery) }))
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
@@ -0,0 +1,87 @@
+package database
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+	"gorm.io/gorm"
+)
+
+type Post struct {
+	ID        string
+	Title     string
+	DeletedAt gorm.DeletedAt
+}
+
+func TestGormRepository_Trashed(t *testing.T) {
+	db, mock, gdb := mockDB(t)
+	defer db.Close()
+	repo := NewGormRepository(gdb)
+	mock.ExpectQuery("^SELECT \\* FROM `posts` WHERE `title` = \\? AND `posts`\\.`deleted_at` IS NULL$").
+		WithArgs("a").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "title"}))
+	mock.ExpectQuery("^SELECT \\* FROM `posts` WHERE `title` = \\?$").
+		WithArgs("a").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "title"}))
+	mock.ExpectQuery("^SELECT \\* FROM `posts` WHERE `posts`\\.`deleted_at` IS NOT NULL AND `title` = \\?$").
+		WithArgs("a").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "title"}))
+	mock.ExpectQuery("^SELECT count\\(\\*\\) FROM `posts` WHERE `posts`\\.`deleted_at` IS NOT NULL$").
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(2))
+	ctx := context.Background()
+	title := func(opts *MatchOptions) { opts.EQ("title", "a") }
+	var posts []Post
+	assert.Nil(t, repo.Find(ctx, &posts, title))
+	assert.Nil(t, repo.Find(ctx, &posts, title, WithTrashed()))
+	assert.Nil(t, repo.Find(ctx, &posts, title, OnlyTrashed()))
+	var count int64
+	assert.Nil(t, repo.Count(ctx, &Post{}, &count, OnlyTrashed()))
+	assert.Equal(t, int64(2), count)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestGormRepository_Restore(t *testing.T) {
+	db, mock, gdb := mockDB(t)
+	defer db.Close()
+	repo := NewGormRepository(gdb)
+	mock.ExpectBegin()
+	mock.ExpectExec("^UPDATE `posts` SET `deleted_at`=\\? WHERE `posts`\\.`deleted_at` IS NOT NULL AND `id` = \\?$").
+		WithArgs(nil, "1").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	err := repo.Restore(context.Background(), &Post{}, func(opts *MatchOptions) { opts.EQ("id", "1") })
+	assert.Nil(t, err)
+	err = repo.Restore(context.Background(), &User{}, func(opts *MatchOptions) { opts.EQ("id", "1") })
+	assert.NotNil(t, err)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestGormRepository_ForceDelete(t *testing.T) {
+	db, mock, gdb := mockDB(t)
+	defer db.Close()
+	repo := NewGormRepository(gdb)
+	mock.ExpectBegin()
+	mock.ExpectExec("^DELETE FROM `posts` WHERE `id` = \\?$").
+		WithArgs("1").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	mock.ExpectBegin()
+	mock.ExpectExec("^DELETE FROM `posts` WHERE `posts`\\.`deleted_at` IS NOT NULL AND `deleted_at` < \\?$").
+		WithArgs(AnyTime{}).
+		WillReturnResult(sqlmock.NewResult(0, 3))
+	mock.ExpectCommit()
+	mock.ExpectBegin()
+	mock.ExpectExec("^UPDATE `posts` SET `deleted_at`=\\? WHERE `id` = \\? AND `posts`\\.`deleted_at` IS NULL$").
+		WithArgs(AnyTime{}, "1").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	ctx := context.Background()
+	assert.Nil(t, repo.ForceDelete(ctx, &Post{}, func(opts *MatchOptions) { opts.EQ("id", "1") }))
+	assert.Nil(t, repo.ForceDelete(ctx, &Post{}, OnlyTrashed(), func(opts *MatchOptions) { opts.LT("deleted_at", time.Now()) }))
+	// Delete never deletes for good even if the soft deleted records are matched
+	assert.Nil(t, repo.Delete(ctx, &Post{}, WithTrashed(), func(opts *MatchOptions) { opts.EQ("id", "1") }))
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
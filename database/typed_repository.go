@@ -0,0 +1,121 @@
+package database
+
+import (
+	"context"
+)
+
+// TypedRepository wraps any Repository and exposes the operations of model T with typed results
+// usage:
+//   users := NewTypedRepository[User](NewGormRepository(db))
+//   user, err := users.First(ctx, ID("1"))
+//   list, err := users.Find(ctx, Role("member"), Limit(20))
+type TypedRepository[T any] struct {
+	repo Repository
+}
+
+// NewTypedRepository
+func NewTypedRepository[T any](repo Repository) *TypedRepository[T] {
+	return &TypedRepository[T]{repo: repo}
+}
+
+// Repository the underlying untyped repository
+func (r *TypedRepository[T]) Repository() Repository {
+	return r.repo
+}
+
+// First get the first T following the match condition
+func (r *TypedRepository[T]) First(ctx context.Context, opts ...MatchOption) (*T, error) {
+	var m T
+	if err := r.repo.First(ctx, &m, opts...); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+// Find Ts following the match condition
+func (r *TypedRepository[T]) Find(ctx context.Context, opts ...MatchOption) ([]T, error) {
+	ms := []T{}
+	if err := r.repo.Find(ctx, &ms, opts...); err != nil {
+		return nil, err
+	}
+	return ms, nil
+}
+
+// Count Ts following the match condition
+func (r *TypedRepository[T]) Count(ctx context.Context, opts ...MatchOption) (int64, error) {
+	var count int64
+	if err := r.repo.Count(ctx, new(T), &count, opts...); err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+// Paginate fetch a page of Ts following the match condition
+func (r *TypedRepository[T]) Paginate(ctx context.Context, opts ...MatchOption) ([]T, Page, error) {
+	ms := []T{}
+	var page Page
+	if err := r.repo.Paginate(ctx, &ms, &page, opts...); err != nil {
+		return nil, page, err
+	}
+	return ms, page, nil
+}
+
+// Each stream the Ts following the match condition, do is called with every size of them
+func (r *TypedRepository[T]) Each(ctx context.Context, size int, do func(ctx context.Context, ms []T) error, opts ...MatchOption) error {
+	var ms []T
+	return r.repo.Each(ctx, &ms, size, func(ctx context.Context) error {
+		return do(ctx, ms)
+	}, opts...)
+}
+
+// Create a T
+func (r *TypedRepository[T]) Create(ctx context.Context, m *T) error {
+	return r.repo.Create(ctx, m)
+}
+
+// Update a T
+func (r *TypedRepository[T]) Update(ctx context.Context, m *T) error {
+	return r.repo.Update(ctx, m)
+}
+
+// Delete Ts following the match condition
+func (r *TypedRepository[T]) Delete(ctx context.Context, opts ...MatchOption) error {
+	return r.repo.Delete(ctx, new(T), opts...)
+}
+
+// Restore the soft deleted Ts following the match condition
+func (r *TypedRepository[T]) Restore(ctx context.Context, opts ...MatchOption) error {
+	return r.repo.Restore(ctx, new(T), opts...)
+}
+
+// ForceDelete Ts following the match condition for good, the soft deleted ones included
+func (r *TypedRepository[T]) ForceDelete(ctx context.Context, opts ...MatchOption) error {
+	return r.repo.ForceDelete(ctx, new(T), opts...)
+}
+
+// UpdateFields of Ts following the match condition
+func (r *TypedRepository[T]) UpdateFields(ctx context.Context, fields Fields, opts ...MatchOption) error {
+	return r.repo.UpdateFields(ctx, new(T), fields, opts...)
+}
+
+// CreateInBatches create ms, batchSize records per statement
+func (r *TypedRepository[T]) CreateInBatches(ctx context.Context, ms []T, batchSize int) error {
+	return r.repo.CreateInBatches(ctx, &ms, batchSize)
+}
+
+// Upsert create ms, updating the ones conflicting on the columns conflict
+func (r *TypedRepository[T]) Upsert(ctx context.Context, ms []T, conflict []string, update ...string) error {
+	return r.repo.Upsert(ctx, &ms, conflict, update...)
+}
+
+// BulkUpdateFields update the fields of the Ts keyed by their primary key
+func (r *TypedRepository[T]) BulkUpdateFields(ctx context.Context, rows map[interface{}]Fields) error {
+	return r.repo.BulkUpdateFields(ctx, new(T), rows)
+}
+
+// Transaction run do in a transaction with the repository scoped in it
+func (r *TypedRepository[T]) Transaction(ctx context.Context, do func(ctx context.Context, repo *TypedRepository[T]) error, opts ...TxOption) error {
+	return r.repo.Transaction(ctx, func(ctx context.Context, repo Repository) error {
+		return do(ctx, NewTypedRepository[T](repo))
+	}, opts...)
+}
@@ -0,0 +1,95 @@
+package database
+
+import (
+	"context"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+	"gorm.io/gorm"
+)
+
+func TestTypedRepository_First(t *testing.T) {
+	db, mock, err := sqlmock.New() // mock sql.DB
+	assert.Nil(t, err)
+	defer db.Close()
+	gdb, err := gorm.Open(dialector(db)) // open gorm db
+	assert.Nil(t, err)
+	users := NewTypedRepository[User](NewGormRepository(gdb))
+	func() {
+		execSql := "^SELECT \\* FROM `users` WHERE `id` = \\? ORDER BY `users`\\.`id` LIMIT 1$"
+		mock.ExpectQuery(execSql).
+			WithArgs("1").
+			WillReturnRows(sqlmock.NewRows([]string{"id", "name"}).AddRow("1", "author1"))
+	}()
+	user, err := users.First(context.Background(), func(opts *MatchOptions) { opts.EQ("id", "1") })
+	assert.Nil(t, err)
+	assert.Equal(t, &User{ID: "1", Name: "author1"}, user)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestTypedRepository_Find(t *testing.T) {
+	db, mock, err := sqlmock.New() // mock sql.DB
+	assert.Nil(t, err)
+	defer db.Close()
+	gdb, err := gorm.Open(dialector(db)) // open gorm db
+	assert.Nil(t, err)
+	books := NewTypedRepository[Book](NewGormRepository(gdb))
+	func() {
+		execSql := "^SELECT \\* FROM `books` WHERE `book`\\.`author_id` IN \\(\\?,\\?\\) LIMIT 20$"
+		mock.ExpectQuery(execSql).
+			WithArgs("1", "2").
+			WillReturnRows(sqlmock.NewRows([]string{"id", "name", "author_id"}).
+				AddRow("1", "book1", "1").
+				AddRow("2", "book2", "2"))
+	}()
+	list, err := books.Find(context.Background(),
+		AuthorID([]string{"1", "2"}),
+		func(opts *MatchOptions) { opts.SetLimit(20) },
+	)
+	assert.Nil(t, err)
+	assert.Equal(t, []Book{
+		{ID: "1", Name: "book1", AuthorID: "1"},
+		{ID: "2", Name: "book2", AuthorID: "2"},
+	}, list)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestTypedRepository_Count(t *testing.T) {
+	db, mock, err := sqlmock.New() // mock sql.DB
+	assert.Nil(t, err)
+	defer db.Close()
+	gdb, err := gorm.Open(dialector(db)) // open gorm db
+	assert.Nil(t, err)
+	books := NewTypedRepository[Book](NewGormRepository(gdb))
+	func() {
+		execSql := "^SELECT count\\(\\*\\) FROM `books` WHERE `book`\\.`author_id` = \\?$"
+		mock.ExpectQuery(execSql).
+			WithArgs("1").
+			WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(3))
+	}()
+	count, err := books.Count(context.Background(), AuthorID("1"))
+	assert.Nil(t, err)
+	assert.Equal(t, int64(3), count)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestTypedRepository_Create(t *testing.T) {
+	db, mock, err := sqlmock.New() // mock sql.DB
+	assert.Nil(t, err)
+	defer db.Close()
+	gdb, err := gorm.Open(dialector(db)) // open gorm db
+	assert.Nil(t, err)
+	users := NewTypedRepository[User](NewGormRepository(gdb))
+	func() {
+		execSql := "^INSERT INTO `users` \\(`id`,`name`\\) VALUES \\(\\?,\\?\\)$"
+		mock.ExpectBegin()
+		mock.ExpectExec(execSql).
+			WithArgs("1", "author1").
+			WillReturnResult(sqlmock.NewResult(1, 1))
+		mock.ExpectCommit()
+	}()
+	err = users.Create(context.Background(), &User{ID: "1", Name: "author1"})
+	assert.Nil(t, err)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
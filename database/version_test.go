@@ -0,0 +1,62 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+)
+
+type Article struct {
+	ID      string
+	Body    string
+	Version int64 `lock:"version"`
+}
+
+func TestGormRepository_UpdateVersion(t *testing.T) {
+	db, mock, gdb := mockDB(t)
+	defer db.Close()
+	repo := NewGormRepository(gdb)
+	mock.ExpectBegin()
+	mock.ExpectExec("^UPDATE `articles` SET `body`=\\?,`version`=\\? WHERE `version` = \\? AND `id` = \\?$").
+		WithArgs("b", int64(4), int64(3), "1").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	article := Article{ID: "1", Body: "b", Version: 3}
+	assert.Nil(t, repo.Update(context.Background(), &article))
+	assert.Equal(t, int64(4), article.Version)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestGormRepository_UpdateConflict(t *testing.T) {
+	db, mock, gdb := mockDB(t)
+	defer db.Close()
+	repo := NewGormRepository(gdb)
+	mock.ExpectBegin()
+	mock.ExpectExec("^UPDATE `articles` SET `body`=\\?,`version`=\\? WHERE `version` = \\? AND `id` = \\?$").
+		WithArgs("b", int64(4), int64(3), "1").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectCommit()
+	article := Article{ID: "1", Body: "b", Version: 3}
+	err := repo.Update(context.Background(), &article)
+	assert.ErrorIs(t, err, ErrConflict)
+	var dbErr *Error
+	assert.True(t, errors.As(err, &dbErr))
+	assert.Equal(t, int64(3), article.Version)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestGormRepository_UpdateWithoutVersion(t *testing.T) {
+	db, mock, gdb := mockDB(t)
+	defer db.Close()
+	repo := NewGormRepository(gdb)
+	mock.ExpectBegin()
+	mock.ExpectExec("^UPDATE `users` SET `name`=\\? WHERE `id` = \\?$").
+		WithArgs("a", "1").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	assert.Nil(t, repo.Update(context.Background(), &User{ID: "1", Name: "a"}))
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
@@ -0,0 +1,68 @@
+package http
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/yang-zzhong/xl/database"
+)
+
+const (
+	ErrCodeNotFound   = "not_found"
+	ErrCodeDuplicate  = "duplicate"
+	ErrCodeForeignKey = "foreign_key"
+	ErrCodeConflict   = "conflict"
+	ErrCodeDeadlock   = "deadlock"
+	ErrCodeTimeout    = "timeout"
+	ErrCodeCanceled   = "canceled"
+	ErrCodeBadRequest = "bad_request"
+	ErrCodeInternal   = "internal"
+)
+
+// StatusClientClosedRequest the status of the requests canceled by the client, which net/http has no name of
+const StatusClientClosedRequest = 499
+
+// errStatus the status and the code of the errors of the database package, checked in order
+var errStatus = []struct {
+	err    error
+	status int
+	code   string
+}{
+	{database.ErrRecordNotFound, http.StatusNotFound, ErrCodeNotFound},
+	{database.ErrDuplicate, http.StatusConflict, ErrCodeDuplicate},
+	{database.ErrForeignKey, http.StatusConflict, ErrCodeForeignKey},
+	{database.ErrConflict, http.StatusConflict, ErrCodeConflict},
+	{database.ErrDeadlock, http.StatusServiceUnavailable, ErrCodeDeadlock},
+	{database.ErrTimeout, http.StatusGatewayTimeout, ErrCodeTimeout},
+	{database.ErrCanceled, StatusClientClosedRequest, ErrCodeCanceled},
+	{ErrInvalidFilter, http.StatusBadRequest, ErrCodeInvalidFilter},
+	{database.ErrInvalidIdentifier, http.StatusBadRequest, ErrCodeBadRequest},
+	{database.ErrInvalidSort, http.StatusBadRequest, ErrCodeBadRequest},
+	{database.ErrFieldNotAllowed, http.StatusBadRequest, ErrCodeBadRequest},
+	{database.ErrInvalidCursor, http.StatusBadRequest, ErrCodeBadRequest},
+}
+
+// StatusOf the http status and the error code of err, 500 if err is not one of the database errors
+func StatusOf(err error) (int, string) {
+	for _, s := range errStatus {
+		if errors.Is(err, s.err) {
+			return s.status, s.code
+		}
+	}
+	return http.StatusInternalServerError, ErrCodeInternal
+}
+
+// DBErrJSON respond err with the status of it, see StatusOf. the message of the internal errors
+// is hidden from the client
+//   if err := repo.First(ctx, &user, ID(id)); err != nil {
+//       DBErrJSON(w, err)
+//       return
+//   }
+func DBErrJSON(w http.ResponseWriter, err error) error {
+	status, code := StatusOf(err)
+	msg := err.Error()
+	if status == http.StatusInternalServerError {
+		msg = http.StatusText(status)
+	}
+	return ErrJSON(w, code, msg, status)
+}
@@ -0,0 +1,43 @@
+package http
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/stretchr/testify/assert"
+	"github.com/yang-zzhong/xl/database"
+)
+
+func TestStatusOf(t *testing.T) {
+	cases := []struct {
+		err    error
+		status int
+		code   string
+	}{
+		{&database.Error{Kind: database.ErrRecordNotFound, Err: errors.New("record not found")}, http.StatusNotFound, ErrCodeNotFound},
+		{fmt.Errorf("create: %w", &database.Error{Kind: database.ErrDuplicate, Key: "email", Err: &mysql.MySQLError{Number: 1062}}), http.StatusConflict, ErrCodeDuplicate},
+		{&database.Error{Kind: database.ErrConflict, Err: errors.New("updated by others")}, http.StatusConflict, ErrCodeConflict},
+		{&database.Error{Kind: database.ErrDeadlock, Err: &mysql.MySQLError{Number: 1213}}, http.StatusServiceUnavailable, ErrCodeDeadlock},
+		{&database.ContextError{Op: "find", Err: context.DeadlineExceeded}, http.StatusGatewayTimeout, ErrCodeTimeout},
+		{&database.ContextError{Op: "find", Err: context.Canceled}, StatusClientClosedRequest, ErrCodeCanceled},
+		{&FilterError{Param: "limit", Msg: "not a number"}, http.StatusBadRequest, ErrCodeInvalidFilter},
+		{errors.New("boom"), http.StatusInternalServerError, ErrCodeInternal},
+	}
+	for _, c := range cases {
+		status, code := StatusOf(c.err)
+		assert.Equal(t, c.status, status, c.err.Error())
+		assert.Equal(t, c.code, code, c.err.Error())
+	}
+}
+
+func TestDBErrJSON(t *testing.T) {
+	w := httptest.NewRecorder()
+	assert.Nil(t, DBErrJSON(w, errors.New("dial tcp 10.0.0.1:3306: connection refused")))
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+	assert.JSONEq(t, `{"errcode":"internal","errmsg":"Internal Server Error"}`, w.Body.String())
+}
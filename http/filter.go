@@ -0,0 +1,305 @@
+package http
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/spf13/cast"
+	"github.com/yang-zzhong/xl/database"
+)
+
+const (
+	ErrCodeInvalidFilter = "invalid_filter"
+)
+
+var (
+	ErrInvalidFilter = errors.New("invalid filter")
+	timeType         = reflect.TypeOf(time.Time{})
+)
+
+// FilterError the query param which can't be parsed to the filter
+type FilterError struct {
+	Param string
+	Msg   string
+}
+
+func (e *FilterError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Param, e.Msg)
+}
+
+func (e *FilterError) Is(target error) bool {
+	return target == ErrInvalidFilter
+}
+
+type FilterOptions struct {
+	// DefaultLimit the limit when it's not given, zero means no limit
+	DefaultLimit int
+	// MaxLimit the max limit allowed
+	MaxLimit int
+	// IgnoreUnknown ignore the params which are not the allowed fields instead of failing
+	IgnoreUnknown bool
+}
+
+type FilterOption func(*FilterOptions)
+
+func DefaultLimit(limit int) FilterOption {
+	return func(opts *FilterOptions) { opts.DefaultLimit = limit }
+}
+
+func MaxLimit(limit int) FilterOption {
+	return func(opts *FilterOptions) { opts.MaxLimit = limit }
+}
+
+func IgnoreUnknown() FilterOption {
+	return func(opts *FilterOptions) { opts.IgnoreUnknown = true }
+}
+
+// ParseFilter parse the query into MatchOptions, the fields are validated against the allowed fields of model,
+// see database.Allowed. cursor and total=true are passed to database.Repository.Paginate. every param other
+// than sort, limit, offset, cursor and total is a filter of the field in form of
+// [operator:]value, the operator is one of eq (default), neq, lt, lte, gt, gte, in, nin, between, like, prefix,
+// suffix and null, the values of in, nin and between are separated by comma, e.g.
+//   ?status=in:a,b&created_at=gte:2024-01-01&sort=-created_at&limit=20&offset=40
+//   filter, err := ParseFilter(req.URL.Query(), &Book{}, MaxLimit(100))
+//   if err != nil {
+//       return FilterErrJSON(w, err)
+//   }
+//   err = repo.Find(ctx, &books, filter.Option())
+func ParseFilter(query url.Values, model interface{}, opts ...FilterOption) (database.MatchOptions, error) {
+	opt := &FilterOptions{DefaultLimit: 20, MaxLimit: 100}
+	for _, apply := range opts {
+		apply(opt)
+	}
+	allowed := database.Allowed(model)
+	filter := database.MatchOptions{}
+	params := make([]string, 0, len(query))
+	for param := range query {
+		params = append(params, param)
+	}
+	sort.Strings(params)
+	for _, param := range params {
+		var err error
+		switch param {
+		case "sort":
+			err = parseSort(&filter, allowed, query[param])
+		case "limit":
+			err = parseLimit(&filter, query.Get(param), opt.MaxLimit)
+		case "offset":
+			err = parseOffset(&filter, query.Get(param))
+		case "cursor":
+			filter.After(query.Get(param))
+		case "total":
+			var total bool
+			if total, err = cast.ToBoolE(query.Get(param)); err == nil && total {
+				filter.CountTotal()
+			}
+		default:
+			field, ok := allowed.Lookup(param)
+			if !ok {
+				if opt.IgnoreUnknown {
+					continue
+				}
+				return filter, &FilterError{Param: param, Msg: "unknown field"}
+			}
+			for _, val := range query[param] {
+				if err = parseMatch(&filter, field, val); err != nil {
+					break
+				}
+			}
+		}
+		if err != nil {
+			return filter, &FilterError{Param: param, Msg: err.Error()}
+		}
+	}
+	if filter.Limit == nil && opt.DefaultLimit > 0 {
+		filter.SetLimit(opt.DefaultLimit)
+	}
+	return filter, nil
+}
+
+// FilterErrJSON respond the error of ParseFilter with 400
+func FilterErrJSON(w http.ResponseWriter, err error) error {
+	return ErrJSON(w, ErrCodeInvalidFilter, err.Error(), http.StatusBadRequest)
+}
+
+func parseSort(filter *database.MatchOptions, allowed *database.AllowedFields, vals []string) error {
+	specs := []string{}
+	for _, val := range vals {
+		for _, name := range strings.Split(val, ",") {
+			name = strings.TrimSpace(name)
+			desc := strings.HasPrefix(name, "-")
+			field, ok := allowed.Lookup(strings.TrimPrefix(name, "-"))
+			if !ok || !field.Sortable {
+				return fmt.Errorf("can't sort by %q", name)
+			}
+			if desc {
+				specs = append(specs, database.Field(field.Column).DESC())
+				continue
+			}
+			specs = append(specs, database.Field(field.Column).ASC())
+		}
+	}
+	filter.SetSort(specs...)
+	return nil
+}
+
+func parseLimit(filter *database.MatchOptions, val string, max int) error {
+	limit, err := cast.ToIntE(val)
+	if err != nil || limit <= 0 {
+		return fmt.Errorf("limit must be a positive integer")
+	}
+	if max > 0 && limit > max {
+		return fmt.Errorf("limit must not be greater than %d", max)
+	}
+	filter.SetLimit(limit)
+	return nil
+}
+
+func parseOffset(filter *database.MatchOptions, val string) error {
+	offset, err := cast.ToIntE(val)
+	if err != nil || offset < 0 {
+		return fmt.Errorf("offset must be a non-negative integer")
+	}
+	filter.SetOffset(offset)
+	return nil
+}
+
+func parseMatch(filter *database.MatchOptions, field database.AllowedField, val string) error {
+	op, operand := "eq", val
+	if idx := strings.Index(val, ":"); idx >= 0 && isFilterOperator(val[:idx]) {
+		op, operand = val[:idx], val[idx+1:]
+	}
+	switch op {
+	case "null":
+		isNull := true
+		if operand != "" {
+			var err error
+			if isNull, err = cast.ToBoolE(operand); err != nil {
+				return fmt.Errorf("null expects true or false")
+			}
+		}
+		if isNull {
+			filter.Null(field.Column)
+			return nil
+		}
+		filter.NotNull(field.Column)
+		return nil
+	case "like", "prefix", "suffix":
+		if indirect(field.Type).Kind() != reflect.String {
+			return fmt.Errorf("%s is only allowed on text", op)
+		}
+		switch op {
+		case "like":
+			filter.Contains(field.Column, operand)
+		case "prefix":
+			filter.StartsWith(field.Column, operand)
+		case "suffix":
+			filter.EndsWith(field.Column, operand)
+		}
+		return nil
+	case "in", "nin", "between":
+		vals, err := convertAll(strings.Split(operand, ","), field.Type)
+		if err != nil {
+			return err
+		}
+		switch op {
+		case "in":
+			filter.IN(field.Column, vals)
+		case "nin":
+			filter.NotIN(field.Column, vals)
+		case "between":
+			if len(vals) != 2 {
+				return fmt.Errorf("between expects 2 values")
+			}
+			filter.Between(field.Column, vals[0], vals[1])
+		}
+		return nil
+	}
+	v, err := convert(operand, field.Type)
+	if err != nil {
+		return err
+	}
+	switch op {
+	case "eq":
+		filter.EQ(field.Column, v)
+	case "neq":
+		filter.NEQ(field.Column, v)
+	case "lt":
+		filter.LT(field.Column, v)
+	case "lte":
+		filter.LTE(field.Column, v)
+	case "gt":
+		filter.GT(field.Column, v)
+	case "gte":
+		filter.GTE(field.Column, v)
+	}
+	return nil
+}
+
+func isFilterOperator(op string) bool {
+	switch op {
+	case "eq", "neq", "lt", "lte", "gt", "gte", "in", "nin", "between", "like", "prefix", "suffix", "null":
+		return true
+	}
+	return false
+}
+
+func indirect(t reflect.Type) reflect.Type {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return t
+}
+
+func convertAll(vals []string, t reflect.Type) ([]interface{}, error) {
+	ret := make([]interface{}, len(vals))
+	for i, val := range vals {
+		var err error
+		if ret[i], err = convert(strings.TrimSpace(val), t); err != nil {
+			return nil, err
+		}
+	}
+	return ret, nil
+}
+
+// convert val to the type of the field
+func convert(val string, t reflect.Type) (interface{}, error) {
+	t = indirect(t)
+	if t == timeType {
+		v, err := cast.ToTimeE(val)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not a time", val)
+		}
+		return v, nil
+	}
+	var v interface{}
+	var err error
+	switch t.Kind() {
+	case reflect.String:
+		v = val
+	case reflect.Bool:
+		v, err = cast.ToBoolE(val)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		v, err = cast.ToInt64E(val)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		v, err = cast.ToUint64E(val)
+	case reflect.Float32, reflect.Float64:
+		v, err = cast.ToFloat64E(val)
+	default:
+		return nil, fmt.Errorf("filtering by %s is not supported", t.String())
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%q is not a %s", val, t.Kind().String())
+	}
+	rv := reflect.ValueOf(v)
+	if rv.Type().ConvertibleTo(t) {
+		return rv.Convert(t).Interface(), nil
+	}
+	return v, nil
+}
@@ -0,0 +1,104 @@
+package http
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/yang-zzhong/xl/database"
+)
+
+type Status string
+
+type Order struct {
+	ID        string    `filter:"id,sort"`
+	Status    Status    `filter:"status"`
+	Amount    *int      `filter:"amount,sort"`
+	Paid      bool      `filter:"paid"`
+	Remark    string    `filter:"remark"`
+	CreatedAt time.Time `filter:",sort"`
+	Secret    string
+}
+
+func TestParseFilter(t *testing.T) {
+	query, err := url.ParseQuery("status=in:a,b&created_at=gte:2024-01-01&amount=between:1,10&paid=true&remark=like:50%25_off&id=neq:1&sort=-created_at,id&limit=20&offset=40")
+	assert.Nil(t, err)
+	filter, err := ParseFilter(query, &Order{})
+	assert.Nil(t, err)
+	limit, offset := 20, 40
+	assert.Equal(t, database.MatchOptions{
+		Matches: []database.MatchItem{
+			{Field: "amount", Operator: database.BETWEEN, Value: []interface{}{1, 10}},
+			{Field: "created_at", Operator: database.GTE, Value: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)},
+			{Field: "id", Operator: database.NEQ, Value: "1"},
+			{Field: "paid", Operator: database.EQ, Value: true},
+			{Field: "remark", Operator: database.LIKE, Value: `%50\%\_off%`},
+			{Field: "status", Operator: database.IN, Value: []interface{}{Status("a"), Status("b")}},
+		},
+		Sort:   []string{"created_at DESC", "id ASC"},
+		Limit:  &limit,
+		Offset: &offset,
+	}, filter)
+}
+
+func TestParseFilter_Default(t *testing.T) {
+	filter, err := ParseFilter(url.Values{"status": {"a", "neq:b"}, "remark": {"null:false"}}, Order{}, DefaultLimit(10))
+	assert.Nil(t, err)
+	limit := 10
+	assert.Equal(t, database.MatchOptions{
+		Matches: []database.MatchItem{
+			{Field: "remark", Operator: database.NOTNULL},
+			{Field: "status", Operator: database.EQ, Value: Status("a")},
+			{Field: "status", Operator: database.NEQ, Value: Status("b")},
+		},
+		Limit: &limit,
+	}, filter)
+	_, err = ParseFilter(url.Values{"page": {"1"}}, Order{}, IgnoreUnknown())
+	assert.Nil(t, err)
+	filter, err = ParseFilter(url.Values{"cursor": {"next"}, "total": {"true"}}, Order{})
+	assert.Nil(t, err)
+	assert.Equal(t, "next", filter.Cursor)
+	assert.True(t, filter.Total)
+}
+
+func TestParseFilter_Error(t *testing.T) {
+	cases := []struct {
+		query string
+		param string
+	}{
+		{query: "secret=1", param: "secret"},
+		{query: "amount=abc", param: "amount"},
+		{query: "amount=like:1", param: "amount"},
+		{query: "amount=between:1", param: "amount"},
+		{query: "created_at=lt:yesterday", param: "created_at"},
+		{query: "sort=status", param: "sort"},
+		{query: "sort=-secret", param: "sort"},
+		{query: "limit=1000", param: "limit"},
+		{query: "limit=-1", param: "limit"},
+		{query: "offset=a", param: "offset"},
+	}
+	for _, c := range cases {
+		query, err := url.ParseQuery(c.query)
+		assert.Nil(t, err)
+		_, err = ParseFilter(query, Order{})
+		assert.True(t, errors.Is(err, ErrInvalidFilter), c.query)
+		var filterErr *FilterError
+		assert.True(t, errors.As(err, &filterErr), c.query)
+		assert.Equal(t, c.param, filterErr.Param, c.query)
+	}
+}
+
+func TestFilterErrJSON(t *testing.T) {
+	_, err := ParseFilter(url.Values{"secret": {"1"}}, Order{})
+	w := httptest.NewRecorder()
+	assert.Nil(t, FilterErrJSON(w, err))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	res := Res{}
+	assert.Nil(t, json.NewDecoder(w.Body).Decode(&res))
+	assert.Equal(t, Res{ErrCode: ErrCodeInvalidFilter, ErrMsg: "secret: unknown field"}, res)
+}
@@ -3,6 +3,8 @@ package http
 import (
 	"encoding/json"
 	"net/http"
+
+	"github.com/yang-zzhong/xl/database"
 )
 
 type Res struct {
@@ -19,9 +21,22 @@ func JSON(w http.ResponseWriter, data interface{}, codes ...int) error {
 	return writeJSON(w, &Res{Response: data}, code)
 }
 
+// PageRes the envelope of a page of items
+type PageRes struct {
+	Items   any    `json:"items"`
+	Total   *int64 `json:"total,omitempty"`
+	HasNext bool   `json:"has_next"`
+	Next    string `json:"next,omitempty"`
+}
+
+// PageJSON respond the items with the page info fetched by database.Repository.Paginate
+func PageJSON(w http.ResponseWriter, items interface{}, page database.Page, codes ...int) error {
+	return JSON(w, &PageRes{Items: items, Total: page.Total, HasNext: page.HasNext, Next: page.Next}, codes...)
+}
+
 func ErrJSON(w http.ResponseWriter, errCode, errMsg string, codes ...int) error {
 	code := http.StatusInternalServerError
-	if len(codes) == 0 {
+	if len(codes) > 0 {
 		code = codes[0]
 	}
 	return writeJSON(w, &Res{ErrCode: errCode, ErrMsg: errMsg}, code)
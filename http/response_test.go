@@ -0,0 +1,19 @@
+package http
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/yang-zzhong/xl/database"
+)
+
+func TestPageJSON(t *testing.T) {
+	w := httptest.NewRecorder()
+	total := int64(3)
+	err := PageJSON(w, []string{"a", "b"}, database.Page{Total: &total, HasNext: true, Next: "next"})
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"response":{"items":["a","b"],"total":3,"has_next":true,"next":"next"}}`, w.Body.String())
+}
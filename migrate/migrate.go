@@ -0,0 +1,539 @@
+package migrate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"math"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+
+	"gorm.io/gorm"
+)
+
+var (
+	ErrLocked           = errors.New("migrations locked by another run")
+	ErrDuplicateVersion = errors.New("duplicate migration version")
+	ErrIrreversible     = errors.New("migration irreversible")
+)
+
+// DefaultTable the history table if Table is not given
+const DefaultTable = "schema_migrations"
+
+// DefaultLockTimeout how long to wait for the lock of another run if LockTimeout is not given
+const DefaultLockTimeout = 10 * time.Second
+
+// lockRetryInterval how often the lock of postgres and sqlite is tried while it's held by another run
+const lockRetryInterval = 200 * time.Millisecond
+
+// VersionLayout the layout of the versions of the migrations created by Create
+const VersionLayout = "20060102150405"
+
+// fileRegexp the sql migration files, <version>_<name>.up.sql and <version>_<name>.down.sql
+var fileRegexp = regexp.MustCompile(`^(\d+)_(\w+)\.(up|down)\.sql$`)
+
+// Migration a versioned change of the schema or the data. the migrations are applied in the order of
+// their versions, every one in a transaction along with its history record. mysql commits every DDL
+// statement implicitly, so a migration failing after some of its DDL statements leaves them applied
+// without the history record there, and has to be fixed by hand. a migration of mysql had better be
+// one DDL statement, or statements that are safe to run again
+type Migration struct {
+	Version string
+	Name    string
+	Up      func(ctx context.Context, tx *gorm.DB) error
+	// Down revert Up, the migration can't be reverted if it's nil
+	Down func(ctx context.Context, tx *gorm.DB) error
+}
+
+// SQL a migration running the statements of up, and the ones of down to revert it
+func SQL(version, name, up, down string) Migration {
+	m := Migration{Version: version, Name: name, Up: exec(up)}
+	if strings.TrimSpace(down) != "" {
+		m.Down = exec(down)
+	}
+	return m
+}
+
+func exec(sql string) func(ctx context.Context, tx *gorm.DB) error {
+	return func(ctx context.Context, tx *gorm.DB) error {
+		for _, stmt := range statements(tx.Dialector.Name(), sql) {
+			if err := tx.WithContext(ctx).Exec(stmt).Error; err != nil {
+				return fmt.Errorf("%s: %w", stmt, err)
+			}
+		}
+		return nil
+	}
+}
+
+// Status the status of a migration
+type Status struct {
+	Version string
+	Name    string
+	// AppliedAt when the migration was applied, nil if it's pending
+	AppliedAt *time.Time
+	// Missing the migration was applied but is not known any more
+	Missing bool
+}
+
+// Options options of the migrator
+type Options struct {
+	// Table the history table of the migrations applied
+	Table string
+	// LockTimeout how long to wait for the lock of another run
+	LockTimeout time.Duration
+}
+
+type Option func(*Options)
+
+// Table set the history table
+func Table(table string) Option {
+	return func(opts *Options) { opts.Table = table }
+}
+
+// LockTimeout set how long to wait for the lock of another run
+func LockTimeout(d time.Duration) Option {
+	return func(opts *Options) { opts.LockTimeout = d }
+}
+
+// Migrator apply and revert the migrations registered or loaded from a directory. a run holds a lock
+// of the database, so that the concurrent runs never apply a migration twice
+type Migrator struct {
+	db         *gorm.DB
+	opts       Options
+	migrations map[string]Migration
+}
+
+// New a migrator of db
+// usage:
+//   m := migrate.New(db)
+//   if err := m.Load(os.DirFS("migrations")); err != nil {
+//       return err
+//   }
+//   err := m.Register(migrate.Migration{Version: "20230401000000", Name: "backfill_names", Up: backfill})
+//   applied, err := m.Up(ctx, 0)
+func New(db *gorm.DB, opts ...Option) *Migrator {
+	m := &Migrator{db: db, migrations: map[string]Migration{}}
+	m.opts.Table = DefaultTable
+	m.opts.LockTimeout = DefaultLockTimeout
+	for _, apply := range opts {
+		apply(&m.opts)
+	}
+	return m
+}
+
+// Register go migrations
+func (m *Migrator) Register(migrations ...Migration) error {
+	for _, migration := range migrations {
+		if _, ok := m.migrations[migration.Version]; ok {
+			return fmt.Errorf("%w: %s", ErrDuplicateVersion, migration.Version)
+		}
+		m.migrations[migration.Version] = migration
+	}
+	return nil
+}
+
+// Load the sql migrations of fsys, named <version>_<name>.up.sql and <version>_<name>.down.sql
+func (m *Migrator) Load(fsys fs.FS) error {
+	entries, err := fs.ReadDir(fsys, ".")
+	if err != nil {
+		return err
+	}
+	ups, downs, names := map[string]string{}, map[string]string{}, map[string]string{}
+	for _, entry := range entries {
+		match := fileRegexp.FindStringSubmatch(entry.Name())
+		if entry.IsDir() || match == nil {
+			continue
+		}
+		content, err := fs.ReadFile(fsys, entry.Name())
+		if err != nil {
+			return err
+		}
+		version, name := match[1], match[2]
+		if other, ok := names[version]; ok && other != name {
+			return fmt.Errorf("%w: %s of %s and %s", ErrDuplicateVersion, version, other, name)
+		}
+		names[version] = name
+		if match[3] == "up" {
+			ups[version] = string(content)
+		} else {
+			downs[version] = string(content)
+		}
+	}
+	for version, name := range names {
+		up, ok := ups[version]
+		if !ok {
+			return fmt.Errorf("migration %s_%s has no up", version, name)
+		}
+		if err := m.Register(SQL(version, name, up, downs[version])); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Up apply n pending migrations, all of them if n is not positive. the migrations applied before a failing
+// one stay applied, and the failing one is rolled back unless its DDL is committed implicitly by mysql
+func (m *Migrator) Up(ctx context.Context, n int) (applied []Migration, err error) {
+	err = m.locked(ctx, func(db *gorm.DB) error {
+		history, err := m.history(db)
+		if err != nil {
+			return err
+		}
+		for _, version := range m.versions() {
+			if _, ok := history[version]; ok {
+				continue
+			}
+			if n > 0 && len(applied) == n {
+				break
+			}
+			migration := m.migrations[version]
+			if err := db.Transaction(func(tx *gorm.DB) error {
+				if err := migration.Up(ctx, tx); err != nil {
+					return err
+				}
+				return tx.Table(m.opts.Table).Create(&record{Version: version, Name: migration.Name, AppliedAt: time.Now()}).Error
+			}); err != nil {
+				return fmt.Errorf("up %s_%s: %w", version, migration.Name, err)
+			}
+			applied = append(applied, migration)
+		}
+		return nil
+	})
+	return applied, err
+}
+
+// Down revert the n migrations applied last, all of them if n is not positive
+func (m *Migrator) Down(ctx context.Context, n int) (reverted []Migration, err error) {
+	err = m.locked(ctx, func(db *gorm.DB) error {
+		history, err := m.history(db)
+		if err != nil {
+			return err
+		}
+		versions := make([]string, 0, len(history))
+		for version := range history {
+			versions = append(versions, version)
+		}
+		sort.Sort(sort.Reverse(sort.StringSlice(versions)))
+		for _, version := range versions {
+			if n > 0 && len(reverted) == n {
+				break
+			}
+			migration, ok := m.migrations[version]
+			if !ok || migration.Down == nil {
+				return fmt.Errorf("%w: %s_%s", ErrIrreversible, version, history[version].Name)
+			}
+			if err := db.Transaction(func(tx *gorm.DB) error {
+				if err := migration.Down(ctx, tx); err != nil {
+					return err
+				}
+				return tx.Table(m.opts.Table).Where("version = ?", version).Delete(&record{}).Error
+			}); err != nil {
+				return fmt.Errorf("down %s_%s: %w", version, migration.Name, err)
+			}
+			reverted = append(reverted, migration)
+		}
+		return nil
+	})
+	return reverted, err
+}
+
+// Status the status of the migrations known and the ones applied, in the order of their versions
+func (m *Migrator) Status(ctx context.Context) ([]Status, error) {
+	db := m.db.WithContext(ctx)
+	if err := m.ensureTable(db); err != nil {
+		return nil, err
+	}
+	history, err := m.history(db)
+	if err != nil {
+		return nil, err
+	}
+	statuses := []Status{}
+	for _, version := range m.versions() {
+		status := Status{Version: version, Name: m.migrations[version].Name}
+		if r, ok := history[version]; ok {
+			appliedAt := r.AppliedAt
+			status.AppliedAt = &appliedAt
+		}
+		statuses = append(statuses, status)
+	}
+	for version, r := range history {
+		if _, ok := m.migrations[version]; !ok {
+			appliedAt := r.AppliedAt
+			statuses = append(statuses, Status{Version: version, Name: r.Name, AppliedAt: &appliedAt, Missing: true})
+		}
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Version < statuses[j].Version })
+	return statuses, nil
+}
+
+// Create the empty sql migration files of name in dir, versioned by now
+func Create(dir, name string, now time.Time) (up string, down string, err error) {
+	name = strings.Trim(regexp.MustCompile(`\W+`).ReplaceAllString(strings.ToLower(name), "_"), "_")
+	if name == "" {
+		return "", "", errors.New("migration name required")
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", "", err
+	}
+	prefix := path.Join(dir, now.UTC().Format(VersionLayout)+"_"+name)
+	up, down = prefix+".up.sql", prefix+".down.sql"
+	for _, file := range []string{up, down} {
+		f, err := os.OpenFile(file, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+		if err != nil {
+			return "", "", err
+		}
+		f.Close()
+	}
+	return up, down, nil
+}
+
+// record a migration applied
+type record struct {
+	Version   string `gorm:"primarykey;size:64"`
+	Name      string `gorm:"size:255"`
+	AppliedAt time.Time
+}
+
+func (m *Migrator) versions() []string {
+	versions := make([]string, 0, len(m.migrations))
+	for version := range m.migrations {
+		versions = append(versions, version)
+	}
+	sort.Strings(versions)
+	return versions
+}
+
+func (m *Migrator) quote(name string) string {
+	var b strings.Builder
+	m.db.Dialector.QuoteTo(&b, name)
+	return b.String()
+}
+
+func (m *Migrator) ensureTable(db *gorm.DB) error {
+	datetime := "DATETIME"
+	if m.db.Dialector.Name() == "postgres" {
+		datetime = "TIMESTAMP"
+	}
+	return db.Exec(fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (version VARCHAR(64) NOT NULL PRIMARY KEY, name VARCHAR(255) NOT NULL, applied_at %s NOT NULL)", m.quote(m.opts.Table), datetime)).Error
+}
+
+func (m *Migrator) history(db *gorm.DB) (map[string]record, error) {
+	records := []record{}
+	if err := db.Table(m.opts.Table).Order("version").Find(&records).Error; err != nil {
+		return nil, err
+	}
+	history := make(map[string]record, len(records))
+	for _, r := range records {
+		history[r.Version] = r
+	}
+	return history, nil
+}
+
+// locked run do on a connection holding the lock of the history table. the lock is GET_LOCK of mysql, the
+// advisory lock of postgres and the row of the lock table of sqlite, which has no lock of the session. the
+// row of a run killed before it's released has to be deleted by hand
+func (m *Migrator) locked(ctx context.Context, do func(db *gorm.DB) error) error {
+	return m.db.WithContext(ctx).Connection(func(db *gorm.DB) (err error) {
+		// a new session on the connection, so that no statement is chained to another
+		db = db.Session(&gorm.Session{NewDB: true})
+		// the locks are of the connection, they're released even if ctx is done, or the connection
+		// returned to the pool would keep holding them
+		unlocked := db.WithContext(context.Background())
+		lock := "xl_migrate:" + m.opts.Table
+		switch m.db.Dialector.Name() {
+		case "sqlite":
+			table := m.quote(m.opts.Table + "_lock")
+			if err := db.Exec(fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (id INTEGER NOT NULL PRIMARY KEY, locked_at DATETIME NOT NULL)", table)).Error; err != nil {
+				return err
+			}
+			if err := m.acquire(ctx, func() (bool, error) {
+				// the row is inserted by the one run holding the lock
+				result := db.Exec(fmt.Sprintf("INSERT OR IGNORE INTO %s (id, locked_at) VALUES (1, ?)", table), time.Now())
+				return result.RowsAffected == 1, result.Error
+			}); err != nil {
+				return err
+			}
+			defer unlock(unlocked, &err, fmt.Sprintf("DELETE FROM %s WHERE id = 1", table))
+		case "postgres":
+			if err := m.acquire(ctx, func() (bool, error) {
+				var got bool
+				err := db.Raw("SELECT pg_try_advisory_lock(hashtext(?))", lock).Row().Scan(&got)
+				return got, err
+			}); err != nil {
+				return err
+			}
+			defer unlock(unlocked, &err, "SELECT pg_advisory_unlock(hashtext(?))", lock)
+		default:
+			var got *int
+			// GET_LOCK waits for whole seconds, a timeout under a second would not wait at all
+			timeout := int(math.Ceil(m.opts.LockTimeout.Seconds()))
+			if err := db.Raw("SELECT GET_LOCK(?, ?)", lock, timeout).Row().Scan(&got); err != nil {
+				return err
+			}
+			if got == nil || *got != 1 {
+				return ErrLocked
+			}
+			defer unlock(unlocked, &err, "SELECT RELEASE_LOCK(?)", lock)
+		}
+		if err := m.ensureTable(db); err != nil {
+			return err
+		}
+		return do(db)
+	})
+}
+
+// unlock release the lock by sql, the error of it is set to err unless err is set already
+func unlock(db *gorm.DB, err *error, sql string, values ...interface{}) {
+	if unlockErr := db.Exec(sql, values...).Error; unlockErr != nil && *err == nil {
+		*err = fmt.Errorf("unlock: %w", unlockErr)
+	}
+}
+
+// acquire try the lock until it's got or the lock timeout is exceeded
+func (m *Migrator) acquire(ctx context.Context, try func() (bool, error)) error {
+	deadline := time.Now().Add(m.opts.LockTimeout)
+	for {
+		got, err := try()
+		if err != nil {
+			return err
+		}
+		if got {
+			return nil
+		}
+		if !time.Now().Before(deadline) {
+			return ErrLocked
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(lockRetryInterval):
+		}
+	}
+}
+
+// statements split sql into the statements separated by semicolons, the semicolons quoted or commented are
+// kept. the quotes and the comments are of dialect: the strings of mysql escape by backslashes and # starts a
+// comment there, postgres quotes by dollars like $$...$$ or $tag$...$tag$ and nests its block comments. the
+// comments are left out but the hints and the executable comments of mysql, like /*+ ... */ and /*! ... */
+func statements(dialect, sql string) []string {
+	stmts := []string{}
+	var b strings.Builder
+	runes := []rune(sql)
+	next := func(i int) rune {
+		if i+1 < len(runes) {
+			return runes[i+1]
+		}
+		return 0
+	}
+	for i := 0; i < len(runes); i++ {
+		c := runes[i]
+		switch {
+		case c == '\'' || c == '"' || c == '`':
+			end := quoteEnd(dialect, runes, i)
+			b.WriteString(string(runes[i : end+1]))
+			i = end
+		case c == '$' && dialect == "postgres":
+			end, ok := dollarQuoteEnd(runes, i)
+			if !ok {
+				b.WriteRune(c)
+				continue
+			}
+			b.WriteString(string(runes[i : end+1]))
+			i = end
+		case c == '-' && next(i) == '-', c == '#' && dialect != "postgres" && dialect != "sqlite":
+			// the line break ending the comment is kept
+			for i+1 < len(runes) && runes[i+1] != '\n' {
+				i++
+			}
+		case c == '/' && next(i) == '*':
+			end := blockCommentEnd(dialect, runes, i)
+			if dialect != "postgres" && dialect != "sqlite" && i+2 < len(runes) && (runes[i+2] == '!' || runes[i+2] == '+') {
+				b.WriteString(string(runes[i : end+1]))
+			} else {
+				b.WriteRune(' ')
+			}
+			i = end
+		case c == ';':
+			if stmt := strings.TrimSpace(b.String()); stmt != "" {
+				stmts = append(stmts, stmt)
+			}
+			b.Reset()
+		default:
+			b.WriteRune(c)
+		}
+	}
+	if stmt := strings.TrimSpace(b.String()); stmt != "" {
+		stmts = append(stmts, stmt)
+	}
+	return stmts
+}
+
+// quoteEnd the index of the quote closing the one at start, the last index if it's not closed. a quote doubled
+// is closed and opened again, which is the same string
+func quoteEnd(dialect string, runes []rune, start int) int {
+	quote := runes[start]
+	for i := start + 1; i < len(runes); i++ {
+		switch {
+		case runes[i] == '\\' && quote != '`' && dialect != "postgres" && dialect != "sqlite":
+			i++
+		case runes[i] == quote:
+			return i
+		}
+	}
+	return len(runes) - 1
+}
+
+// dollarQuoteEnd the index of the last dollar of the dollar quote of postgres opened at start, false if no
+// dollar quote is opened there, like the parameter $1
+func dollarQuoteEnd(runes []rune, start int) (int, bool) {
+	if start > 0 && isIdentifier(runes[start-1]) {
+		return 0, false
+	}
+	tagEnd := start + 1
+	for tagEnd < len(runes) && runes[tagEnd] != '$' {
+		if !isIdentifier(runes[tagEnd]) || (tagEnd == start+1 && unicode.IsDigit(runes[tagEnd])) {
+			return 0, false
+		}
+		tagEnd++
+	}
+	if tagEnd >= len(runes) {
+		return 0, false
+	}
+	tag := string(runes[start : tagEnd+1])
+	for i := tagEnd + 1; i+tagEnd-start < len(runes); i++ {
+		if string(runes[i:i+tagEnd-start+1]) == tag {
+			return i + tagEnd - start, true
+		}
+	}
+	return len(runes) - 1, true
+}
+
+// blockCommentEnd the index of the slash closing the block comment opened at start, the last index if it's not
+// closed. the block comments of postgres nest
+func blockCommentEnd(dialect string, runes []rune, start int) int {
+	depth := 0
+	for i := start; i+1 < len(runes); i++ {
+		switch {
+		case runes[i] == '/' && runes[i+1] == '*' && (depth == 0 || dialect == "postgres"):
+			depth++
+			i++
+		case runes[i] == '*' && runes[i+1] == '/':
+			depth--
+			i++
+			if depth == 0 {
+				return i
+			}
+		}
+	}
+	return len(runes) - 1
+}
+
+func isIdentifier(c rune) bool {
+	return c == '_' || c == '$' || unicode.IsLetter(c) || unicode.IsDigit(c)
+}
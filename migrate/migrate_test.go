@@ -0,0 +1,317 @@
+package migrate
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"os"
+	"path"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/glebarez/sqlite"
+	"github.com/stretchr/testify/assert"
+	"gorm.io/driver/mysql"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+)
+
+type AnyTime struct{}
+
+func (a AnyTime) Match(v driver.Value) bool {
+	_, ok := v.(time.Time)
+	return ok
+}
+
+func mockDB(t *testing.T) (sqlmock.Sqlmock, *gorm.DB) {
+	db, mock, err := sqlmock.New()
+	assert.Nil(t, err)
+	t.Cleanup(func() { db.Close() })
+	gdb, err := gorm.Open(mysql.New(mysql.Config{Conn: db, DriverName: "mysql", SkipInitializeWithVersion: true}))
+	assert.Nil(t, err)
+	return mock, gdb
+}
+
+var files = fstest.MapFS{
+	"20230101000000_create_users.up.sql":   {Data: []byte("CREATE TABLE users (id INT, name VARCHAR(16) DEFAULT 'a;b');\n-- the index; of names\nCREATE INDEX idx_name ON users (name);")},
+	"20230101000000_create_users.down.sql": {Data: []byte("DROP TABLE users;")},
+	"20230102000000_add_email.up.sql":      {Data: []byte("ALTER TABLE users ADD email VARCHAR(64);")},
+	"20230102000000_add_email.down.sql":    {Data: []byte("ALTER TABLE users DROP email;")},
+	"README.md":                            {Data: []byte("not a migration")},
+}
+
+func expectLocked(mock sqlmock.Sqlmock, history *sqlmock.Rows) {
+	mock.ExpectQuery("^SELECT GET_LOCK\\(\\?, \\?\\)$").
+		WithArgs("xl_migrate:schema_migrations", 10).
+		WillReturnRows(sqlmock.NewRows([]string{"lock"}).AddRow(1))
+	mock.ExpectExec("^CREATE TABLE IF NOT EXISTS `schema_migrations` ").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery("^SELECT (.+) FROM `schema_migrations` ORDER BY version$").
+		WillReturnRows(history)
+}
+
+func TestMigrator_Up(t *testing.T) {
+	mock, db := mockDB(t)
+	m := New(db)
+	assert.Nil(t, m.Load(files))
+	expectLocked(mock, sqlmock.NewRows([]string{"version", "name", "applied_at"}).
+		AddRow("20230101000000", "create_users", time.Now()))
+	mock.ExpectBegin()
+	mock.ExpectExec("^ALTER TABLE users ADD email VARCHAR\\(64\\)$").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("^INSERT INTO `schema_migrations` \\(`version`,`name`,`applied_at`\\) VALUES \\(\\?,\\?,\\?\\)$").
+		WithArgs("20230102000000", "add_email", AnyTime{}).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+	mock.ExpectExec("^SELECT RELEASE_LOCK\\(\\?\\)$").
+		WithArgs("xl_migrate:schema_migrations").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	applied, err := m.Up(context.Background(), 0)
+	assert.Nil(t, err)
+	assert.Len(t, applied, 1)
+	assert.Equal(t, "add_email", applied[0].Name)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestMigrator_Down(t *testing.T) {
+	mock, db := mockDB(t)
+	m := New(db)
+	assert.Nil(t, m.Load(files))
+	expectLocked(mock, sqlmock.NewRows([]string{"version", "name", "applied_at"}).
+		AddRow("20230101000000", "create_users", time.Now()).
+		AddRow("20230102000000", "add_email", time.Now()))
+	mock.ExpectBegin()
+	mock.ExpectExec("^ALTER TABLE users DROP email$").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("^DELETE FROM `schema_migrations` WHERE version = \\?$").
+		WithArgs("20230102000000").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	mock.ExpectExec("^SELECT RELEASE_LOCK\\(\\?\\)$").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	reverted, err := m.Down(context.Background(), 1)
+	assert.Nil(t, err)
+	assert.Len(t, reverted, 1)
+	assert.Equal(t, "20230102000000", reverted[0].Version)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestMigrator_Locked(t *testing.T) {
+	mock, db := mockDB(t)
+	m := New(db, LockTimeout(time.Second))
+	mock.ExpectQuery("^SELECT GET_LOCK\\(\\?, \\?\\)$").
+		WithArgs("xl_migrate:schema_migrations", 1).
+		WillReturnRows(sqlmock.NewRows([]string{"lock"}).AddRow(0))
+	_, err := m.Up(context.Background(), 0)
+	assert.ErrorIs(t, err, ErrLocked)
+
+	// a timeout under a second waits a second
+	m = New(db, LockTimeout(500*time.Millisecond))
+	mock.ExpectQuery("^SELECT GET_LOCK\\(\\?, \\?\\)$").
+		WithArgs("xl_migrate:schema_migrations", 1).
+		WillReturnRows(sqlmock.NewRows([]string{"lock"}).AddRow(0))
+	_, err = m.Up(context.Background(), 0)
+	assert.ErrorIs(t, err, ErrLocked)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestMigrator_Unlock(t *testing.T) {
+	errLost := errors.New("connection lost")
+	mock, db := mockDB(t)
+	m := New(db)
+	assert.Nil(t, m.Load(files))
+	expectLocked(mock, sqlmock.NewRows([]string{"version", "name", "applied_at"}).
+		AddRow("20230101000000", "create_users", time.Now()).
+		AddRow("20230102000000", "add_email", time.Now()))
+	mock.ExpectExec("^SELECT RELEASE_LOCK\\(\\?\\)$").
+		WithArgs("xl_migrate:schema_migrations").
+		WillReturnError(errLost)
+	_, err := m.Up(context.Background(), 0)
+	assert.ErrorIs(t, err, errLost)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestMigrator_PostgresLocked(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.Nil(t, err)
+	defer db.Close()
+	gdb, err := gorm.Open(postgres.New(postgres.Config{Conn: db}))
+	assert.Nil(t, err)
+	m := New(gdb)
+	assert.Nil(t, m.Load(files))
+	// the lock is held by another run at first
+	mock.ExpectQuery("^SELECT pg_try_advisory_lock\\(hashtext\\(\\$1\\)\\)$").
+		WithArgs("xl_migrate:schema_migrations").
+		WillReturnRows(sqlmock.NewRows([]string{"lock"}).AddRow(false))
+	mock.ExpectQuery("^SELECT pg_try_advisory_lock\\(hashtext\\(\\$1\\)\\)$").
+		WithArgs("xl_migrate:schema_migrations").
+		WillReturnRows(sqlmock.NewRows([]string{"lock"}).AddRow(true))
+	mock.ExpectExec("^CREATE TABLE IF NOT EXISTS \"schema_migrations\" (.+) applied_at TIMESTAMP NOT NULL\\)$").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery("^SELECT (.+) FROM \"schema_migrations\" ORDER BY version$").
+		WillReturnRows(sqlmock.NewRows([]string{"version", "name", "applied_at"}).
+			AddRow("20230101000000", "create_users", time.Now()).
+			AddRow("20230102000000", "add_email", time.Now()))
+	mock.ExpectExec("^SELECT pg_advisory_unlock\\(hashtext\\(\\$1\\)\\)$").
+		WithArgs("xl_migrate:schema_migrations").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	applied, err := m.Up(context.Background(), 0)
+	assert.Nil(t, err)
+	assert.Empty(t, applied)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestMigrator_SQLite(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open("file::memory:"))
+	assert.Nil(t, err)
+	sqlDB, err := db.DB()
+	assert.Nil(t, err)
+	defer sqlDB.Close()
+	// every connection opens its own memory db
+	sqlDB.SetMaxOpenConns(1)
+	m := New(db)
+	assert.Nil(t, m.Load(files))
+	applied, err := m.Up(context.Background(), 0)
+	assert.Nil(t, err)
+	assert.Len(t, applied, 2)
+	assert.Nil(t, db.Exec("INSERT INTO users (id, email) VALUES (1, 'a@b.c')").Error)
+	reverted, err := m.Down(context.Background(), 1)
+	assert.Nil(t, err)
+	assert.Len(t, reverted, 1)
+	statuses, err := m.Status(context.Background())
+	assert.Nil(t, err)
+	assert.Len(t, statuses, 2)
+	assert.NotNil(t, statuses[0].AppliedAt)
+	assert.Nil(t, statuses[1].AppliedAt)
+}
+
+func TestMigrator_SQLiteLocked(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open("file::memory:"))
+	assert.Nil(t, err)
+	sqlDB, err := db.DB()
+	assert.Nil(t, err)
+	defer sqlDB.Close()
+	sqlDB.SetMaxOpenConns(1)
+	m := New(db, LockTimeout(300*time.Millisecond))
+	assert.Nil(t, m.Load(files))
+	_, err = m.Up(context.Background(), 1)
+	assert.Nil(t, err)
+	var count int64
+	assert.Nil(t, db.Table("schema_migrations_lock").Count(&count).Error)
+	assert.Equal(t, int64(0), count)
+	// the lock held by another run
+	assert.Nil(t, db.Exec("INSERT INTO schema_migrations_lock (id, locked_at) VALUES (1, ?)", time.Now()).Error)
+	_, err = m.Up(context.Background(), 0)
+	assert.ErrorIs(t, err, ErrLocked)
+}
+
+func TestMigrator_Status(t *testing.T) {
+	mock, db := mockDB(t)
+	m := New(db)
+	assert.Nil(t, m.Load(files))
+	mock.ExpectExec("^CREATE TABLE IF NOT EXISTS `schema_migrations` ").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery("^SELECT (.+) FROM `schema_migrations` ORDER BY version$").
+		WillReturnRows(sqlmock.NewRows([]string{"version", "name", "applied_at"}).
+			AddRow("20221231000000", "gone", time.Now()).
+			AddRow("20230101000000", "create_users", time.Now()))
+	statuses, err := m.Status(context.Background())
+	assert.Nil(t, err)
+	assert.Len(t, statuses, 3)
+	assert.True(t, statuses[0].Missing)
+	assert.NotNil(t, statuses[1].AppliedAt)
+	assert.Nil(t, statuses[2].AppliedAt)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestMigrator_Register(t *testing.T) {
+	_, db := mockDB(t)
+	m := New(db)
+	assert.Nil(t, m.Load(files))
+	err := m.Register(Migration{Version: "20230101000000", Name: "again"})
+	assert.ErrorIs(t, err, ErrDuplicateVersion)
+}
+
+func TestCreate(t *testing.T) {
+	dir := t.TempDir()
+	up, down, err := Create(dir, "Add Email!", time.Date(2023, 4, 1, 8, 0, 0, 0, time.UTC))
+	assert.Nil(t, err)
+	assert.Equal(t, path.Join(dir, "20230401080000_add_email.up.sql"), up)
+	assert.Equal(t, path.Join(dir, "20230401080000_add_email.down.sql"), down)
+	_, err = os.Stat(down)
+	assert.Nil(t, err)
+	_, _, err = Create(dir, "add email", time.Date(2023, 4, 1, 8, 0, 0, 0, time.UTC))
+	assert.NotNil(t, err)
+}
+
+func TestStatements(t *testing.T) {
+	for _, c := range []struct {
+		name    string
+		dialect string
+		sql     string
+		stmts   []string
+	}{
+		{
+			name:    "quotes and line comments",
+			dialect: "mysql",
+			sql:     "CREATE TABLE a (s VARCHAR(8) DEFAULT 'x;y');\n# comment;\nINSERT INTO a VALUES (\"1;\"); -- done;\n",
+			stmts:   []string{"CREATE TABLE a (s VARCHAR(8) DEFAULT 'x;y')", "INSERT INTO a VALUES (\"1;\")"},
+		},
+		{
+			name:    "backslash escapes of mysql",
+			dialect: "mysql",
+			sql:     `INSERT INTO a VALUES ('it\'s; fine', "a\";b"); INSERT INTO a VALUES ('it''s;')`,
+			stmts:   []string{`INSERT INTO a VALUES ('it\'s; fine', "a\";b")`, `INSERT INTO a VALUES ('it''s;')`},
+		},
+		{
+			name:    "backslashes of postgres are not escapes",
+			dialect: "postgres",
+			sql:     `INSERT INTO a VALUES ('C:\'); INSERT INTO a VALUES ('b')`,
+			stmts:   []string{`INSERT INTO a VALUES ('C:\')`, `INSERT INTO a VALUES ('b')`},
+		},
+		{
+			name:    "json operators of postgres",
+			dialect: "postgres",
+			sql:     "SELECT attrs #> '{a}', attrs #>> '{b}' FROM a; SELECT 1",
+			stmts:   []string{"SELECT attrs #> '{a}', attrs #>> '{b}' FROM a", "SELECT 1"},
+		},
+		{
+			name:    "json operators of sqlite",
+			dialect: "sqlite",
+			sql:     "SELECT 1 # 2; SELECT 3",
+			stmts:   []string{"SELECT 1 # 2", "SELECT 3"},
+		},
+		{
+			name:    "dollar quotes of postgres",
+			dialect: "postgres",
+			sql:     "CREATE FUNCTION f() RETURNS int AS $$ BEGIN RETURN 1; END; $$ LANGUAGE plpgsql;\nDO $body$ BEGIN PERFORM 'a$$;'; END $body$; SELECT $1",
+			stmts: []string{
+				"CREATE FUNCTION f() RETURNS int AS $$ BEGIN RETURN 1; END; $$ LANGUAGE plpgsql",
+				"DO $body$ BEGIN PERFORM 'a$$;'; END $body$",
+				"SELECT $1",
+			},
+		},
+		{
+			name:    "block comments",
+			dialect: "sqlite",
+			sql:     "/* create; the table */ CREATE TABLE a (id INT);\nDROP /* ; */ TABLE b;",
+			stmts:   []string{"CREATE TABLE a (id INT)", "DROP   TABLE b"},
+		},
+		{
+			name:    "nested block comments of postgres",
+			dialect: "postgres",
+			sql:     "/* outer /* inner; */ still; */ SELECT 1; SELECT 2",
+			stmts:   []string{"SELECT 1", "SELECT 2"},
+		},
+		{
+			name:    "executable comments of mysql",
+			dialect: "mysql",
+			sql:     "/*!40101 SET NAMES utf8mb4; */; SELECT /*+ MAX_EXECUTION_TIME(1) */ 1",
+			stmts:   []string{"/*!40101 SET NAMES utf8mb4; */", "SELECT /*+ MAX_EXECUTION_TIME(1) */ 1"},
+		},
+	} {
+		assert.Equal(t, c.stmts, statements(c.dialect, c.sql), c.name)
+	}
+}
@@ -0,0 +1,104 @@
+package tasks
+
+import (
+	"context"
+	"sync"
+
+	"github.com/yang-zzhong/xl/database"
+)
+
+// RepositoryTask a Task processing the Ts following Opts page by page. the pages are ranges of
+// the unique key Key found by streaming the keys in Total, so no page is fetched by offset
+// usage:
+//   d := &Dispatcher{
+//       PageSize: 500,
+//       Task: &RepositoryTask[User]{
+//           Repo:     repo,
+//           PageSize: 500,
+//           Opts:     []database.MatchOption{Role("member")},
+//           Handle:   func(ctx context.Context, users []User) error { return notify(ctx, users) },
+//       },
+//   }
+//   err := d.Dispatch(ctx)
+type RepositoryTask[T any] struct {
+	Repo database.Repository
+	// Key the unique and sortable column the pages are ranged by, id if it's empty
+	Key string
+	// PageSize must be the same as the PageSize of the Dispatcher, 500 if it's zero
+	PageSize int
+	Opts     []database.MatchOption
+	Handle   func(ctx context.Context, ms []T) error
+
+	bounds []interface{}
+	lock   sync.RWMutex
+}
+
+var _ Task = &RepositoryTask[struct{}]{}
+
+func (t *RepositoryTask[T]) key() string {
+	if t.Key == "" {
+		return "id"
+	}
+	return t.Key
+}
+
+func (t *RepositoryTask[T]) pageSize() int {
+	if t.PageSize == 0 {
+		return 500
+	}
+	return t.PageSize
+}
+
+// Total stream the keys of the Ts and record the first key of every page
+func (t *RepositoryTask[T]) Total() (int, error) {
+	key := t.key()
+	opts := append(append([]database.MatchOption{}, t.Opts...), func(opts *database.MatchOptions) {
+		opts.SetSelect(key).SetSort(key)
+	})
+	rows, err := t.Repo.Rows(context.Background(), new(T), opts...)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+	bounds := []interface{}{}
+	total := 0
+	for rows.Next() {
+		if total%t.pageSize() == 0 {
+			row := map[string]interface{}{}
+			if err := rows.Scan(&row); err != nil {
+				return 0, err
+			}
+			bounds = append(bounds, row[key])
+		}
+		total++
+	}
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	t.lock.Lock()
+	t.bounds = bounds
+	t.lock.Unlock()
+	return total, nil
+}
+
+// Do fetch the Ts of the page by the key range of it and handle them
+func (t *RepositoryTask[T]) Do(ctx context.Context, page int) error {
+	t.lock.RLock()
+	bounds := t.bounds
+	t.lock.RUnlock()
+	if page >= len(bounds) {
+		return nil
+	}
+	key := t.key()
+	opts := append(append([]database.MatchOption{}, t.Opts...), func(opts *database.MatchOptions) {
+		opts.GTE(key, bounds[page]).SetSort(key)
+		if page+1 < len(bounds) {
+			opts.LT(key, bounds[page+1])
+		}
+	})
+	ms := []T{}
+	if err := t.Repo.Find(ctx, &ms, opts...); err != nil {
+		return err
+	}
+	return t.Handle(ctx, ms)
+}
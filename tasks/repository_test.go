@@ -0,0 +1,56 @@
+package tasks
+
+import (
+	"context"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+	"github.com/yang-zzhong/xl/database"
+	gormmysql "gorm.io/driver/mysql"
+	"gorm.io/gorm"
+)
+
+type user struct {
+	ID   string
+	Name string
+}
+
+func TestRepositoryTask(t *testing.T) {
+	db, mock, err := sqlmock.New() // mock sql.DB
+	assert.Nil(t, err)
+	defer db.Close()
+	gdb, err := gorm.Open(gormmysql.New(gormmysql.Config{
+		Conn:                      db,
+		DriverName:                "mysql",
+		SkipInitializeWithVersion: true,
+	}))
+	assert.Nil(t, err)
+	func() {
+		mock.ExpectQuery("^SELECT `id` FROM `users` ORDER BY `id`$").
+			WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("1").AddRow("2").AddRow("3"))
+		mock.ExpectQuery("^SELECT \\* FROM `users` WHERE `id` >= \\? AND `id` < \\? ORDER BY `id`$").
+			WithArgs("1", "3").
+			WillReturnRows(sqlmock.NewRows([]string{"id", "name"}).AddRow("1", "a").AddRow("2", "b"))
+		mock.ExpectQuery("^SELECT \\* FROM `users` WHERE `id` >= \\? ORDER BY `id`$").
+			WithArgs("3").
+			WillReturnRows(sqlmock.NewRows([]string{"id", "name"}).AddRow("3", "c"))
+	}()
+	handled := []user{}
+	task := &RepositoryTask[user]{
+		Repo:     database.NewGormRepository(gdb),
+		PageSize: 2,
+		Handle: func(ctx context.Context, ms []user) error {
+			handled = append(handled, ms...)
+			return nil
+		},
+	}
+	total, err := task.Total()
+	assert.Nil(t, err)
+	assert.Equal(t, 3, total)
+	for page := 0; page <= total/task.PageSize; page++ {
+		assert.Nil(t, task.Do(context.Background(), page))
+	}
+	assert.Equal(t, []user{{ID: "1", Name: "a"}, {ID: "2", Name: "b"}, {ID: "3", Name: "c"}}, handled)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
@@ -0,0 +1,42 @@
+package utils
+
+import "sync"
+
+type flight struct {
+	wg  sync.WaitGroup
+	val interface{}
+	err error
+}
+
+// SingleFlight suppress the duplicate calls of the same key, the calls of a key made while
+// the first one is in flight wait for it and share its result
+type SingleFlight struct {
+	lock    sync.Mutex
+	flights map[string]*flight
+}
+
+// Do call fn once for the calls of key in flight
+func (s *SingleFlight) Do(key string, fn func() (interface{}, error)) (interface{}, error) {
+	s.lock.Lock()
+	if s.flights == nil {
+		s.flights = map[string]*flight{}
+	}
+	if f, ok := s.flights[key]; ok {
+		s.lock.Unlock()
+		f.wg.Wait()
+		return f.val, f.err
+	}
+	f := &flight{}
+	f.wg.Add(1)
+	s.flights[key] = f
+	s.lock.Unlock()
+
+	defer func() {
+		s.lock.Lock()
+		delete(s.flights, key)
+		s.lock.Unlock()
+		f.wg.Done()
+	}()
+	f.val, f.err = fn()
+	return f.val, f.err
+}
@@ -0,0 +1,42 @@
+package utils
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSingleFlight(t *testing.T) {
+	var s SingleFlight
+	var calls int32
+	var wg sync.WaitGroup
+	start := make(chan struct{})
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			val, err := s.Do("key", func() (interface{}, error) {
+				atomic.AddInt32(&calls, 1)
+				time.Sleep(50 * time.Millisecond)
+				return "val", nil
+			})
+			if err != nil || val != "val" {
+				t.Errorf("unexpected result [%v] [%v]", val, err)
+			}
+		}()
+	}
+	close(start)
+	wg.Wait()
+	if calls != 1 {
+		t.Fatalf("fn called [%d] times", calls)
+	}
+	s.Do("key", func() (interface{}, error) {
+		atomic.AddInt32(&calls, 1)
+		return nil, nil
+	})
+	if calls != 2 {
+		t.Fatalf("fn not called after the flight landed")
+	}
+}